@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxJSONBody bounds the size of JSON request bodies; it is set at startup
+var maxJSONBody int64 = 1 << 20
+
+// eventRequest is the JSON body of POST and PUT on the v1 event endpoints.
+// Pointer fields distinguish "absent" from "empty".
+type eventRequest struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Location    *string   `json:"location"`
+	StartTime   *string   `json:"start_time"`
+	EndTime     *string   `json:"end_time"`
+	RRule       *string   `json:"rrule"`
+	ExDates     *[]string `json:"exdates"`
+	UID         *string   `json:"uid"`
+	AllDay      *bool     `json:"all_day"`
+	TimeZone    *string   `json:"time_zone"`
+	Reminders   *[]int    `json:"reminders"`
+	Tags        *[]string `json:"tags"`
+	Attendees   *[]int    `json:"attendees"`
+	CalendarID  *int      `json:"calendar_id"`
+	// UserID moves the event to another user on PUT
+	UserID *int `json:"user_id"`
+}
+
+// toEvent builds a complete event of the user from a POST or PUT body
+func (req *eventRequest) toEvent(userID int) (Event, error) {
+	event := Event{UserID: userID}
+	if req.Title == nil || *req.Title == "" {
+		return event, invalidf("missing title field")
+	}
+	if req.StartTime == nil {
+		return event, invalidf("missing start_time field")
+	}
+	if req.EndTime == nil {
+		return event, invalidf("missing end_time field")
+	}
+	var timeZone string
+	if req.TimeZone != nil {
+		timeZone = *req.TimeZone
+	}
+	allDay := req.AllDay != nil && *req.AllDay
+	if err := setEventTimes(&event, *req.StartTime, *req.EndTime, timeZone, allDay); err != nil {
+		return event, err
+	}
+	event.Title = *req.Title
+	if req.Description != nil {
+		event.Description = *req.Description
+	}
+	if req.Location != nil {
+		event.Location = *req.Location
+	}
+	if req.RRule != nil {
+		event.RRule = *req.RRule
+	}
+	if req.UID != nil {
+		event.UID = *req.UID
+	}
+	if req.CalendarID != nil {
+		if *req.CalendarID < 0 {
+			return event, invalidf("invalid calendar_id field")
+		}
+		event.CalendarID = *req.CalendarID
+	}
+	if req.Reminders != nil {
+		reminders, err := normalizeReminders(*req.Reminders)
+		if err != nil {
+			return event, err
+		}
+		event.Reminders = reminders
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return event, err
+		}
+		event.Tags = tags
+	}
+	if req.Attendees != nil {
+		if err := event.setAttendees(*req.Attendees); err != nil {
+			return event, err
+		}
+	}
+	if req.ExDates != nil {
+		for _, value := range *req.ExDates {
+			t, err := parseTimeValue(value)
+			if err != nil {
+				return event, invalidf("invalid exdates field: %s", err)
+			}
+			event.ExDates = append(event.ExDates, t)
+		}
+		if len(event.ExDates) > 0 && event.RRule == "" {
+			return event, invalidf("exdates need a recurring event")
+		}
+	}
+	return event, checkFieldSizes(event)
+}
+
+// mergePatch reads a PATCH body as an RFC 7396 JSON Merge Patch and converts
+// it into field updates: absent members stay unchanged and null clears an
+// optional field. A user_id member asks to move the event to that user.
+func mergePatch(w http.ResponseWriter, r *http.Request) (map[string]string, *int, error) {
+	var patch map[string]json.RawMessage
+	if err := decodeJSONBody(w, r, &patch); err != nil {
+		return nil, nil, err
+	}
+	return patchUpdates(patch)
+}
+
+// patchUpdates converts the members of a merge patch into field updates
+func patchUpdates(patch map[string]json.RawMessage) (map[string]string, *int, error) {
+	updates := make(map[string]string)
+	var toUserID *int
+	for name, raw := range patch {
+		null := string(raw) == "null"
+		var err error
+		switch name {
+		case "title", "start_time", "end_time":
+			if null {
+				return nil, nil, invalidf("%s cannot be null", name)
+			}
+			var value string
+			err = json.Unmarshal(raw, &value)
+			updates[name] = value
+		case "description", "location", "rrule", "time_zone":
+			var value string
+			if !null {
+				err = json.Unmarshal(raw, &value)
+			}
+			updates[name] = value
+		case "all_day":
+			var value bool
+			if !null {
+				err = json.Unmarshal(raw, &value)
+			}
+			updates[name] = strconv.FormatBool(value)
+		case "exdates", "tags":
+			var values []string
+			if !null {
+				err = json.Unmarshal(raw, &values)
+			}
+			updates[name] = strings.Join(values, ",")
+		case "reminders", "attendees":
+			var values []int
+			if !null {
+				err = json.Unmarshal(raw, &values)
+			}
+			numbers := make([]string, len(values))
+			for i, n := range values {
+				numbers[i] = strconv.Itoa(n)
+			}
+			updates[name] = strings.Join(numbers, ",")
+		case "calendar_id":
+			var value int
+			if !null {
+				err = json.Unmarshal(raw, &value)
+			}
+			updates[name] = strconv.Itoa(value)
+		case "user_id":
+			if null {
+				return nil, nil, invalidf("user_id cannot be null")
+			}
+			toUserID = new(int)
+			err = json.Unmarshal(raw, toUserID)
+		case "uid":
+			return nil, nil, invalidf("uid can only be changed with PUT")
+		default:
+			return nil, nil, invalidf("unknown field %q", name)
+		}
+		if err != nil {
+			return nil, nil, invalidf("invalid %s field: %s", name, err)
+		}
+	}
+	return updates, toUserID, nil
+}
+
+// decodeJSONBody reads a single JSON object from the request body
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") &&
+		!strings.HasPrefix(ct, "application/merge-patch+json") {
+		return invalidf("unsupported content type %q", ct)
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return invalidf("invalid JSON body: %s", err)
+	}
+	if decoder.More() {
+		return invalidf("invalid JSON body: unexpected data after object")
+	}
+	return nil
+}
+
+// pathInt reads an integer wildcard of the request path
+func pathInt(r *http.Request, key string) (int, error) {
+	i, err := strconv.Atoi(r.PathValue(key))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in path", key)
+	}
+	return i, nil
+}
+
+// errorStatus maps an error kind to an HTTP status code
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errConflict):
+		return http.StatusConflict
+	case errors.Is(err, errInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errPrecondition):
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// respondWithStoreError sends an error with the status matching its kind
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	if respondWithConflict(w, err) {
+		return
+	}
+	respondWithError(w, errorStatus(err), err.Error())
+}
+
+// eventLocation is the URL of a single event resource
+func eventLocation(userID, eventID int) string {
+	return fmt.Sprintf("/v1/users/%d/events/%d", userID, eventID)
+}
+
+// methodNotAllowed answers any method that has no handler registered for a path
+func methodNotAllowed(allowed ...string) http.HandlerFunc {
+	allow := strings.Join(allowed, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		respondWithError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// handleMethod registers a handler for a single method of a path and answers
+// every other method with 405
+func handleMethod(mux *http.ServeMux, method, path string, handler http.HandlerFunc) {
+	mux.HandleFunc(method+" "+path, handler)
+	if method == http.MethodGet {
+		mux.HandleFunc(path, methodNotAllowed(http.MethodGet, http.MethodHead))
+	} else {
+		mux.HandleFunc(path, methodNotAllowed(method))
+	}
+}
+
+// registerAPIRoutes registers the v1 REST API. Method-less patterns are less
+// specific than the method ones, so they only catch unsupported methods.
+func registerAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/users/{user_id}/events", listEventsV1)
+	mux.HandleFunc("POST /v1/users/{user_id}/events", idempotent(createEventV1))
+	mux.HandleFunc("/v1/users/{user_id}/events", methodNotAllowed("GET", "HEAD", "POST"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/events/{event_id}", getEventV1)
+	mux.HandleFunc("PUT /v1/users/{user_id}/events/{event_id}", replaceEventV1)
+	mux.HandleFunc("PATCH /v1/users/{user_id}/events/{event_id}", patchEventV1)
+	mux.HandleFunc("DELETE /v1/users/{user_id}/events/{event_id}", deleteEventV1)
+	mux.HandleFunc("/v1/users/{user_id}/events/{event_id}", methodNotAllowed("GET", "HEAD", "PUT", "PATCH", "DELETE"))
+
+	mux.HandleFunc("POST /v1/users/{user_id}/bulk", idempotent(bulkEventsV1))
+	mux.HandleFunc("/v1/users/{user_id}/bulk", methodNotAllowed("POST"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/events/{event_id}/history", eventHistoryV1)
+	mux.HandleFunc("/v1/users/{user_id}/events/{event_id}/history", methodNotAllowed("GET", "HEAD"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/trash", listTrashV1)
+	mux.HandleFunc("/v1/users/{user_id}/trash", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("POST /v1/users/{user_id}/trash/{event_id}/restore", restoreEventV1)
+	mux.HandleFunc("/v1/users/{user_id}/trash/{event_id}/restore", methodNotAllowed("POST"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/settings", getUserSettingsV1)
+	mux.HandleFunc("PATCH /v1/users/{user_id}/settings", patchUserSettingsV1)
+	mux.HandleFunc("/v1/users/{user_id}/settings", methodNotAllowed("GET", "HEAD", "PATCH"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/changes", streamChangesV1)
+	mux.HandleFunc("/v1/users/{user_id}/changes", methodNotAllowed("GET", "HEAD"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/invitations", listInvitationsV1)
+	mux.HandleFunc("/v1/users/{user_id}/invitations", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("PUT /v1/users/{user_id}/invitations/{event_id}", respondInvitationV1)
+	mux.HandleFunc("/v1/users/{user_id}/invitations/{event_id}", methodNotAllowed("PUT"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/reminders", listRemindersV1)
+	mux.HandleFunc("/v1/users/{user_id}/reminders", methodNotAllowed("GET", "HEAD"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/reports/tags", tagReportV1)
+	mux.HandleFunc("/v1/users/{user_id}/reports/tags", methodNotAllowed("GET", "HEAD"))
+
+	mux.HandleFunc("GET /v1/users/{user_id}/calendars", listCalendarsV1)
+	mux.HandleFunc("POST /v1/users/{user_id}/calendars", idempotent(createCalendarV1))
+	mux.HandleFunc("/v1/users/{user_id}/calendars", methodNotAllowed("GET", "HEAD", "POST"))
+
+	mux.HandleFunc("GET /v1/calendars/{calendar_id}", getCalendarV1)
+	mux.HandleFunc("PATCH /v1/calendars/{calendar_id}", patchCalendarV1)
+	mux.HandleFunc("DELETE /v1/calendars/{calendar_id}", deleteCalendarV1)
+	mux.HandleFunc("/v1/calendars/{calendar_id}", methodNotAllowed("GET", "HEAD", "PATCH", "DELETE"))
+	mux.HandleFunc("PUT /v1/calendars/{calendar_id}/shares/{user_id}", shareCalendarV1)
+	mux.HandleFunc("DELETE /v1/calendars/{calendar_id}/shares/{user_id}", unshareCalendarV1)
+	mux.HandleFunc("/v1/calendars/{calendar_id}/shares/{user_id}", methodNotAllowed("PUT", "DELETE"))
+
+	mux.HandleFunc("GET /v1/calendars/{calendar_id}/events", listCalendarEventsV1)
+	mux.HandleFunc("POST /v1/calendars/{calendar_id}/events", idempotent(createCalendarEventV1))
+	mux.HandleFunc("/v1/calendars/{calendar_id}/events", methodNotAllowed("GET", "HEAD", "POST"))
+	mux.HandleFunc("GET /v1/calendars/{calendar_id}/events/{event_id}", getCalendarEventV1)
+	mux.HandleFunc("PATCH /v1/calendars/{calendar_id}/events/{event_id}", patchCalendarEventV1)
+	mux.HandleFunc("DELETE /v1/calendars/{calendar_id}/events/{event_id}", deleteCalendarEventV1)
+	mux.HandleFunc("/v1/calendars/{calendar_id}/events/{event_id}", methodNotAllowed("GET", "HEAD", "PATCH", "DELETE"))
+
+	handleMethod(mux, http.MethodPost, "/v1/admin/tokens", issueTokenV1)
+
+	handleMethod(mux, http.MethodGet, "/v1/freebusy", freeBusyHandler)
+	handleMethod(mux, http.MethodGet, "/v1/slots", slotsHandler)
+}
+
+// Handler for POST /v1/users/{user_id}/events
+func createEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var req eventRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if req.UserID != nil && *req.UserID != userID {
+		respondWithError(w, http.StatusBadRequest, "user_id must match the user in the path")
+		return
+	}
+	event, err := req.toEvent(userID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	eventID := getNextEventID()
+	if strictMode(r.URL.Query(), userID) {
+		err = createEventExclusive(userID, eventID, event, callerOf(r))
+	} else {
+		err = createEvent(userID, eventID, event, callerOf(r))
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	created, err := store.Get(userID, eventID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", eventLocation(userID, eventID))
+	respondWithEvent(w, http.StatusCreated, created)
+}
+
+// Handler for GET /v1/users/{user_id}/events/{event_id}
+func getEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := store.Get(userID, eventID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if notModified(w, r, eventETag(event)) {
+		return
+	}
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// Handler for PUT /v1/users/{user_id}/events/{event_id}; the body replaces
+// every editable field of the event, except that an omitted uid or
+// calendar_id keeps the current one
+func replaceEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req eventRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	replacement, err := req.toEvent(userID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if replacement.RRule != "" {
+		rule, err := parseRRule(replacement.RRule)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		replacement.RRule = rule.String()
+	}
+
+	update := store.Update
+	if strictMode(r.URL.Query(), userID) {
+		update = store.UpdateExclusive
+	}
+	toUserID := userID
+	if req.UserID != nil && *req.UserID != userID {
+		toUserID = *req.UserID
+		if err := authorizeUser(r, toUserID); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		move := store.Move
+		if strictMode(r.URL.Query(), toUserID) {
+			move = store.MoveExclusive
+		}
+		update = func(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+			return move(userID, eventID, toUserID, by, fn)
+		}
+	}
+	check := ifMatch(r)
+	event, err := update(userID, eventID, callerOf(r), func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		if replacement.RRule != "" && event.RecurrenceID != nil {
+			return invalidf("cannot make a single occurrence recurring")
+		}
+		replacement.UserID = event.UserID
+		replacement.EventID = event.EventID
+		replacement.SeriesID = event.SeriesID
+		replacement.RecurrenceID = event.RecurrenceID
+		if replacement.UID == "" {
+			replacement.UID = event.UID
+		}
+		if req.CalendarID == nil {
+			replacement.CalendarID = event.CalendarID
+		}
+		// Attendees that stay invited keep their answer unless the event
+		// is rescheduled
+		guests := replacement.attendeeIDs()
+		rescheduled := replacement.rescheduled(*event)
+		replacement.Attendees = event.Attendees
+		*event = replacement
+		if err := event.setAttendees(guests); err != nil {
+			return err
+		}
+		if rescheduled {
+			event.resetRSVPs()
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if toUserID != userID {
+		w.Header().Set("Content-Location", eventLocation(toUserID, eventID))
+	}
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// Handler for PATCH /v1/users/{user_id}/events/{event_id}; with occurrence
+// and scope query parameters it edits part of a recurring event
+func patchEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	updates, toUserID, err := mergePatch(w, r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if len(updates) == 0 && (toUserID == nil || *toUserID == userID) {
+		respondWithError(w, http.StatusBadRequest, "no updates provided")
+		return
+	}
+
+	queryParams := r.URL.Query()
+	check := ifMatch(r)
+	if toUserID != nil && *toUserID != userID {
+		if queryParams.Get("occurrence") != "" {
+			respondWithError(w, http.StatusBadRequest, "a single occurrence cannot be moved to another user")
+			return
+		}
+		if err := authorizeUser(r, *toUserID); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		move := moveEvent
+		if strictMode(queryParams, *toUserID) {
+			move = moveEventExclusive
+		}
+		event, err := move(userID, eventID, *toUserID, updates, callerOf(r), check)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Location", eventLocation(*toUserID, eventID))
+		respondWithEvent(w, http.StatusOK, event)
+		return
+	}
+	if queryParams.Get("occurrence") != "" {
+		occurrence, err := parseDate(queryParams, "occurrence")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := updateOccurrence(userID, eventID, occurrence, scopeParam(queryParams), updates, strictMode(queryParams, userID), callerOf(r), check); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	} else if strictMode(queryParams, userID) {
+		if err := updateEventExclusive(userID, eventID, updates, callerOf(r), check); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	} else if err := updateEvent(userID, eventID, updates, callerOf(r), check); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	event, err := store.Get(userID, eventID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// Handler for DELETE /v1/users/{user_id}/events/{event_id}; the event goes
+// to the trash
+func deleteEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	if queryParams.Get("occurrence") != "" {
+		occurrence, err := parseDate(queryParams, "occurrence")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = deleteOccurrence(userID, eventID, occurrence, scopeParam(queryParams), callerOf(r), ifMatch(r))
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	} else if err := deleteEvent(userID, eventID, callerOf(r), ifMatch(r)); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventPath reads the user and event IDs of a single event resource
+func eventPath(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return 0, 0, false
+	}
+	eventID, err := pathInt(r, "event_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return 0, 0, false
+	}
+	return userID, eventID, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiTest serves the JSON API on an empty memory store
+type apiTest struct {
+	mux *http.ServeMux
+}
+
+func newAPITest(t *testing.T) *apiTest {
+	saved := store
+	store = newMemoryStore()
+	t.Cleanup(func() { store = saved })
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	return &apiTest{mux: mux}
+}
+
+// do sends a request as caller and returns the status and the decoded JSON
+// body
+func (test *apiTest) do(t *testing.T, caller principal, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), principalKey{}, caller))
+	rec := httptest.NewRecorder()
+	test.mux.ServeHTTP(rec, req)
+
+	var decoded map[string]interface{}
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, rec.Body)
+		}
+	}
+	return rec.Code, decoded
+}
+
+// apiTestTime returns the given hour of March 2, 2026
+func apiTestTime(hour int) time.Time {
+	return time.Date(2026, time.March, 2, hour, 0, 0, 0, time.UTC)
+}
+
+// createTestEvent stores an hour long event of the user starting at the
+// given hour of March 2, 2026
+func createTestEvent(t *testing.T, userID, hour int) Event {
+	event := Event{
+		UserID:    userID,
+		EventID:   store.NextEventID(),
+		Title:     "Meeting",
+		StartTime: apiTestTime(hour),
+		EndTime:   apiTestTime(hour + 1),
+	}
+	if err := store.Create(event, systemActor); err != nil {
+		t.Fatalf("create event: %v", err)
+	}
+	return event
+}
+
+func TestEventExDatesNeedRRule(t *testing.T) {
+	const single = `{"title":"Review","start_time":"2026-03-02T10:00:00Z","end_time":"2026-03-02T11:00:00Z","exdates":["2026-03-03T10:00:00Z"]}`
+	const recurring = `{"title":"Review","start_time":"2026-03-02T10:00:00Z","end_time":"2026-03-02T11:00:00Z","rrule":"FREQ=DAILY","exdates":["2026-03-03T10:00:00Z"]}`
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"create", "POST", single, http.StatusBadRequest},
+		{"create recurring", "POST", recurring, http.StatusCreated},
+		{"replace", "PUT", single, http.StatusBadRequest},
+		{"replace recurring", "PUT", recurring, http.StatusOK},
+		{"patch", "PATCH", `{"exdates":["2026-03-03T10:00:00Z"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := newAPITest(t)
+			event := createTestEvent(t, 1, 10)
+			path := "/v1/users/1/events"
+			if tt.method != "POST" {
+				path += fmt.Sprintf("/%d", event.EventID)
+			}
+			if status, body := test.do(t, principal{UserID: 1}, tt.method, path, tt.body); status != tt.status {
+				t.Errorf("got status %d, want %d: %v", status, tt.status, body)
+			}
+		})
+	}
+}
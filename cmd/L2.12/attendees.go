@@ -0,0 +1,325 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RSVP states of an attendee
+const (
+	rsvpNeedsAction = "needs-action"
+	rsvpAccepted    = "accepted"
+	rsvpDeclined    = "declined"
+	rsvpTentative   = "tentative"
+)
+
+// maxAttendees bounds the guest list of a single event
+const maxAttendees = 200
+
+// Attendee is a user invited to an event by its organizer, the owner of the
+// event, together with the invitee's answer
+type Attendee struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+}
+
+func validRSVP(status string) bool {
+	switch status {
+	case rsvpNeedsAction, rsvpAccepted, rsvpDeclined, rsvpTentative:
+		return true
+	}
+	return false
+}
+
+// attendee returns the invitation of a user, or nil if the user is not
+// invited
+func (e *Event) attendee(userID int) *Attendee {
+	for i := range e.Attendees {
+		if e.Attendees[i].UserID == userID {
+			return &e.Attendees[i]
+		}
+	}
+	return nil
+}
+
+// setAttendees replaces the guest list of an event; users that stay invited
+// keep their answer and new ones start as needs-action
+func (e *Event) setAttendees(userIDs []int) error {
+	if len(userIDs) > maxAttendees {
+		return invalidf("too many attendees: at most %d", maxAttendees)
+	}
+	var attendees []Attendee
+	seen := make(map[int]bool)
+	for _, userID := range userIDs {
+		if userID <= 0 {
+			return invalidf("invalid attendee user ID %d", userID)
+		}
+		if userID == e.UserID {
+			return invalidf("the organizer cannot be an attendee")
+		}
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		status := rsvpNeedsAction
+		if current := e.attendee(userID); current != nil {
+			status = current.Status
+		}
+		attendees = append(attendees, Attendee{UserID: userID, Status: status})
+	}
+	e.Attendees = attendees
+	return nil
+}
+
+// removeAttendee drops a user from the guest list
+func (e *Event) removeAttendee(userID int) {
+	var attendees []Attendee
+	for _, a := range e.Attendees {
+		if a.UserID != userID {
+			attendees = append(attendees, a)
+		}
+	}
+	e.Attendees = attendees
+}
+
+// resetRSVPs asks every attendee to answer again, after the organizer moved
+// the event
+func (e *Event) resetRSVPs() {
+	if len(e.Attendees) == 0 {
+		return
+	}
+	attendees := make([]Attendee, len(e.Attendees))
+	for i, a := range e.Attendees {
+		attendees[i] = Attendee{UserID: a.UserID, Status: rsvpNeedsAction}
+	}
+	e.Attendees = attendees
+}
+
+// parseAttendees parses a comma-separated list of user IDs
+func parseAttendees(value string) ([]int, error) {
+	var userIDs []int
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		userID, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, invalidf("invalid attendees: %q is not a user ID", field)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// Respond records the answer of an invitee on the organizer's event
+func (s *memoryStore) Respond(userID, eventID int, status string, by principal, check eventCheck) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	organizerID, invited := s.invites[userID][eventID]
+	if !invited {
+		return Event{}, notFoundf("user %d is not invited to event ID %d", userID, eventID)
+	}
+	event := s.events[organizerID][eventID]
+	if err := check.verify(event); err != nil {
+		return Event{}, err
+	}
+	// The stored event shares its guest list, so answer on a copy
+	event.Attendees = append([]Attendee(nil), event.Attendees...)
+	event.attendee(userID).Status = status
+	event.Version++
+	if err := s.commit(storeRecord{Op: opPut, Event: &event, Actor: actorOf(by)}); err != nil {
+		return Event{}, err
+	}
+	s.put(event)
+	return event, nil
+}
+
+// organizerOf returns the organizer of an event the user is invited to
+func (s *memoryStore) organizerOf(userID, eventID int) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	organizerID, invited := s.invites[userID][eventID]
+	return organizerID, invited
+}
+
+func (s *memoryStore) Invitations(userID int) []Event {
+	var events []Event
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for eventID, organizerID := range s.invites[userID] {
+		events = append(events, s.events[organizerID][eventID])
+	}
+	return events
+}
+
+// indexAttendees records the invitations of an event
+func (s *memoryStore) indexAttendees(event Event) {
+	for _, a := range event.Attendees {
+		if s.invites[a.UserID] == nil {
+			s.invites[a.UserID] = make(map[int]int)
+		}
+		s.invites[a.UserID][event.EventID] = event.UserID
+	}
+}
+
+// unindexAttendees forgets the invitations of an event
+func (s *memoryStore) unindexAttendees(event Event) {
+	for _, a := range event.Attendees {
+		delete(s.invites[a.UserID], event.EventID)
+		if len(s.invites[a.UserID]) == 0 {
+			delete(s.invites, a.UserID)
+		}
+	}
+}
+
+func (s *fileStore) Respond(userID, eventID int, status string, by principal, check eventCheck) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.Respond(userID, eventID, status, by, check)
+}
+
+// attendeeChanges tells the attendees of an event about a change made by the
+// organizer: users still invited see it created or updated, users dropped
+// from the guest list or whose event was deleted see it deleted. old or event
+// may be nil.
+func attendeeChanges(old, event *Event) []change {
+	var changes []change
+	if event != nil {
+		for _, a := range event.Attendees {
+			kind := changeCreated
+			if old != nil && old.attendee(a.UserID) != nil {
+				kind = changeUpdated
+			}
+			changes = append(changes, change{Type: kind, UserID: a.UserID, EventID: event.EventID, Event: event})
+		}
+	}
+	if old != nil {
+		for _, a := range old.Attendees {
+			if event == nil || event.attendee(a.UserID) == nil {
+				changes = append(changes, change{Type: changeDeleted, UserID: a.UserID, EventID: old.EventID})
+			}
+		}
+	}
+	return changes
+}
+
+// invitedEvents returns the events other users invited userID to and that the
+// user has not declined
+func invitedEvents(userID int) []Event {
+	var events []Event
+	for _, event := range store.Invitations(userID) {
+		if a := event.attendee(userID); a != nil && a.Status != rsvpDeclined {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// respondToInvitation answers an invitation on behalf of userID
+func respondToInvitation(userID, eventID int, status string, by principal, check eventCheck) (Event, error) {
+	if !validRSVP(status) {
+		return Event{}, invalidf("invalid status %q: want needs-action, accepted, declined or tentative", status)
+	}
+	return store.Respond(userID, eventID, status, by, check)
+}
+
+// Handler for POST /respond_event
+func respondEventHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := r.Form
+
+	userID, err := requestUserID(r, params)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	eventID, err := parseInt(params, "event_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := respondToInvitation(userID, eventID, params.Get("status"), callerOf(r), ifMatch(r)); err != nil {
+		respondWithLegacyError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "Response recorded"})
+}
+
+// Handler for GET /v1/users/{user_id}/invitations?status=...&tag=...; lists the
+// events the user is invited to, declined ones included
+func listInvitationsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !validRSVP(status) {
+		respondWithError(w, http.StatusBadRequest, "invalid status parameter")
+		return
+	}
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	events := []Event{}
+	for _, event := range store.Invitations(userID) {
+		if (status == "" || event.attendee(userID).Status == status) && filter.matches(&event) {
+			events = append(events, event)
+		}
+	}
+	sortEvents(events)
+
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": events})
+}
+
+// rsvpRequest is the JSON body of PUT /v1/users/{user_id}/invitations/{event_id}
+type rsvpRequest struct {
+	Status string `json:"status"`
+}
+
+// Handler for PUT /v1/users/{user_id}/invitations/{event_id}
+func respondInvitationV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	eventID, err := pathInt(r, "event_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req rsvpRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	event, err := respondToInvitation(userID, eventID, req.Status, callerOf(r), ifMatch(r))
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// attendeeIDs returns the user IDs of the guest list
+func (e *Event) attendeeIDs() []int {
+	userIDs := make([]int, len(e.Attendees))
+	for i, a := range e.Attendees {
+		userIDs[i] = a.UserID
+	}
+	return userIDs
+}
+
+// rescheduled reports whether the event takes place at other times than old
+func (e *Event) rescheduled(old Event) bool {
+	return !e.StartTime.Equal(old.StartTime) || !e.EndTime.Equal(old.EndTime) || e.RRule != old.RRule
+}
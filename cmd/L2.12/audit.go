@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Audit actions
+const (
+	auditCreated  = "created"
+	auditUpdated  = "updated"
+	auditMoved    = "moved"
+	auditDeleted  = "deleted"
+	auditRestored = "restored"
+	auditPurged   = "purged"
+)
+
+// Actor roles besides the token roles
+const roleSystem = "system"
+
+// auditActor identifies who made a change: a user, an admin acting on the
+// user's behalf, or the server itself
+type auditActor struct {
+	UserID int    `json:"user_id,omitempty"`
+	Role   string `json:"role"`
+}
+
+// systemActor makes the changes of background jobs
+var systemActor = principal{}
+
+// actorOf describes a principal in audit entries; the zero principal is the
+// server itself
+func actorOf(p principal) *auditActor {
+	switch {
+	case p.Admin:
+		return &auditActor{UserID: p.UserID, Role: roleAdmin}
+	case p.UserID == 0:
+		return &auditActor{Role: roleSystem}
+	default:
+		return &auditActor{UserID: p.UserID, Role: roleUser}
+	}
+}
+
+// auditEntry is an immutable record of one change of an event. Before is
+// absent for creations and After for deletions and purges.
+type auditEntry struct {
+	Seq     int64       `json:"seq"`
+	Time    time.Time   `json:"time"`
+	Action  string      `json:"action"`
+	UserID  int         `json:"user_id"`
+	EventID int         `json:"event_id"`
+	Actor   *auditActor `json:"actor,omitempty"`
+	Before  *Event      `json:"before,omitempty"`
+	After   *Event      `json:"after,omitempty"`
+}
+
+// auditLocked appends the audit entries of a record to the log; like
+// changesLocked it runs under the write lock before the record is applied,
+// both for new and for replayed records, so the log is rebuilt from the
+// journal
+func (s *memoryStore) auditLocked(rec storeRecord) {
+	add := func(action string, userID, eventID int, before, after *Event) {
+		entry := s.auditIndex.add(auditEntry{
+			Time:    rec.Time,
+			Action:  action,
+			UserID:  userID,
+			EventID: eventID,
+			Actor:   rec.Actor,
+			Before:  before,
+			After:   after,
+		})
+		s.audit[eventID] = append(s.audit[eventID], entry)
+	}
+	switch rec.Op {
+	case opPut:
+		event := *rec.Event
+		if old, exists := s.events[event.UserID][event.EventID]; exists {
+			add(auditUpdated, event.UserID, event.EventID, &old, &event)
+		} else {
+			add(auditCreated, event.UserID, event.EventID, nil, &event)
+		}
+	case opDelete:
+		if old, exists := s.events[rec.UserID][rec.EventID]; exists {
+			add(auditDeleted, rec.UserID, rec.EventID, &old, nil)
+		}
+	case opMove:
+		for _, event := range rec.Events {
+			event := event
+			if old, exists := s.events[rec.UserID][event.EventID]; exists {
+				add(auditMoved, event.UserID, event.EventID, &old, &event)
+			}
+		}
+	case opRestore:
+		event := *rec.Event
+		if old, exists := s.trash[event.UserID][event.EventID]; exists {
+			add(auditRestored, event.UserID, event.EventID, &old, &event)
+		}
+	case opPurge:
+		for _, event := range rec.Events {
+			event := event
+			add(auditPurged, event.UserID, event.EventID, &event, nil)
+		}
+	}
+}
+
+// History returns the audit entries of an event, oldest first
+func (s *memoryStore) History(eventID int) []auditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]auditEntry(nil), s.audit[eventID]...)
+}
+
+// Changes returns the audit entries that concern the calendar of userID
+// recorded after seq, oldest first, and the sequence number of the latest
+// entry
+func (s *memoryStore) Changes(userID int, seq int64) ([]auditEntry, int64) {
+	return s.auditIndex.since(userID, seq)
+}
+
+// auditIndex numbers the audit entries and keeps them by the users they
+// concern, in sequence order, so that a sync reads the entries of one user
+// after its token instead of the whole log. It has its own lock and is shared
+// by the shards of a sharded store: an entry is numbered and indexed in one
+// step, so no entry up to the latest number can show up later.
+type auditIndex struct {
+	mu     sync.RWMutex
+	latest int64
+	users  map[int][]auditEntry
+}
+
+func newAuditIndex() *auditIndex {
+	return &auditIndex{users: make(map[int][]auditEntry)}
+}
+
+// add indexes an entry and returns it numbered; an entry read back from a
+// snapshot keeps its number. Entries must be added in sequence order.
+func (x *auditIndex) add(entry auditEntry) auditEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if entry.Seq == 0 {
+		entry.Seq = x.latest + 1
+	}
+	x.latest = entry.Seq
+	x.users[entry.UserID] = append(x.users[entry.UserID], entry)
+	if entry.Before != nil && entry.Before.UserID != entry.UserID {
+		x.users[entry.Before.UserID] = append(x.users[entry.Before.UserID], entry)
+	}
+	return entry
+}
+
+// since returns the entries that concern userID numbered after seq, oldest
+// first, and the latest number
+func (x *auditIndex) since(userID int, seq int64) ([]auditEntry, int64) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	entries := x.users[userID]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Seq > seq })
+	return append([]auditEntry(nil), entries[i:]...), x.latest
+}
+
+// involves reports whether an entry concerns the calendar of userID, as the
+// owner of the event before or after the change
+func (e *auditEntry) involves(userID int) bool {
+	return e.UserID == userID || (e.Before != nil && e.Before.UserID == userID)
+}
+
+// Handler for GET /v1/users/{user_id}/events/{event_id}/history; the history
+// of an event stays available after it has been deleted or moved away
+func eventHistoryV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	history := store.History(eventID)
+	visible := false
+	for i := range history {
+		if history[i].involves(userID) {
+			visible = true
+			break
+		}
+	}
+	if !visible {
+		respondWithStoreError(w, notFoundf("no history of event ID %d for user %d", eventID, userID))
+		return
+	}
+
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": history})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token roles
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+const (
+	defaultTokenTTL = 24 * time.Hour
+	maxTokenTTL     = 365 * 24 * time.Hour
+)
+
+// authSecret signs and verifies bearer tokens; it is set at startup
+var authSecret []byte
+
+// tokenClaims is the signed content of a bearer token
+type tokenClaims struct {
+	UserID    int    `json:"sub"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// principal is the authenticated caller of a request
+type principal struct {
+	UserID int
+	Admin  bool
+}
+
+// canActAs reports whether the caller may read and change the calendar of
+// userID; admins act on behalf of every user
+func (p principal) canActAs(userID int) bool {
+	return p.Admin || p.UserID == userID
+}
+
+// key identifies the principal in per-caller state such as rate limits and
+// idempotency keys; an admin token for a user is a separate caller
+func (p principal) key() string {
+	if p.Admin {
+		return "admin:" + strconv.Itoa(p.UserID)
+	}
+	return strconv.Itoa(p.UserID)
+}
+
+type principalKey struct{}
+
+// generateSecret returns a random signing key for servers started without one
+func generateSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// signToken encodes claims as base64url(JSON) "." base64url(HMAC-SHA256)
+func signToken(secret []byte, claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// adminToken signs an admin token valid for defaultTokenTTL; it bootstraps
+// access to the token endpoint
+func adminToken() (string, error) {
+	return signToken(authSecret, tokenClaims{Role: roleAdmin, ExpiresAt: time.Now().Add(defaultTokenTTL).Unix()})
+}
+
+// verifyToken checks the signature and expiry of a token and returns its claims
+func verifyToken(secret []byte, token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, unauthorizedf("malformed token")
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return claims, unauthorizedf("malformed token")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return claims, unauthorizedf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, unauthorizedf("malformed token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, unauthorizedf("malformed token")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, unauthorizedf("token has expired")
+	}
+	if claims.Role != roleUser && claims.Role != roleAdmin {
+		return claims, unauthorizedf("token has an unknown role")
+	}
+	return claims, nil
+}
+
+// authMiddleware rejects requests without a valid bearer token and makes
+// the caller available to the handlers. Calendar apps that only speak HTTP
+// Basic authentication send the token as the password; the user name is
+// ignored.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, _ = r.BasicAuth()
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="calendar"`)
+			respondWithError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		claims, err := verifyToken(authSecret, strings.TrimSpace(token), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar", error="invalid_token"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="calendar"`)
+			respondWithStoreError(w, err)
+			return
+		}
+		caller := principal{UserID: claims.UserID, Admin: claims.Role == roleAdmin}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, caller)))
+	})
+}
+
+// callerOf returns the authenticated caller of a request
+func callerOf(r *http.Request) principal {
+	caller, _ := r.Context().Value(principalKey{}).(principal)
+	return caller
+}
+
+// authorizeUser fails with a forbidden error unless the caller may act on
+// the calendar of userID
+func authorizeUser(r *http.Request, userID int) error {
+	if !callerOf(r).canActAs(userID) {
+		return forbiddenf("not allowed to access the calendar of user %d", userID)
+	}
+	return nil
+}
+
+// requestUserID returns the user a form or query request acts on: the
+// user_id parameter if given, the caller otherwise
+func requestUserID(r *http.Request, params url.Values) (int, error) {
+	if params.Get("user_id") == "" {
+		caller := callerOf(r)
+		if caller.Admin && caller.UserID == 0 {
+			return 0, invalidf("missing user_id parameter")
+		}
+		return caller.UserID, nil
+	}
+	userID, err := parseInt(params, "user_id")
+	if err != nil {
+		return 0, invalidf("%v", err)
+	}
+	return userID, authorizeUser(r, userID)
+}
+
+// pathUserID returns the {user_id} of a v1 request the caller may act on
+func pathUserID(r *http.Request) (int, error) {
+	userID, err := pathInt(r, "user_id")
+	if err != nil {
+		return 0, invalidf("%v", err)
+	}
+	return userID, authorizeUser(r, userID)
+}
+
+// tokenRequest is the JSON body of POST /v1/admin/tokens
+type tokenRequest struct {
+	UserID *int   `json:"user_id"`
+	Role   string `json:"role"`
+	TTL    string `json:"ttl"`
+}
+
+// Handler for POST /v1/admin/tokens
+func issueTokenV1(w http.ResponseWriter, r *http.Request) {
+	if !callerOf(r).Admin {
+		respondWithError(w, http.StatusForbidden, "only admins can issue tokens")
+		return
+	}
+
+	var req tokenRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUser
+	}
+	if req.Role != roleUser && req.Role != roleAdmin {
+		respondWithError(w, http.StatusBadRequest, "role must be user or admin")
+		return
+	}
+	if req.UserID == nil && req.Role == roleUser {
+		respondWithError(w, http.StatusBadRequest, "missing user_id field")
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxTokenTTL {
+			respondWithError(w, http.StatusBadRequest, "invalid ttl field: want a positive duration of at most "+strconv.Itoa(int(maxTokenTTL.Hours()))+"h")
+			return
+		}
+		ttl = d
+	}
+
+	claims := tokenClaims{Role: req.Role, ExpiresAt: time.Now().Add(ttl).Unix()}
+	if req.UserID != nil {
+		claims.UserID = *req.UserID
+	}
+	token, err := signToken(authSecret, claims)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, map[string]interface{}{"result": map[string]interface{}{
+		"token":      token,
+		"user_id":    claims.UserID,
+		"role":       claims.Role,
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	}})
+}
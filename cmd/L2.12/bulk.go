@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// maxBatchOps bounds the operations of a bulk request
+const maxBatchOps = 500
+
+// Batch operation kinds
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// errNotApplied is the outcome of the valid operations of an atomic batch in
+// which another operation failed
+var errNotApplied = errors.New("not applied because another operation of the batch failed")
+
+// batchOp is a single write of a batch
+type batchOp struct {
+	Kind string
+	// EventID is the event to update or delete
+	EventID int
+	// Event is the new event of a create; the store assigns its ID unless
+	// it carries one reserved with NextEventID
+	Event Event
+	// Update changes a copy of the event to update
+	Update func(*Event) error
+	// Check, if not nil, can veto an update or delete
+	Check eventCheck
+	// Exclusive rejects a create or update with a *conflictError when the
+	// result overlaps events it did not overlap before; events written by
+	// the same batch are not checked
+	Exclusive bool
+	// Replaces is the event an exclusive create stands in for, such as the
+	// occurrence an edited occurrence detaches from its series; overlaps it
+	// already had are allowed
+	Replaces *Event
+}
+
+// batchOutcome is the result of one operation: the written event, or why
+// the operation failed
+type batchOutcome struct {
+	Event Event
+	Err   error
+}
+
+func (s *memoryStore) Batch(userID int, ops []batchOp, atomic bool, by principal) ([]batchOutcome, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// staged holds the events written by earlier operations of the batch; a
+	// nil entry is a deleted event
+	staged := make(map[int]*Event)
+	lookup := func(eventID int) (Event, error) {
+		if event, ok := staged[eventID]; ok {
+			if event == nil {
+				return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+			}
+			return *event, nil
+		}
+		event, exists := s.events[userID][eventID]
+		if !exists {
+			return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+		}
+		return event, nil
+	}
+
+	outcomes := make([]batchOutcome, len(ops))
+	var recs []storeRecord
+	failed := false
+	// added counts the events the batch adds to the calendar so far
+	added := 0
+	for i, op := range ops {
+		var rec storeRecord
+		// occurrences are the edited occurrences a delete takes along
+		var occurrences []storeRecord
+		var event Event
+		var err error
+		switch op.Kind {
+		case batchCreate:
+			if err = s.checkQuotaLocked(userID, added+1); err != nil {
+				break
+			}
+			event = op.Event
+			event.UserID = userID
+			if err = s.checkCalendarLocked(event); err != nil {
+				break
+			}
+			if op.Exclusive {
+				if conflicts := s.newConflictsLocked(event, op.Replaces, staged); len(conflicts) > 0 {
+					err = &conflictError{Conflicts: conflicts}
+					break
+				}
+			}
+			if event.EventID == 0 {
+				event.EventID = int(s.eventIDs.next())
+			} else if _, taken := lookup(event.EventID); taken == nil {
+				err = conflictf("event ID %d already exists for user %d", event.EventID, userID)
+				break
+			}
+			if err = s.checkUIDLocked(event, staged); err != nil {
+				break
+			}
+			event.Version = 1
+			rec = storeRecord{Op: opPut, Event: &event}
+			staged[event.EventID] = &event
+			added++
+		case batchUpdate:
+			if event, err = lookup(op.EventID); err != nil {
+				break
+			}
+			if err = op.Check.verify(event); err != nil {
+				break
+			}
+			old := event
+			if err = op.Update(&event); err != nil {
+				break
+			}
+			if err = s.checkCalendarLocked(event); err != nil {
+				break
+			}
+			if event.UID != old.UID {
+				if err = s.checkUIDLocked(event, staged); err != nil {
+					break
+				}
+			}
+			if op.Exclusive {
+				if conflicts := s.newConflictsLocked(event, &old, staged); len(conflicts) > 0 {
+					err = &conflictError{Conflicts: conflicts}
+					break
+				}
+			}
+			event.Version = old.Version + 1
+			rec = storeRecord{Op: opPut, Event: &event}
+			staged[event.EventID] = &event
+		case batchDelete:
+			if event, err = lookup(op.EventID); err != nil {
+				break
+			}
+			if err = op.Check.verify(event); err != nil {
+				break
+			}
+			rec = storeRecord{Op: opDelete, UserID: userID, EventID: op.EventID}
+			staged[op.EventID] = nil
+			added--
+			// The edited occurrences of a recurring event go with it
+			for _, eventID := range s.occurrencesLocked(userID, op.EventID, staged) {
+				occurrences = append(occurrences, storeRecord{Op: opDelete, UserID: userID, EventID: eventID})
+				staged[eventID] = nil
+				added--
+			}
+		default:
+			err = invalidf("unknown operation %q", op.Kind)
+		}
+		if err != nil {
+			outcomes[i].Err = err
+			failed = true
+			continue
+		}
+		outcomes[i].Event = event
+		recs = append(recs, rec)
+		recs = append(recs, occurrences...)
+	}
+
+	if failed && atomic {
+		for i := range outcomes {
+			if outcomes[i].Err == nil {
+				outcomes[i] = batchOutcome{Err: errNotApplied}
+			}
+		}
+		return outcomes, nil
+	}
+	if len(recs) == 0 {
+		return outcomes, nil
+	}
+	if err := s.commitBatch(recs, by); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// occurrencesLocked returns the IDs of the edited occurrences of a
+// recurring event, as the batch has staged them so far; the caller must hold
+// the lock
+func (s *memoryStore) occurrencesLocked(userID, seriesID int, staged map[int]*Event) []int {
+	var eventIDs []int
+	for eventID, event := range s.events[userID] {
+		if _, ok := staged[eventID]; !ok && event.SeriesID == seriesID {
+			eventIDs = append(eventIDs, eventID)
+		}
+	}
+	for eventID, event := range staged {
+		if event != nil && event.SeriesID == seriesID {
+			eventIDs = append(eventIDs, eventID)
+		}
+	}
+	sort.Ints(eventIDs)
+	return eventIDs
+}
+
+func (s *fileStore) Batch(userID int, ops []batchOp, atomic bool, by principal) ([]batchOutcome, error) {
+	defer s.compact()
+	return s.memoryStore.Batch(userID, ops, atomic, by)
+}
+
+// applyBatch runs operations as an atomic batch and returns the error of
+// the one that failed
+func applyBatch(userID int, ops []batchOp, by principal) error {
+	outcomes, err := store.Batch(userID, ops, true, by)
+	if err != nil {
+		return err
+	}
+	for _, outcome := range outcomes {
+		if outcome.Err != nil && outcome.Err != errNotApplied {
+			return outcome.Err
+		}
+	}
+	return nil
+}
+
+// bulkRequest is the JSON body of POST /v1/users/{user_id}/bulk
+type bulkRequest struct {
+	// Atomic applies either every operation or none
+	Atomic     bool            `json:"atomic"`
+	Operations []bulkOperation `json:"operations"`
+}
+
+// bulkOperation is one operation of a bulk request. Event is the complete
+// event of a create and a JSON Merge Patch for an update.
+type bulkOperation struct {
+	Op      string          `json:"op"`
+	EventID int             `json:"event_id"`
+	Event   json.RawMessage `json:"event"`
+	IfMatch string          `json:"if_match"`
+}
+
+// bulkResult reports the outcome of one operation with an HTTP status
+type bulkResult struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Status  int    `json:"status"`
+	EventID int    `json:"event_id,omitempty"`
+	Event   *Event `json:"event,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// decodeStrict decodes a JSON value, rejecting unknown fields
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// toBatchOp validates a bulk operation of the user and converts it into a
+// store operation; with strict, creates and updates must not add overlaps
+func (o *bulkOperation) toBatchOp(userID int, strict bool) (batchOp, error) {
+	op := batchOp{Kind: o.Op, EventID: o.EventID, Check: ifMatchValue(o.IfMatch)}
+	switch o.Op {
+	case batchCreate:
+		if len(o.Event) == 0 {
+			return op, invalidf("missing event field")
+		}
+		var req eventRequest
+		if err := decodeStrict(o.Event, &req); err != nil {
+			return op, invalidf("invalid event field: %s", err)
+		}
+		if req.UserID != nil && *req.UserID != userID {
+			return op, invalidf("user_id must match the user in the path")
+		}
+		event, err := req.toEvent(userID)
+		if err != nil {
+			return op, err
+		}
+		if err := normalizeRRule(&event); err != nil {
+			return op, err
+		}
+		op.Event = event
+		op.Exclusive = strict
+	case batchUpdate:
+		var patch map[string]json.RawMessage
+		if err := decodeStrict(o.Event, &patch); err != nil || patch == nil {
+			return op, invalidf("invalid event field: want a merge patch object")
+		}
+		updates, toUserID, err := patchUpdates(patch)
+		if err != nil {
+			return op, err
+		}
+		if toUserID != nil && *toUserID != userID {
+			return op, invalidf("events cannot be moved in bulk")
+		}
+		if len(updates) == 0 {
+			return op, invalidf("no updates provided")
+		}
+		op.Update = func(event *Event) error {
+			return applyUpdates(event, updates)
+		}
+		op.Exclusive = strict
+	case batchDelete:
+		if len(o.Event) > 0 {
+			return op, invalidf("a delete takes no event field")
+		}
+	default:
+		return op, invalidf("unknown op %q: want create, update or delete", o.Op)
+	}
+	if o.Op != batchCreate && o.EventID <= 0 {
+		return op, invalidf("missing event_id field")
+	}
+	return op, nil
+}
+
+// Handler for POST /v1/users/{user_id}/bulk. Without atomic every
+// operation succeeds or fails on its own and the response is 200 with the
+// result of each; with atomic a single failure rejects the whole request
+// with the status of the first failed operation.
+func bulkEventsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var req bulkRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if len(req.Operations) == 0 {
+		respondWithError(w, http.StatusBadRequest, "missing operations field")
+		return
+	}
+	if len(req.Operations) > maxBatchOps {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("too many operations: at most %d", maxBatchOps))
+		return
+	}
+
+	// Operations that are invalid on their own never reach the store
+	strict := strictMode(r.URL.Query(), userID)
+	outcomes := make([]batchOutcome, len(req.Operations))
+	var ops []batchOp
+	var indexes []int
+	for i := range req.Operations {
+		op, err := req.Operations[i].toBatchOp(userID, strict)
+		if err != nil {
+			outcomes[i].Err = err
+			continue
+		}
+		ops = append(ops, op)
+		indexes = append(indexes, i)
+	}
+	if req.Atomic && len(ops) < len(req.Operations) {
+		for _, i := range indexes {
+			outcomes[i].Err = errNotApplied
+		}
+	} else if len(ops) > 0 {
+		applied, err := store.Batch(userID, ops, req.Atomic, callerOf(r))
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		for j, i := range indexes {
+			outcomes[i] = applied[j]
+		}
+	}
+
+	results := make([]bulkResult, len(outcomes))
+	var firstErr error
+	for i, outcome := range outcomes {
+		op := req.Operations[i]
+		result := bulkResult{Index: i, Op: op.Op, EventID: op.EventID}
+		switch {
+		case outcome.Err == errNotApplied:
+			result.Status = http.StatusFailedDependency
+			result.Error = outcome.Err.Error()
+		case outcome.Err != nil:
+			result.Status = errorStatus(outcome.Err)
+			result.Error = outcome.Err.Error()
+			if firstErr == nil {
+				firstErr = outcome.Err
+			}
+		case op.Op == batchDelete:
+			result.Status = http.StatusNoContent
+		default:
+			event := outcome.Event
+			result.EventID = event.EventID
+			result.Event = &event
+			result.Status = http.StatusOK
+			if op.Op == batchCreate {
+				result.Status = http.StatusCreated
+			}
+		}
+		results[i] = result
+	}
+
+	if req.Atomic && firstErr != nil {
+		respondWithJSON(w, errorStatus(firstErr), withRequestID(w, map[string]interface{}{
+			"error":   "batch rejected: " + firstErr.Error(),
+			"results": results,
+		}))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": results})
+}
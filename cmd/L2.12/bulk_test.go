@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bulkCreate is a bulk create of an hour long event at the given hour of
+// March 2, 2026
+func bulkCreate(hour int, calendarID int) string {
+	return fmt.Sprintf(`{"op":"create","event":{"title":"Bulk","start_time":%q,"end_time":%q,"calendar_id":%d}}`,
+		apiTestTime(hour).Format(time.RFC3339), apiTestTime(hour+1).Format(time.RFC3339), calendarID)
+}
+
+// bulkStatuses returns the status of each operation of a bulk response
+func bulkStatuses(t *testing.T, body map[string]interface{}) []int {
+	results, ok := body["result"].([]interface{})
+	if !ok {
+		results, ok = body["results"].([]interface{})
+	}
+	if !ok {
+		t.Fatalf("no results in %v", body)
+	}
+	statuses := make([]int, len(results))
+	for i, result := range results {
+		statuses[i] = int(result.(map[string]interface{})["status"].(float64))
+	}
+	return statuses
+}
+
+func TestBulkStrictConflicts(t *testing.T) {
+	overlapping := bulkCreate(10, primaryCalendarID)
+	free := bulkCreate(13, primaryCalendarID)
+	tests := []struct {
+		name     string
+		query    string
+		strict   bool
+		atomic   bool
+		ops      string
+		status   int
+		statuses []int
+	}{
+		{"atomic", "?strict=true", false, true, overlapping + "," + free, http.StatusConflict, []int{http.StatusConflict, http.StatusFailedDependency}},
+		{"not atomic", "?strict=true", false, false, overlapping + "," + free, http.StatusOK, []int{http.StatusConflict, http.StatusCreated}},
+		{"strict user", "", true, false, overlapping + "," + free, http.StatusOK, []int{http.StatusConflict, http.StatusCreated}},
+		{"forced", "?force=true", true, false, overlapping + "," + free, http.StatusOK, []int{http.StatusCreated, http.StatusCreated}},
+		{"not strict", "", false, false, overlapping + "," + free, http.StatusOK, []int{http.StatusCreated, http.StatusCreated}},
+		{"update", "?strict=true", false, false, `{"op":"update","event_id":2,"event":{"start_time":"2026-03-02T10:30:00Z","end_time":"2026-03-02T11:30:00Z"}}`, http.StatusOK, []int{http.StatusConflict}},
+		{"events of the batch", "?strict=true", false, false, free + "," + bulkCreate(13, primaryCalendarID), http.StatusOK, []int{http.StatusCreated, http.StatusCreated}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := newAPITest(t)
+			store.PutUser(User{UserID: 1, StrictConflicts: tt.strict})
+			createTestEvent(t, 1, 10)
+			createTestEvent(t, 1, 15)
+
+			body := fmt.Sprintf(`{"atomic":%t,"operations":[%s]}`, tt.atomic, tt.ops)
+			status, resp := test.do(t, principal{UserID: 1}, "POST", "/v1/users/1/bulk"+tt.query, body)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d: %v", status, tt.status, resp)
+			}
+			if got := bulkStatuses(t, resp); !reflect.DeepEqual(got, tt.statuses) {
+				t.Errorf("got statuses %v, want %v", got, tt.statuses)
+			}
+		})
+	}
+}
+
+func TestBulkDeleteSeries(t *testing.T) {
+	test := newAPITest(t)
+	series := Event{
+		UserID:    1,
+		EventID:   store.NextEventID(),
+		Title:     "Standup",
+		StartTime: apiTestTime(9),
+		EndTime:   apiTestTime(10),
+		RRule:     "FREQ=DAILY",
+	}
+	if err := store.Create(series, systemActor); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateOccurrence(1, series.EventID, apiTestTime(9).AddDate(0, 0, 1), scopeThis, map[string]string{"title": "Moved"}, false, systemActor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(store.List(1)); got != 2 {
+		t.Fatalf("got %d events before the delete, want the series and its edited occurrence", got)
+	}
+
+	body := fmt.Sprintf(`{"atomic":true,"operations":[{"op":"delete","event_id":%d}]}`, series.EventID)
+	status, resp := test.do(t, principal{UserID: 1}, "POST", "/v1/users/1/bulk", body)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %v", status, resp)
+	}
+	if got := bulkStatuses(t, resp); !reflect.DeepEqual(got, []int{http.StatusNoContent}) {
+		t.Errorf("got statuses %v", got)
+	}
+	if events := store.List(1); len(events) != 0 {
+		t.Errorf("got %d events left, want none: %+v", len(events), events)
+	}
+	if trash := store.Trash(1); len(trash) != 2 {
+		t.Errorf("got %d events in the trash, want 2", len(trash))
+	}
+}
+
+func TestBulkQuotaCountsAppliedCreates(t *testing.T) {
+	limit := maxEventsPerUser
+	maxEventsPerUser = 3
+	t.Cleanup(func() { maxEventsPerUser = limit })
+	test := newAPITest(t)
+	createTestEvent(t, 1, 8)
+
+	// The create into a missing calendar fails and leaves room for two
+	ops := bulkCreate(10, 99) + "," + bulkCreate(11, primaryCalendarID) + "," + bulkCreate(12, primaryCalendarID) + "," + bulkCreate(13, primaryCalendarID)
+	status, resp := test.do(t, principal{UserID: 1}, "POST", "/v1/users/1/bulk", `{"operations":[`+ops+`]}`)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %v", status, resp)
+	}
+	want := []int{http.StatusBadRequest, http.StatusCreated, http.StatusCreated, http.StatusForbidden}
+	if got := bulkStatuses(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("got statuses %v, want %v", got, want)
+	}
+}
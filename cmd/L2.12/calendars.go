@@ -0,0 +1,769 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// primaryCalendarID is the calendar of events that name no other. Every user
+// has one; it is private and reached through /v1/users/{user_id}/events.
+const primaryCalendarID = 0
+
+const (
+	primaryCalendarName = "Primary"
+	maxCalendarName     = 100
+	// busyTitle replaces the title of events shown to free/busy viewers
+	busyTitle = "Busy"
+)
+
+// Calendar access levels, weakest first. Free/busy viewers only see when the
+// events are; the owner, and admins, can also rename, share and delete.
+const (
+	accessFreeBusy = "freebusy"
+	accessRead     = "read"
+	accessWrite    = "write"
+	accessOwner    = "owner"
+)
+
+var accessRank = map[string]int{accessFreeBusy: 1, accessRead: 2, accessWrite: 3, accessOwner: 4}
+
+// Calendar is a named calendar of a user that can be shared with others
+type Calendar struct {
+	CalendarID int    `json:"calendar_id"`
+	UserID     int    `json:"user_id"`
+	Name       string `json:"name"`
+	// Shares maps the users the calendar is shared with to their access
+	Shares  map[int]string `json:"shares,omitempty"`
+	Version int            `json:"version"`
+}
+
+// accessOf returns the access of a principal to the calendar, or "" for none
+func (c *Calendar) accessOf(p principal) string {
+	if p.canActAs(c.UserID) {
+		return accessOwner
+	}
+	return c.Shares[p.UserID]
+}
+
+// allows reports whether access grants at least the level need
+func allows(access, need string) bool {
+	return access != "" && accessRank[access] >= accessRank[need]
+}
+
+// parseCalendarID parses the calendar_id of an event; empty is the primary
+// calendar
+func parseCalendarID(value string) (int, error) {
+	if value == "" {
+		return primaryCalendarID, nil
+	}
+	calendarID, err := strconv.Atoi(value)
+	if err != nil || calendarID < 0 {
+		return 0, invalidf("invalid calendar_id %q", value)
+	}
+	return calendarID, nil
+}
+
+// checkCalendarLocked fails unless the calendar of the event belongs to the
+// owner of the event; the caller must hold the lock
+func (s *memoryStore) checkCalendarLocked(event Event) error {
+	if event.CalendarID == primaryCalendarID {
+		return nil
+	}
+	if cal, exists := s.calendars[event.CalendarID]; !exists || cal.UserID != event.UserID {
+		return invalidf("calendar %d does not exist for user %d", event.CalendarID, event.UserID)
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateCalendar(cal Calendar) (Calendar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cal.CalendarID = int(s.calendarIDs.next())
+	cal.Version = 1
+	if err := s.commit(storeRecord{Op: opCalendar, Calendar: &cal}); err != nil {
+		return Calendar{}, err
+	}
+	s.calendars[cal.CalendarID] = cal
+	return cal, nil
+}
+
+func (s *memoryStore) UpdateCalendar(calendarID int, fn func(*Calendar) error) (Calendar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cal, exists := s.calendars[calendarID]
+	if !exists {
+		return Calendar{}, notFoundf("calendar %d not found", calendarID)
+	}
+	// fn gets its own copy of the shares
+	shares := make(map[int]string, len(cal.Shares))
+	for userID, access := range cal.Shares {
+		shares[userID] = access
+	}
+	cal.Shares = shares
+	if err := fn(&cal); err != nil {
+		return Calendar{}, err
+	}
+	if len(cal.Shares) == 0 {
+		cal.Shares = nil
+	}
+	cal.Version++
+	if err := s.commit(storeRecord{Op: opCalendar, Calendar: &cal}); err != nil {
+		return Calendar{}, err
+	}
+	s.calendars[calendarID] = cal
+	return cal, nil
+}
+
+// DeleteCalendar removes a calendar that has no events left. Events of it in
+// the trash stay there; Restore puts them into the primary calendar.
+func (s *memoryStore) DeleteCalendar(calendarID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cal, exists := s.calendars[calendarID]
+	if !exists {
+		return notFoundf("calendar %d not found", calendarID)
+	}
+	for _, event := range s.events[cal.UserID] {
+		if event.CalendarID == calendarID {
+			return conflictf("calendar %d still has events", calendarID)
+		}
+	}
+	if err := s.commit(storeRecord{Op: opDeleteCalendar, Calendar: &cal}); err != nil {
+		return err
+	}
+	delete(s.calendars, calendarID)
+	return nil
+}
+
+func (s *memoryStore) Calendar(calendarID int) (Calendar, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cal, exists := s.calendars[calendarID]
+	if !exists {
+		return Calendar{}, notFoundf("calendar %d not found", calendarID)
+	}
+	return cal, nil
+}
+
+func (s *memoryStore) Calendars(userID int) []Calendar {
+	var calendars []Calendar
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cal := range s.calendars {
+		if _, shared := cal.Shares[userID]; shared || cal.UserID == userID {
+			calendars = append(calendars, cal)
+		}
+	}
+	return calendars
+}
+
+func (s *fileStore) CreateCalendar(cal Calendar) (Calendar, error) {
+	defer s.compact()
+	return s.memoryStore.CreateCalendar(cal)
+}
+
+func (s *fileStore) UpdateCalendar(calendarID int, fn func(*Calendar) error) (Calendar, error) {
+	defer s.compact()
+	return s.memoryStore.UpdateCalendar(calendarID, fn)
+}
+
+func (s *fileStore) DeleteCalendar(calendarID int) error {
+	defer s.compact()
+	return s.memoryStore.DeleteCalendar(calendarID)
+}
+
+// busyOnly hides everything but the time of an event from free/busy viewers
+func busyOnly(event Event) Event {
+	return Event{
+		UserID:       event.UserID,
+		EventID:      event.EventID,
+		CalendarID:   event.CalendarID,
+		Title:        busyTitle,
+		StartTime:    event.StartTime,
+		EndTime:      event.EndTime,
+		AllDay:       event.AllDay,
+		TimeZone:     event.TimeZone,
+		RecurrenceID: event.RecurrenceID,
+		SeriesID:     event.SeriesID,
+	}
+}
+
+// getCalendarEventsForRange is getEventsForRange for a single calendar,
+// without invitations; free/busy viewers get the events with busyOnly
+func getCalendarEventsForRange(cal Calendar, access string, startTime, endTime time.Time) []Event {
+	var events []Event
+	for _, event := range getEventsForRange(cal.UserID, startTime, endTime) {
+		if event.UserID != cal.UserID || event.CalendarID != cal.CalendarID {
+			continue
+		}
+		if access == accessFreeBusy {
+			event = busyOnly(event)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// getSelectedEventsForRange returns the events of the calendars userID
+// selects with the calendars parameter of the events_for_* queries: empty
+// for the user's own events and invitations, "all" to merge in every
+// calendar shared with the user, or a comma-separated list of calendar IDs,
+// 0 being the user's primary calendar
+func getSelectedEventsForRange(userID int, selection string, startTime, endTime time.Time) ([]Event, error) {
+	viewer := principal{UserID: userID}
+	var events []Event
+	switch selection {
+	case "":
+		return getEventsForRange(userID, startTime, endTime), nil
+	case "all":
+		events = getEventsForRange(userID, startTime, endTime)
+		for _, cal := range store.Calendars(userID) {
+			if cal.UserID != userID {
+				events = append(events, getCalendarEventsForRange(cal, cal.accessOf(viewer), startTime, endTime)...)
+			}
+		}
+	default:
+		for _, value := range strings.Split(selection, ",") {
+			calendarID, err := parseCalendarID(strings.TrimSpace(value))
+			if err != nil {
+				return nil, err
+			}
+			cal := Calendar{UserID: userID}
+			if calendarID != primaryCalendarID {
+				if cal, err = store.Calendar(calendarID); err != nil {
+					return nil, err
+				}
+			}
+			access := cal.accessOf(viewer)
+			if access == "" {
+				return nil, notFoundf("calendar %d not found", calendarID)
+			}
+			events = append(events, getCalendarEventsForRange(cal, access, startTime, endTime)...)
+		}
+	}
+
+	// An invitation to an event of a shared calendar is listed once
+	type occurrence struct {
+		userID, eventID int
+		start           int64
+	}
+	seen := make(map[occurrence]bool)
+	unique := events[:0]
+	for _, event := range events {
+		key := occurrence{event.UserID, event.EventID, event.StartTime.UnixNano()}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, event)
+		}
+	}
+	sortEvents(unique)
+	return unique, nil
+}
+
+// inCalendar extends check to veto events of other calendars, which the
+// routes of a calendar must not reach
+func inCalendar(calendarID int, check eventCheck) eventCheck {
+	return func(event Event) error {
+		if event.CalendarID != calendarID {
+			return notFoundf("event ID %d not found in calendar %d", event.EventID, calendarID)
+		}
+		return check.verify(event)
+	}
+}
+
+func calendarLocation(calendarID int) string {
+	return fmt.Sprintf("/v1/calendars/%d", calendarID)
+}
+
+func calendarEventLocation(calendarID, eventID int) string {
+	return fmt.Sprintf("/v1/calendars/%d/events/%d", calendarID, eventID)
+}
+
+// calendarView is a calendar as seen by one user; only the owner sees the
+// shares
+type calendarView struct {
+	Calendar
+	Access string `json:"access"`
+}
+
+func viewOf(cal Calendar, access string) calendarView {
+	if access != accessOwner {
+		cal.Shares = nil
+	}
+	return calendarView{Calendar: cal, Access: access}
+}
+
+// calendarRequest is the JSON body of POST and PATCH on calendars
+type calendarRequest struct {
+	Name *string `json:"name"`
+}
+
+func (req *calendarRequest) name() (string, error) {
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		return "", invalidf("missing name field")
+	}
+	name := strings.TrimSpace(*req.Name)
+	if utf8.RuneCountInString(name) > maxCalendarName {
+		return "", invalidf("name is too long: at most %d characters", maxCalendarName)
+	}
+	return name, nil
+}
+
+// shareRequest is the JSON body of PUT /v1/calendars/{calendar_id}/shares/{user_id}
+type shareRequest struct {
+	Access string `json:"access"`
+}
+
+// calendarPath reads the calendar of a calendar resource and checks that the
+// caller has at least the access need to it. Calendars the caller cannot
+// see at all are reported as not found.
+func calendarPath(w http.ResponseWriter, r *http.Request, need string) (Calendar, string, bool) {
+	calendarID, err := pathInt(r, "calendar_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return Calendar{}, "", false
+	}
+	cal, err := store.Calendar(calendarID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return Calendar{}, "", false
+	}
+	access := cal.accessOf(callerOf(r))
+	switch {
+	case access == "":
+		respondWithStoreError(w, notFoundf("calendar %d not found", calendarID))
+		return Calendar{}, "", false
+	case !allows(access, need):
+		respondWithStoreError(w, forbiddenf("%s access to calendar %d is required", need, calendarID))
+		return Calendar{}, "", false
+	}
+	return cal, access, true
+}
+
+// calendarEventPath is calendarPath for a single event of the calendar
+func calendarEventPath(w http.ResponseWriter, r *http.Request, need string) (Calendar, string, int, bool) {
+	cal, access, ok := calendarPath(w, r, need)
+	if !ok {
+		return Calendar{}, "", 0, false
+	}
+	eventID, err := pathInt(r, "event_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return Calendar{}, "", 0, false
+	}
+	return cal, access, eventID, true
+}
+
+// Handler for GET /v1/users/{user_id}/calendars; lists the primary calendar
+// of the user, the calendars the user owns and those shared with the user
+func listCalendarsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	viewer := principal{UserID: userID}
+	views := []calendarView{{Calendar: Calendar{CalendarID: primaryCalendarID, UserID: userID, Name: primaryCalendarName}, Access: accessOwner}}
+	for _, cal := range store.Calendars(userID) {
+		views = append(views, viewOf(cal, cal.accessOf(viewer)))
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].CalendarID < views[j].CalendarID })
+
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": views})
+}
+
+// Handler for POST /v1/users/{user_id}/calendars
+func createCalendarV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var req calendarRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	name, err := req.name()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	cal, err := store.CreateCalendar(Calendar{UserID: userID, Name: name})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.Header().Set("Location", calendarLocation(cal.CalendarID))
+	respondWithJSON(w, http.StatusCreated, map[string]interface{}{"result": viewOf(cal, accessOwner)})
+}
+
+// Handler for GET /v1/calendars/{calendar_id}
+func getCalendarV1(w http.ResponseWriter, r *http.Request) {
+	cal, access, ok := calendarPath(w, r, accessFreeBusy)
+	if !ok {
+		return
+	}
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": viewOf(cal, access)})
+}
+
+// Handler for PATCH /v1/calendars/{calendar_id}; renames the calendar
+func patchCalendarV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, ok := calendarPath(w, r, accessOwner)
+	if !ok {
+		return
+	}
+
+	var req calendarRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	name, err := req.name()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	cal, err = store.UpdateCalendar(cal.CalendarID, func(cal *Calendar) error {
+		cal.Name = name
+		return nil
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": viewOf(cal, accessOwner)})
+}
+
+// Handler for DELETE /v1/calendars/{calendar_id}; only empty calendars can
+// be deleted
+func deleteCalendarV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, ok := calendarPath(w, r, accessOwner)
+	if !ok {
+		return
+	}
+	if err := store.DeleteCalendar(cal.CalendarID); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for PUT /v1/calendars/{calendar_id}/shares/{user_id}; grants or
+// changes the access of a user
+func shareCalendarV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, ok := calendarPath(w, r, accessOwner)
+	if !ok {
+		return
+	}
+	userID, err := pathInt(r, "user_id")
+	if err != nil || userID <= 0 {
+		respondWithError(w, http.StatusBadRequest, "invalid user_id in path")
+		return
+	}
+	if userID == cal.UserID {
+		respondWithError(w, http.StatusBadRequest, "a calendar cannot be shared with its owner")
+		return
+	}
+
+	var req shareRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if req.Access != accessFreeBusy && req.Access != accessRead && req.Access != accessWrite {
+		respondWithError(w, http.StatusBadRequest, "access must be freebusy, read or write")
+		return
+	}
+
+	cal, err = store.UpdateCalendar(cal.CalendarID, func(cal *Calendar) error {
+		cal.Shares[userID] = req.Access
+		return nil
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": viewOf(cal, accessOwner)})
+}
+
+// Handler for DELETE /v1/calendars/{calendar_id}/shares/{user_id}; the owner
+// revokes a share, or a user leaves a calendar shared with them
+func unshareCalendarV1(w http.ResponseWriter, r *http.Request) {
+	cal, access, ok := calendarPath(w, r, accessFreeBusy)
+	if !ok {
+		return
+	}
+	userID, err := pathInt(r, "user_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if access != accessOwner && callerOf(r).UserID != userID {
+		respondWithStoreError(w, forbiddenf("only the owner can revoke the access of other users"))
+		return
+	}
+
+	_, err = store.UpdateCalendar(cal.CalendarID, func(cal *Calendar) error {
+		if _, shared := cal.Shares[userID]; !shared {
+			return notFoundf("calendar %d is not shared with user %d", cal.CalendarID, userID)
+		}
+		delete(cal.Shares, userID)
+		return nil
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /v1/calendars/{calendar_id}/events; takes the parameters
+// of GET /v1/users/{user_id}/events, except that free/busy viewers cannot
+// search
+func listCalendarEventsV1(w http.ResponseWriter, r *http.Request) {
+	cal, access, ok := calendarPath(w, r, accessFreeBusy)
+	if !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if access == accessFreeBusy && !filter.empty() {
+		respondWithStoreError(w, forbiddenf("free/busy access to calendar %d does not allow searching", cal.CalendarID))
+		return
+	}
+	limit, err := parseLimit(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	loc, err := requestLocation(queryParams, callerOf(r).UserID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	from, to, bounded, err := parseListWindow(queryParams, loc)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var events []Event
+	if bounded {
+		events = getCalendarEventsForRange(cal, access, from, to)
+	} else {
+		for _, event := range store.List(cal.UserID) {
+			if event.CalendarID != cal.CalendarID {
+				continue
+			}
+			if access == accessFreeBusy {
+				event = busyOnly(event)
+			}
+			events = append(events, event)
+		}
+	}
+	page, next, err := paginate(filter.filterEvents(events), queryParams.Get("cursor"), limit)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if page == nil {
+		page = []Event{}
+	}
+
+	response := map[string]interface{}{"result": page}
+	if next != "" {
+		response["next_cursor"] = next
+	}
+	respondWithCacheableJSON(w, r, response)
+}
+
+// Handler for POST /v1/calendars/{calendar_id}/events; the event belongs to
+// the owner of the calendar
+func createCalendarEventV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, ok := calendarPath(w, r, accessWrite)
+	if !ok {
+		return
+	}
+
+	var req eventRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if req.UserID != nil && *req.UserID != cal.UserID {
+		respondWithError(w, http.StatusBadRequest, "user_id must be the owner of the calendar")
+		return
+	}
+	if req.CalendarID != nil && *req.CalendarID != cal.CalendarID {
+		respondWithError(w, http.StatusBadRequest, "calendar_id must match the calendar in the path")
+		return
+	}
+	event, err := req.toEvent(cal.UserID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	event.CalendarID = cal.CalendarID
+	eventID := getNextEventID()
+	if strictMode(r.URL.Query(), cal.UserID) {
+		err = createEventExclusive(cal.UserID, eventID, event, callerOf(r))
+	} else {
+		err = createEvent(cal.UserID, eventID, event, callerOf(r))
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	created, err := store.Get(cal.UserID, eventID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", calendarEventLocation(cal.CalendarID, eventID))
+	respondWithEvent(w, http.StatusCreated, created)
+}
+
+// Handler for GET /v1/calendars/{calendar_id}/events/{event_id}
+func getCalendarEventV1(w http.ResponseWriter, r *http.Request) {
+	cal, access, eventID, ok := calendarEventPath(w, r, accessFreeBusy)
+	if !ok {
+		return
+	}
+
+	event, err := store.Get(cal.UserID, eventID)
+	if err == nil {
+		err = inCalendar(cal.CalendarID, nil).verify(event)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if access == accessFreeBusy {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": busyOnly(event)})
+		return
+	}
+	if notModified(w, r, eventETag(event)) {
+		return
+	}
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// Handler for PATCH /v1/calendars/{calendar_id}/events/{event_id}; takes the
+// body and parameters of PATCH /v1/users/{user_id}/events/{event_id}. The
+// event can change calendars if the caller may write to both, but it
+// cannot change owners.
+func patchCalendarEventV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, eventID, ok := calendarEventPath(w, r, accessWrite)
+	if !ok {
+		return
+	}
+
+	updates, toUserID, err := mergePatch(w, r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if toUserID != nil && *toUserID != cal.UserID {
+		respondWithError(w, http.StatusBadRequest, "events of a calendar cannot be moved to another user")
+		return
+	}
+	if len(updates) == 0 {
+		respondWithError(w, http.StatusBadRequest, "no updates provided")
+		return
+	}
+	targetID := cal.CalendarID
+	if value, ok := updates["calendar_id"]; ok {
+		if targetID, err = parseCalendarID(value); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		target := Calendar{UserID: cal.UserID}
+		if targetID != primaryCalendarID {
+			if target, err = store.Calendar(targetID); err != nil {
+				respondWithStoreError(w, err)
+				return
+			}
+		}
+		if targetID != cal.CalendarID && !allows(target.accessOf(callerOf(r)), accessWrite) {
+			respondWithStoreError(w, forbiddenf("write access to calendar %d is required", targetID))
+			return
+		}
+	}
+
+	queryParams := r.URL.Query()
+	check := inCalendar(cal.CalendarID, ifMatch(r))
+	if queryParams.Get("occurrence") != "" {
+		occurrence, perr := parseDate(queryParams, "occurrence")
+		if perr != nil {
+			respondWithError(w, http.StatusBadRequest, perr.Error())
+			return
+		}
+		err = updateOccurrence(cal.UserID, eventID, occurrence, scopeParam(queryParams), updates, strictMode(queryParams, cal.UserID), callerOf(r), check)
+	} else if strictMode(queryParams, cal.UserID) {
+		err = updateEventExclusive(cal.UserID, eventID, updates, callerOf(r), check)
+	} else {
+		err = updateEvent(cal.UserID, eventID, updates, callerOf(r), check)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	event, err := store.Get(cal.UserID, eventID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if targetID != cal.CalendarID {
+		if targetID == primaryCalendarID {
+			w.Header().Set("Content-Location", eventLocation(cal.UserID, eventID))
+		} else {
+			w.Header().Set("Content-Location", calendarEventLocation(targetID, eventID))
+		}
+	}
+	respondWithEvent(w, http.StatusOK, event)
+}
+
+// Handler for DELETE /v1/calendars/{calendar_id}/events/{event_id}; the
+// event goes to the trash of the owner
+func deleteCalendarEventV1(w http.ResponseWriter, r *http.Request) {
+	cal, _, eventID, ok := calendarEventPath(w, r, accessWrite)
+	if !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	check := inCalendar(cal.CalendarID, ifMatch(r))
+	var err error
+	if queryParams.Get("occurrence") != "" {
+		occurrence, perr := parseDate(queryParams, "occurrence")
+		if perr != nil {
+			respondWithError(w, http.StatusBadRequest, perr.Error())
+			return
+		}
+		err = deleteOccurrence(cal.UserID, eventID, occurrence, scopeParam(queryParams), callerOf(r), check)
+	} else {
+		err = deleteEvent(cal.UserID, eventID, callerOf(r), check)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
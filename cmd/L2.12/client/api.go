@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event is the part of a server event the client shows; it keeps the JSON
+// it was decoded from so that -format json prints every field
+type Event struct {
+	UserID       int        `json:"user_id"`
+	EventID      int        `json:"event_id"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	StartTime    time.Time  `json:"start_time"`
+	EndTime      time.Time  `json:"end_time"`
+	Location     string     `json:"location"`
+	CalendarID   int        `json:"calendar_id,omitempty"`
+	AllDay       bool       `json:"all_day,omitempty"`
+	TimeZone     string     `json:"time_zone,omitempty"`
+	RRule        string     `json:"rrule,omitempty"`
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+
+	raw json.RawMessage
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type plain Event
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	e.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	if e.raw != nil {
+		return e.raw, nil
+	}
+	type plain Event
+	return json.Marshal(plain(e))
+}
+
+// serverError is a response in the {"error": ...} shape of the server
+type serverError struct {
+	Status    int
+	Message   string
+	RequestID string
+}
+
+func (e *serverError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("server: %s (status %d, request %s)", e.Message, e.Status, e.RequestID)
+	}
+	return fmt.Sprintf("server: %s (status %d)", e.Message, e.Status)
+}
+
+// client talks to the v1 and form endpoints of the calendar server
+type client struct {
+	baseURL *url.URL
+	token   string
+	userID  int
+	http    *http.Client
+}
+
+func newClient(cfg config) (*client, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("no server configured")
+	}
+	base, err := url.Parse(cfg.Server)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", cfg.Server)
+	}
+	if cfg.UserID <= 0 {
+		return nil, errors.New("no user configured")
+	}
+	return &client{
+		baseURL: base,
+		token:   cfg.Token,
+		userID:  cfg.UserID,
+		http:    &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// do sends a request with an optional JSON body and decodes the response
+// body into out. Any response carrying an "error" member, and any other
+// non-2xx response, is returned as a *serverError.
+func (c *client) do(method, path string, query url.Values, body, out interface{}) error {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var failure struct {
+		Error     *string `json:"error"`
+		RequestID string  `json:"request_id"`
+	}
+	if json.Unmarshal(data, &failure) == nil && failure.Error != nil {
+		return &serverError{Status: resp.StatusCode, Message: *failure.Error, RequestID: failure.RequestID}
+	}
+	if resp.StatusCode >= 300 {
+		message := strings.TrimSpace(string(data))
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return &serverError{Status: resp.StatusCode, Message: message, RequestID: resp.Header.Get("X-Request-ID")}
+	}
+	if out != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decode response of %s %s: %w", method, u.Path, err)
+		}
+	}
+	return nil
+}
+
+// eventResponse is the body of the single event endpoints
+type eventResponse struct {
+	Result Event `json:"result"`
+}
+
+// eventsResponse is the body of the listing endpoints
+type eventsResponse struct {
+	Result     []Event `json:"result"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+// eventsPath is the v1 collection of the user's events
+func (c *client) eventsPath() string {
+	return fmt.Sprintf("/v1/users/%d/events", c.userID)
+}
+
+// eventPath is a single v1 event of the user
+func (c *client) eventPath(eventID int) string {
+	return fmt.Sprintf("/v1/users/%d/events/%d", c.userID, eventID)
+}
+
+func (c *client) createEvent(fields map[string]interface{}) (Event, error) {
+	var resp eventResponse
+	err := c.do(http.MethodPost, c.eventsPath(), nil, fields, &resp)
+	return resp.Result, err
+}
+
+func (c *client) patchEvent(eventID int, query url.Values, fields map[string]interface{}) (Event, error) {
+	var resp eventResponse
+	err := c.do(http.MethodPatch, c.eventPath(eventID), query, fields, &resp)
+	return resp.Result, err
+}
+
+func (c *client) deleteEvent(eventID int, query url.Values) error {
+	return c.do(http.MethodDelete, c.eventPath(eventID), query, nil, nil)
+}
+
+// eventsFor calls one of /events_for_day, /events_for_week and
+// /events_for_month
+func (c *client) eventsFor(period string, date time.Time, query url.Values) ([]Event, error) {
+	query.Set("user_id", fmt.Sprint(c.userID))
+	query.Set("date", date.Format(time.DateOnly))
+	var resp eventsResponse
+	err := c.do(http.MethodGet, "/events_for_"+period, query, nil, &resp)
+	return resp.Result, err
+}
+
+// listEvents pages through the user's events in [from, to)
+func (c *client) listEvents(from, to time.Time, query url.Values) ([]Event, error) {
+	query.Set("from", from.Format(time.RFC3339))
+	query.Set("to", to.Format(time.RFC3339))
+	var events []Event
+	for {
+		var page eventsResponse
+		if err := c.do(http.MethodGet, c.eventsPath(), query, nil, &page); err != nil {
+			return nil, err
+		}
+		events = append(events, page.Result...)
+		if page.NextCursor == "" {
+			return events, nil
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+// timeZone returns the time zone in the user's settings
+func (c *client) timeZone() (string, error) {
+	var resp struct {
+		Result struct {
+			TimeZone string `json:"time_zone"`
+		} `json:"result"`
+	}
+	err := c.do(http.MethodGet, fmt.Sprintf("/v1/users/%d/settings", c.userID), nil, nil, &resp)
+	return resp.Result.TimeZone, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// configEnv names the environment variable with the path of the config file
+const configEnv = "CALENDAR_CLIENT_CONFIG"
+
+// config holds the server URL and credentials of the client
+type config struct {
+	// Server is the base URL of the calendar server, e.g. http://localhost:8080
+	Server string `json:"server"`
+	// Token is a bearer token issued by POST /v1/admin/tokens
+	Token string `json:"token"`
+	// UserID is the user whose calendar the commands work on
+	UserID int `json:"user_id"`
+	// TimeZone is the IANA zone dates are read and shown in; empty means the
+	// zone in the user's settings on the server
+	TimeZone string `json:"time_zone"`
+	// Timeout bounds every request
+	Timeout time.Duration `json:"-"`
+}
+
+// defaultConfigPath is client.json in the l2-calendar directory of the
+// user's config directory, e.g. ~/.config/l2-calendar/client.json
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "l2-calendar", "client.json")
+}
+
+// loadConfig reads the JSON config file at path. A missing file is only an
+// error when the path was given explicitly.
+func loadConfig(path string, explicit bool) (config, error) {
+	cfg := config{Timeout: 10 * time.Second}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("read config file: %w", err)
+	}
+
+	var file struct {
+		config
+		Timeout string `json:"timeout"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return cfg, fmt.Errorf("decode config file %s: %w", path, err)
+	}
+	file.config.Timeout = cfg.Timeout
+	if file.Timeout != "" {
+		if file.config.Timeout, err = time.ParseDuration(file.Timeout); err != nil {
+			return cfg, fmt.Errorf("config file %s: invalid timeout %q", path, file.Timeout)
+		}
+	}
+	return file.config, nil
+}
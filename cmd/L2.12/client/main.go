@@ -0,0 +1,572 @@
+// Command client is a terminal client for the calendar server in cmd/L2.12.
+//
+// It reads the server URL and credentials from a JSON config file, by default
+// client.json in the l2-calendar directory of the user's config directory:
+//
+//	{"server": "http://localhost:8080", "token": "...", "user_id": 1}
+//
+// Results are printed as an agenda, as a month grid or as JSON. The exit
+// status is 1 when the server answers with an error and 2 on bad usage.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `usage: client [flags] <command> [command flags] [args]
+
+Commands:
+  add [flags] [title]        create an event
+  edit [flags] <event_id>    change the given fields of an event
+  rm [flags] <event_id>      delete an event
+  day [date]                 events of the day
+  week [date]                events of the week, starting on Monday
+  month [date]               events of the month
+  agenda [-from date] [-days n]
+                             upcoming events
+
+Dates are YYYY-MM-DD, today, tomorrow or yesterday; the default is today.
+Run "client <command> -h" for the flags of a command.
+
+Flags:
+`
+
+// errUsage marks errors in the command line
+var errUsage = errors.New("usage")
+
+// session is the state shared by the commands
+type session struct {
+	client *client
+	cfg    config
+	format string
+	out    io.Writer
+	errOut io.Writer
+	loc    *time.Location
+}
+
+// command runs a subcommand with its arguments
+type command func(s *session, args []string) error
+
+var commands = map[string]command{
+	"add":    addCommand,
+	"edit":   editCommand,
+	"rm":     rmCommand,
+	"day":    periodCommand("day"),
+	"week":   periodCommand("week"),
+	"month":  periodCommand("month"),
+	"agenda": agendaCommand,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit status
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "path of the config file (default $"+configEnv+" or "+defaultConfigPath()+")")
+	server := fs.String("server", "", "base URL of the server, overrides the config file")
+	token := fs.String("token", "", "bearer token, overrides the config file")
+	userID := fs.Int("user", 0, "user ID, overrides the config file")
+	tz := fs.String("tz", "", "IANA time zone of dates and output, overrides the config file")
+	format := fs.String("format", "", "output format: agenda, grid (month only) or json")
+	timeout := fs.Duration("timeout", 0, "request timeout, overrides the config file")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "client: unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path, explicit = os.LookupEnv(configEnv)
+		if !explicit {
+			path = defaultConfigPath()
+		}
+	}
+	cfg, err := loadConfig(path, explicit)
+	if err != nil {
+		fmt.Fprintln(stderr, "client:", err)
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			cfg.Server = *server
+		case "token":
+			cfg.Token = *token
+		case "user":
+			cfg.UserID = *userID
+		case "tz":
+			cfg.TimeZone = *tz
+		case "timeout":
+			cfg.Timeout = *timeout
+		}
+	})
+	switch *format {
+	case "", formatAgenda, formatGrid, formatJSON:
+	default:
+		fmt.Fprintf(stderr, "client: unknown format %q\n", *format)
+		return 2
+	}
+
+	c, err := newClient(cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, "client:", err)
+		return 2
+	}
+	s := &session{client: c, cfg: cfg, format: *format, out: stdout, errOut: stderr}
+	if err := cmd(s, fs.Args()[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(stderr, "client %s: %v\n", name, err)
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// location returns the zone dates are read and shown in: the configured
+// one, or else the zone in the user's settings
+func (s *session) location() (*time.Location, error) {
+	if s.loc != nil {
+		return s.loc, nil
+	}
+	name := s.cfg.TimeZone
+	if name == "" {
+		var err error
+		if name, err = s.client.timeZone(); err != nil {
+			return nil, err
+		}
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", name, err)
+	}
+	s.loc = loc
+	return loc, nil
+}
+
+// flags returns the flag set of a subcommand
+func (s *session) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(s.errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: client %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the arguments of a subcommand and checks the number of
+// positional arguments
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		return fmt.Errorf("%w: wrong number of arguments", errUsage)
+	}
+	return nil
+}
+
+// parseDate reads a YYYY-MM-DD date, today, tomorrow or yesterday in loc
+func parseDate(value string, loc *time.Location) (time.Time, error) {
+	today := midnight(time.Now(), loc)
+	switch value {
+	case "", "today":
+		return today, nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid date %q, want YYYY-MM-DD", errUsage, value)
+	}
+	return t, nil
+}
+
+// eventID reads the event ID argument
+func eventID(value string) (int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: invalid event ID %q", errUsage, value)
+	}
+	return id, nil
+}
+
+// eventFlags are the flags of add and edit, one per event field
+type eventFlags struct {
+	title, start, end, description, location string
+	rrule, tags, reminders, attendees        string
+	allDay                                   bool
+	calendar                                 int
+}
+
+func (f *eventFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.title, "title", "", "title")
+	fs.StringVar(&f.start, "start", "", "start, RFC 3339, local \"YYYY-MM-DD HH:MM\" or YYYY-MM-DD for all-day events")
+	fs.StringVar(&f.end, "end", "", "end, in the same form as -start")
+	fs.StringVar(&f.description, "description", "", "description")
+	fs.StringVar(&f.location, "location", "", "location")
+	fs.StringVar(&f.rrule, "rrule", "", "RFC 5545 recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO")
+	fs.StringVar(&f.tags, "tags", "", "comma-separated tags")
+	fs.StringVar(&f.reminders, "reminders", "", "comma-separated reminder lead times in minutes")
+	fs.StringVar(&f.attendees, "attendees", "", "comma-separated user IDs to invite")
+	fs.BoolVar(&f.allDay, "all-day", false, "the event spans whole dates")
+	fs.IntVar(&f.calendar, "calendar", 0, "calendar ID, 0 is the primary calendar")
+}
+
+// fields returns the JSON members for the flags given on the command line;
+// an empty list flag clears the field
+func (f *eventFlags) fields(fs *flag.FlagSet, timeZone string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch fl.Name {
+		case "title":
+			fields["title"] = f.title
+		case "start":
+			fields["start_time"] = f.start
+		case "end":
+			fields["end_time"] = f.end
+		case "description":
+			fields["description"] = f.description
+		case "location":
+			fields["location"] = f.location
+		case "rrule":
+			fields["rrule"] = f.rrule
+		case "tags":
+			fields["tags"] = splitList(f.tags)
+		case "reminders":
+			fields["reminders"], err = splitInts("reminders", f.reminders)
+		case "attendees":
+			fields["attendees"], err = splitInts("attendees", f.attendees)
+		case "all-day":
+			fields["all_day"] = f.allDay
+		case "calendar":
+			fields["calendar_id"] = f.calendar
+		}
+	})
+	// Local times are meant in the client's zone, not the server's
+	_, hasStart := fields["start_time"]
+	if timeZone != "" && hasStart && !f.allDay {
+		fields["time_zone"] = timeZone
+	}
+	return fields, err
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func splitInts(name, value string) ([]int, error) {
+	list := []int{}
+	for _, item := range splitList(value) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid -%s value %q", errUsage, name, item)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// occurrenceQuery selects a single occurrence of a recurring event and the
+// scope of the change; scope defaults to that occurrence only. The server
+// wants the exact start of the occurrence, so a bare date is looked up
+// among the occurrences of the event on that day.
+func (s *session) occurrenceQuery(eventID int, occurrence, scope string) (url.Values, error) {
+	query := url.Values{}
+	if occurrence == "" {
+		if scope != "" {
+			return nil, fmt.Errorf("%w: -scope needs -occurrence", errUsage)
+		}
+		return query, nil
+	}
+	if scope == "" {
+		scope = "this"
+	}
+	switch scope {
+	case "this", "following", "all":
+	default:
+		return nil, fmt.Errorf("%w: -scope must be this, following or all", errUsage)
+	}
+
+	if _, err := time.Parse(time.RFC3339, occurrence); err != nil {
+		loc, err := s.location()
+		if err != nil {
+			return nil, err
+		}
+		day, err := parseDate(occurrence, loc)
+		if err != nil {
+			return nil, err
+		}
+		if occurrence, err = s.findOccurrence(eventID, day); err != nil {
+			return nil, err
+		}
+	}
+	query.Set("occurrence", occurrence)
+	query.Set("scope", scope)
+	return query, nil
+}
+
+// findOccurrence returns the start of the occurrence of a recurring event
+// on the day
+func (s *session) findOccurrence(eventID int, day time.Time) (string, error) {
+	events, err := s.client.listEvents(day, day.AddDate(0, 0, 1), url.Values{})
+	if err != nil {
+		return "", err
+	}
+	for _, event := range events {
+		if event.EventID == eventID && event.RecurrenceID != nil {
+			return event.RecurrenceID.Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("event #%d has no occurrence on %s", eventID, day.Format(time.DateOnly))
+}
+
+// showEvent prints a created or changed event
+func (s *session) showEvent(verb string, event Event) error {
+	if s.format == formatJSON {
+		return writeJSON(s.out, event)
+	}
+	loc, err := s.location()
+	if err != nil {
+		return err
+	}
+	start, _ := event.span(loc)
+	_, err = fmt.Fprintf(s.out, "%s %s  %s\n", verb, start.Format("Mon 02 Jan 2006"), agendaLine(event, loc))
+	return err
+}
+
+func addCommand(s *session, args []string) error {
+	fs := s.flags("add", "[title]")
+	var f eventFlags
+	f.define(fs)
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	fields, err := f.fields(fs, s.cfg.TimeZone)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 1 {
+		fields["title"] = fs.Arg(0)
+	}
+	event, err := s.client.createEvent(fields)
+	if err != nil {
+		return err
+	}
+	return s.showEvent("Created", event)
+}
+
+func editCommand(s *session, args []string) error {
+	fs := s.flags("edit", "<event_id>")
+	var f eventFlags
+	f.define(fs)
+	occurrence := fs.String("occurrence", "", "date or RFC 3339 start of the occurrence of a recurring event to edit")
+	scope := fs.String("scope", "", "with -occurrence: this, following or all (default this)")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	id, err := eventID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fields, err := f.fields(fs, s.cfg.TimeZone)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: nothing to change", errUsage)
+	}
+	query, err := s.occurrenceQuery(id, *occurrence, *scope)
+	if err != nil {
+		return err
+	}
+	event, err := s.client.patchEvent(id, query, fields)
+	if err != nil {
+		return err
+	}
+	return s.showEvent("Updated", event)
+}
+
+func rmCommand(s *session, args []string) error {
+	fs := s.flags("rm", "<event_id>")
+	occurrence := fs.String("occurrence", "", "date or RFC 3339 start of the occurrence of a recurring event to delete")
+	scope := fs.String("scope", "", "with -occurrence: this, following or all (default this)")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	id, err := eventID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	query, err := s.occurrenceQuery(id, *occurrence, *scope)
+	if err != nil {
+		return err
+	}
+	if err := s.client.deleteEvent(id, query); err != nil {
+		return err
+	}
+	if s.format == formatJSON {
+		return writeJSON(s.out, map[string]interface{}{"deleted": id})
+	}
+	if occurrence := query.Get("occurrence"); occurrence != "" {
+		_, err = fmt.Fprintf(s.out, "Deleted #%d at %s (%s)\n", id, occurrence, query.Get("scope"))
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Deleted #%d\n", id)
+	return err
+}
+
+// filterFlags are the listing filters the server understands
+func filterFlags(fs *flag.FlagSet) func() url.Values {
+	tag := fs.String("tag", "", "only events with all of these comma-separated tags")
+	q := fs.String("q", "", "only events whose title or description contain these words")
+	calendars := fs.String("calendars", "", "comma-separated calendar IDs, or all")
+	return func() url.Values {
+		query := url.Values{}
+		for name, value := range map[string]string{"tag": *tag, "q": *q, "calendars": *calendars} {
+			if value != "" {
+				query.Set(name, value)
+			}
+		}
+		return query
+	}
+}
+
+// periodCommand lists the events of the day, the week or the month of a date
+func periodCommand(period string) command {
+	return func(s *session, args []string) error {
+		fs := s.flags(period, "[date]")
+		filters := filterFlags(fs)
+		if err := parse(fs, args, 0, 1); err != nil {
+			return err
+		}
+		format := s.format
+		if format == "" {
+			format = formatAgenda
+			if period == "month" {
+				format = formatGrid
+			}
+		}
+		if format == formatGrid && period != "month" {
+			return fmt.Errorf("%w: the grid format is only available for month", errUsage)
+		}
+
+		loc, err := s.location()
+		if err != nil {
+			return err
+		}
+		date, err := parseDate(fs.Arg(0), loc)
+		if err != nil {
+			return err
+		}
+		switch period {
+		case "week":
+			date = date.AddDate(0, 0, -(int(date.Weekday())+6)%7)
+		case "month":
+			date = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, loc)
+		}
+
+		query := filters()
+		query.Set("tz", loc.String())
+		events, err := s.client.eventsFor(period, date, query)
+		if err != nil {
+			return err
+		}
+		return s.render(format, events, date, loc)
+	}
+}
+
+func agendaCommand(s *session, args []string) error {
+	fs := s.flags("agenda", "")
+	from := fs.String("from", "today", "first date")
+	days := fs.Int("days", 7, "number of days")
+	filters := filterFlags(fs)
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("%w: -days must be positive", errUsage)
+	}
+	if s.format == formatGrid {
+		return fmt.Errorf("%w: the grid format is only available for month", errUsage)
+	}
+
+	loc, err := s.location()
+	if err != nil {
+		return err
+	}
+	start, err := parseDate(*from, loc)
+	if err != nil {
+		return err
+	}
+	query := filters()
+	query.Set("tz", loc.String())
+	events, err := s.client.listEvents(start, start.AddDate(0, 0, *days), query)
+	if err != nil {
+		return err
+	}
+	return s.render(s.format, events, start, loc)
+}
+
+// render prints listed events in the format
+func (s *session) render(format string, events []Event, date time.Time, loc *time.Location) error {
+	if events == nil {
+		events = []Event{}
+	}
+	switch format {
+	case formatJSON:
+		return writeJSON(s.out, events)
+	case formatGrid:
+		return writeGrid(s.out, events, date, loc)
+	default:
+		return writeAgenda(s.out, events, loc)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output formats
+const (
+	formatAgenda = "agenda"
+	formatGrid   = "grid"
+	formatJSON   = "json"
+)
+
+// span returns the start and end of an event in loc. All-day events are
+// stored as dates at midnight UTC and mean the same dates in every zone.
+func (e Event) span(loc *time.Location) (time.Time, time.Time) {
+	if e.AllDay {
+		return floating(e.StartTime, loc), floating(e.EndTime, loc)
+	}
+	return e.StartTime.In(loc), e.EndTime.In(loc)
+}
+
+// floating reads the UTC date of t as the same date in loc
+func floating(t time.Time, loc *time.Location) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// midnight returns the start of t's day in loc
+func midnight(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// sortEvents orders events by start, all-day events first within a day
+func sortEvents(events []Event, loc *time.Location) {
+	sort.SliceStable(events, func(i, j int) bool {
+		si, _ := events[i].span(loc)
+		sj, _ := events[j].span(loc)
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		if events[i].AllDay != events[j].AllDay {
+			return events[i].AllDay
+		}
+		return events[i].EventID < events[j].EventID
+	})
+}
+
+// writeJSON prints the events as an indented JSON array
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeAgenda prints the events day by day:
+//
+//	Mon 19 Oct 2026
+//	  all day      Conference  #4
+//	  09:00-09:30  Standup  #3 (recurring)  @ Room 1  [work]
+func writeAgenda(w io.Writer, events []Event, loc *time.Location) error {
+	if len(events) == 0 {
+		_, err := fmt.Fprintln(w, "No events.")
+		return err
+	}
+	sortEvents(events, loc)
+
+	var day time.Time
+	for i, event := range events {
+		start, _ := event.span(loc)
+		if d := midnight(start, loc); !d.Equal(day) {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			day = d
+			fmt.Fprintln(w, day.Format("Mon 02 Jan 2006"))
+		}
+		fmt.Fprintln(w, " ", agendaLine(event, loc))
+	}
+	return nil
+}
+
+// agendaLine describes one event of the agenda
+func agendaLine(event Event, loc *time.Location) string {
+	start, end := event.span(loc)
+	var when string
+	switch {
+	case event.AllDay && end.Sub(start) <= 24*time.Hour:
+		when = "all day"
+	case event.AllDay:
+		// The end of an all-day event is the day after its last date
+		when = "until " + end.AddDate(0, 0, -1).Format("Mon 02 Jan")
+	case midnight(start, loc).Equal(midnight(end, loc)):
+		when = start.Format("15:04") + "-" + end.Format("15:04")
+	default:
+		when = start.Format("15:04") + "-" + end.Format("Mon 02 Jan 15:04")
+	}
+
+	parts := []string{fmt.Sprintf("%-11s", when), event.Title, fmt.Sprintf("#%d", event.EventID)}
+	if event.RRule != "" || event.RecurrenceID != nil {
+		parts[2] += " (recurring)"
+	}
+	if event.Location != "" {
+		parts = append(parts, "@ "+event.Location)
+	}
+	if len(event.Tags) > 0 {
+		parts = append(parts, "["+strings.Join(event.Tags, ", ")+"]")
+	}
+	return strings.Join(parts, "  ")
+}
+
+// writeGrid prints the month of first as a calendar grid, weeks starting on
+// Monday, with the number of events on each day:
+//
+//	          October 2026
+//	Mo     Tu     We     Th     Fr     Sa     Su
+//	                     1      2[1]   3      4
+func writeGrid(w io.Writer, events []Event, first time.Time, loc *time.Location) error {
+	first = time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, loc)
+	next := first.AddDate(0, 1, 0)
+
+	counts := make(map[int]int)
+	for _, event := range events {
+		start, end := event.span(loc)
+		for day := midnight(start, loc); day.Before(next); day = day.AddDate(0, 0, 1) {
+			// An event ending at midnight does not reach into that day,
+			// but an empty event still counts on the day it happens
+			if !day.Before(end) && !(day.Equal(midnight(start, loc)) && end.Equal(start)) {
+				break
+			}
+			if !day.Before(first) {
+				counts[day.Day()]++
+			}
+		}
+	}
+
+	title := first.Format("January 2006")
+	const width = 7*7 - 2
+	fmt.Fprintf(w, "%*s\n", (width+len(title))/2, title)
+	fmt.Fprintln(w, "Mo     Tu     We     Th     Fr     Sa     Su")
+
+	var line strings.Builder
+	line.WriteString(strings.Repeat(" ", 7*((int(first.Weekday())+6)%7)))
+	for day := first; day.Before(next); day = day.AddDate(0, 0, 1) {
+		cell := fmt.Sprintf("%2d", day.Day())
+		if n := counts[day.Day()]; n > 0 {
+			cell += fmt.Sprintf("[%d]", n)
+		}
+		if day.Weekday() == time.Sunday {
+			fmt.Fprintln(w, strings.TrimRight(line.String()+cell, " "))
+			line.Reset()
+			continue
+		}
+		line.WriteString(fmt.Sprintf("%-7s", cell))
+	}
+	if line.Len() > 0 {
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d %s\n", len(events), plural(len(events), "event"))
+	return err
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix starts the names of the environment variables of the settings
+const envPrefix = "CALENDAR_"
+
+// commandLineOnly are the flags that cannot be set from the environment or
+// the config file
+var commandLineOnly = map[string]bool{
+	"config":            true,
+	"print-admin-token": true,
+}
+
+// envName returns the environment variable of the setting behind a flag:
+// -read-timeout is CALENDAR_READ_TIMEOUT
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile reads a JSON object whose keys are flag names, such as
+// {"port": 8080, "read-timeout": "10s"}. Values are parsed like the flags.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if fs.Lookup(name) == nil || commandLineOnly[name] {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		switch value := value.(type) {
+		case string:
+			values[name] = value
+		case json.Number, bool:
+			values[name] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("config file %s: setting %q must be a string, number or boolean", path, name)
+		}
+	}
+	return values, nil
+}
+
+// loadConfig sets the flags that were not given on the command line from
+// their environment variables and then from the config file at path, if any.
+// Command-line flags therefore take precedence over the environment, which
+// takes precedence over the file, which overrides the defaults.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	var file map[string]string
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(fs, path); err != nil {
+			return err
+		}
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !given[f.Name] && !commandLineOnly[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s=%q: %v", envName(name), value, err)
+			}
+		} else if value, ok := file[name]; ok {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("config file %s: invalid %s %q: %v", path, name, value, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// conflictHorizon bounds how far ahead the occurrences of a recurring event
+// are checked for conflicts
+const conflictHorizon = 366 * 24 * time.Hour
+
+// conflictError rejects a write that would overlap existing events
+type conflictError struct {
+	Conflicts []Event
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("event overlaps %d existing event(s)", len(e.Conflicts))
+}
+
+func (e *conflictError) Is(target error) bool {
+	return target == errConflict
+}
+
+// occurrenceKey identifies an event or one occurrence of a recurring event
+type occurrenceKey struct {
+	eventID int
+	start   int64
+}
+
+func keyOf(event Event) occurrenceKey {
+	return occurrenceKey{eventID: event.EventID, start: event.StartTime.UnixNano()}
+}
+
+// related reports whether two events belong to the same series, in which case
+// they never conflict with each other
+func related(a, b *Event) bool {
+	return a.EventID == b.EventID || (a.SeriesID != 0 && a.SeriesID == b.EventID) ||
+		(b.SeriesID != 0 && b.SeriesID == a.EventID)
+}
+
+// conflictsLocked returns the existing events and occurrences of the user
+// that overlap event; the caller must hold at least the read lock. All-day
+// events do not block time, as in free/busy.
+func (s *memoryStore) conflictsLocked(event Event) []Event {
+	if event.AllDay {
+		return nil
+	}
+
+	var spans []interval
+	if event.RRule != "" {
+		for _, occ := range expandOccurrences(event, event.StartTime, event.StartTime.Add(conflictHorizon)) {
+			start, end := occ.span()
+			spans = append(spans, interval{Start: start, End: end})
+		}
+	} else {
+		start, end := event.span()
+		spans = append(spans, interval{Start: start, End: end})
+	}
+
+	seen := make(map[occurrenceKey]bool)
+	var conflicts []Event
+	add := func(other Event) {
+		if other.AllDay || related(&event, &other) || seen[keyOf(other)] {
+			return
+		}
+		seen[keyOf(other)] = true
+		conflicts = append(conflicts, other)
+	}
+	for _, span := range spans {
+		s.index[event.UserID].query(span.Start, span.End, func(eventID int) {
+			other := s.events[event.UserID][eventID]
+			if start, end := other.span(); sharesTime(start, end, span) {
+				add(other)
+			}
+		})
+		for seriesID := range s.series[event.UserID] {
+			series := s.events[event.UserID][seriesID]
+			for _, occ := range expandOccurrences(series, span.Start, span.End) {
+				if start, end := occ.span(); sharesTime(start, end, span) {
+					add(occ)
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// sharesTime reports whether [start, end) and the span have time in common;
+// meetings that only touch end to start do not conflict, while a zero-length
+// event conflicts with the span it lies in
+func sharesTime(start, end time.Time, span interval) bool {
+	instant, spanInstant := !start.Before(end), !span.Start.Before(span.End)
+	switch {
+	case instant && spanInstant:
+		return start.Equal(span.Start)
+	case instant:
+		return !start.Before(span.Start) && start.Before(span.End)
+	case spanInstant:
+		return !span.Start.Before(start) && span.Start.Before(end)
+	default:
+		return start.Before(span.End) && span.Start.Before(end)
+	}
+}
+
+// CreateExclusive stores a new event unless it overlaps existing events of
+// the user; the check and the write happen under one lock
+func (s *memoryStore) CreateExclusive(event Event, by principal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.events[event.UserID][event.EventID]; exists {
+		return conflictf("event ID %d already exists for user %d", event.EventID, event.UserID)
+	}
+	if err := s.checkQuotaLocked(event.UserID, 1); err != nil {
+		return err
+	}
+	if err := s.checkCalendarLocked(event); err != nil {
+		return err
+	}
+	if err := s.checkUIDLocked(event, nil); err != nil {
+		return err
+	}
+	event.Version = 1
+	if conflicts := s.conflictsLocked(event); len(conflicts) > 0 {
+		return &conflictError{Conflicts: conflicts}
+	}
+	if err := s.commit(storeRecord{Op: opPut, Event: &event, Actor: actorOf(by)}); err != nil {
+		return err
+	}
+	s.put(event)
+	return nil
+}
+
+// UpdateExclusive is Update that rejects a result overlapping events it did
+// not already overlap, so editing an event that was forced in stays possible
+func (s *memoryStore) UpdateExclusive(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.events[userID][eventID]
+	if !exists {
+		return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+	}
+	event := old
+	if err := fn(&event); err != nil {
+		return Event{}, err
+	}
+	if err := s.checkCalendarLocked(event); err != nil {
+		return Event{}, err
+	}
+	if event.UID != old.UID {
+		if err := s.checkUIDLocked(event, nil); err != nil {
+			return Event{}, err
+		}
+	}
+	event.Version = old.Version + 1
+	if conflicts := s.newConflictsLocked(event, &old, nil); len(conflicts) > 0 {
+		return Event{}, &conflictError{Conflicts: conflicts}
+	}
+
+	if err := s.commit(storeRecord{Op: opPut, Event: &event, Actor: actorOf(by)}); err != nil {
+		return Event{}, err
+	}
+	s.put(event)
+	return event, nil
+}
+
+// newConflictsLocked returns the conflicts of event that before, if not nil,
+// did not have, leaving out the events in skip; the caller must hold at
+// least the read lock
+func (s *memoryStore) newConflictsLocked(event Event, before *Event, skip map[int]*Event) []Event {
+	had := make(map[occurrenceKey]bool)
+	if before != nil {
+		for _, other := range s.conflictsLocked(*before) {
+			had[keyOf(other)] = true
+		}
+	}
+	var conflicts []Event
+	for _, other := range s.conflictsLocked(event) {
+		if _, skipped := skip[other.EventID]; !skipped && !had[keyOf(other)] {
+			conflicts = append(conflicts, other)
+		}
+	}
+	return conflicts
+}
+
+func (s *fileStore) CreateExclusive(event Event, by principal) error {
+	defer s.compact()
+	return s.memoryStore.CreateExclusive(event, by)
+}
+
+func (s *fileStore) UpdateExclusive(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.UpdateExclusive(userID, eventID, by, fn)
+}
+
+// MoveExclusive is Move that fails with a *conflictError when the moved
+// events overlap events of the new owner
+func (s *memoryStore) MoveExclusive(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return moveLocked(s, s, userID, eventID, toUserID, true, by, fn)
+}
+
+func (s *fileStore) MoveExclusive(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.MoveExclusive(userID, eventID, toUserID, by, fn)
+}
+
+// strictMode decides whether a write must not overlap other events: force
+// always allows the write, the strict parameter overrides the user setting
+func strictMode(params url.Values, userID int) bool {
+	if params.Get("force") == "true" {
+		return false
+	}
+	switch params.Get("strict") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return store.GetUser(userID).StrictConflicts
+}
+
+// createEventExclusive is createEvent that fails with a conflictError when
+// the event overlaps existing events of the user
+func createEventExclusive(userID, eventID int, event Event, by principal) error {
+	event.UserID = userID
+	event.EventID = eventID
+	if err := normalizeRRule(&event); err != nil {
+		return err
+	}
+	if err := checkFieldSizes(event); err != nil {
+		return err
+	}
+	return store.CreateExclusive(event, by)
+}
+
+// updateEventExclusive is updateEvent that fails with a conflictError when
+// the update makes the event overlap other events
+func updateEventExclusive(userID, eventID int, updates map[string]string, by principal, check eventCheck) error {
+	_, err := store.UpdateExclusive(userID, eventID, by, func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		return applyUpdates(event, updates)
+	})
+	return err
+}
+
+// moveEventExclusive is moveEvent that fails with a conflictError when the
+// event overlaps events of toUserID
+func moveEventExclusive(userID, eventID, toUserID int, updates map[string]string, by principal, check eventCheck) (Event, error) {
+	return store.MoveExclusive(userID, eventID, toUserID, by, func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		return applyUpdates(event, updates)
+	})
+}
+
+// respondWithConflict sends 409 with the conflicting events if err is a
+// conflictError and reports whether it did
+func respondWithConflict(w http.ResponseWriter, err error) bool {
+	var conflict *conflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	respondWithJSON(w, http.StatusConflict, withRequestID(w, map[string]interface{}{
+		"error":     conflict.Error(),
+		"conflicts": conflict.Conflicts,
+	}))
+	return true
+}
@@ -0,0 +1,1208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XML namespaces of WebDAV, CalDAV and the CalendarServer extensions
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+// davPrefixes are the prefixes multistatus bodies bind the namespaces to
+var davPrefixes = map[string]string{nsDAV: "d", nsCalDAV: "c", nsCS: "cs"}
+
+// WebDAV methods
+const (
+	methodPropfind = "PROPFIND"
+	methodReport   = "REPORT"
+)
+
+const (
+	davRoot = "/dav/"
+	// syncTokenPrefix turns the audit sequence numbers that serve as sync
+	// tokens into the URIs RFC 6578 asks for
+	syncTokenPrefix = "urn:l2-calendar:sync:"
+	// maxDAVBody bounds the XML bodies of PROPFIND and REPORT requests
+	maxDAVBody = 1 << 20
+
+	davCollectionType   = "<d:collection/>"
+	davCalendarType     = "<d:collection/><c:calendar/>"
+	davPrincipalType    = "<d:principal/>"
+	davResourceType     = ""
+	davComponentSet     = `<c:comp name="VEVENT"/>`
+	davResourceMIMEType = "text/calendar; charset=utf-8; component=VEVENT"
+	davSupportedReports = "<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+		"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>" +
+		"<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>"
+	// davOwnerPrivileges are the privileges of a user on the calendars of
+	// the user's own home
+	davOwnerPrivileges = "<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>" +
+		"<d:privilege><d:write-content/></d:privilege><d:privilege><d:bind/></d:privilege><d:privilege><d:unbind/></d:privilege>"
+)
+
+func davElement(local string) xml.Name {
+	return xml.Name{Space: nsDAV, Local: local}
+}
+
+func calDAVElement(local string) xml.Name {
+	return xml.Name{Space: nsCalDAV, Local: local}
+}
+
+func davPrincipalPath(userID int) string {
+	return fmt.Sprintf("/dav/principals/%d/", userID)
+}
+
+func davHomePath(userID int) string {
+	return fmt.Sprintf("/dav/calendars/%d/", userID)
+}
+
+func davCalendarPath(cal Calendar) string {
+	return fmt.Sprintf("/dav/calendars/%d/%d/", cal.UserID, cal.CalendarID)
+}
+
+func davResourcePath(cal Calendar, name string) string {
+	return davCalendarPath(cal) + url.PathEscape(name)
+}
+
+func syncToken(seq int64) string {
+	return syncTokenPrefix + strconv.FormatInt(seq, 10)
+}
+
+// parseSyncToken returns the audit sequence number of a sync token
+func parseSyncToken(token string) (int64, bool) {
+	value, ok := strings.CutPrefix(token, syncTokenPrefix)
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	return seq, err == nil && seq >= 0
+}
+
+// davResource is a calendar object resource: an event and the occurrences
+// of it that were edited on their own, which share its UID. It is named
+// after the UID; the event comes first.
+type davResource struct {
+	Name   string
+	Events []Event
+}
+
+// resourceName returns the name of the resource an event belongs to; byID
+// resolves the recurring event of an edited occurrence
+func resourceName(event Event, byID map[int]Event) string {
+	if event.RecurrenceID != nil {
+		if series, ok := byID[event.SeriesID]; ok {
+			event = series
+		}
+	}
+	return eventUID(event) + ".ics"
+}
+
+// master returns the recurring or single event of the resource, or nil when
+// only edited occurrences of a deleted event are left
+func (res *davResource) master() *Event {
+	if len(res.Events) > 0 && res.Events[0].RecurrenceID == nil {
+		return &res.Events[0]
+	}
+	return nil
+}
+
+// etag changes with the version of every event of the resource
+func (res *davResource) etag() string {
+	sum := sha256.New()
+	for _, event := range res.Events {
+		fmt.Fprintf(sum, "%d:%d;", event.EventID, event.Version)
+	}
+	return `"` + hex.EncodeToString(sum.Sum(nil)[:8]) + `"`
+}
+
+// modified returns the time of the latest change of the resource
+func (res *davResource) modified() time.Time {
+	var latest time.Time
+	for _, event := range res.Events {
+		if history := store.History(event.EventID); len(history) > 0 && history[len(history)-1].Time.After(latest) {
+			latest = history[len(history)-1].Time
+		}
+	}
+	if latest.IsZero() {
+		// Every write is audited, so only a lost history gets here
+		latest = time.Now()
+	}
+	return latest.UTC()
+}
+
+// writeICS writes the resource as a VCALENDAR object
+func (res *davResource) writeICS(w io.Writer) error {
+	uid := strings.TrimSuffix(res.Name, ".ics")
+	stamp := res.modified().Format(icalDateTimeUTC)
+	iw := &icalWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//L2//Calendar//EN")
+	for _, event := range res.Events {
+		if event.RecurrenceID == nil {
+			event.ExDates = res.exDates(event)
+		}
+		iw.vevent(event, uid, stamp)
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+// exDates returns the exception dates of the recurring event that no edited
+// occurrence of the resource replaces; the edited ones are not excluded in
+// iCalendar, they are overridden
+func (res *davResource) exDates(series Event) []time.Time {
+	var dates []time.Time
+	for _, t := range series.ExDates {
+		overridden := false
+		for _, event := range res.Events {
+			if event.RecurrenceID != nil && event.RecurrenceID.Equal(t) {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			dates = append(dates, t)
+		}
+	}
+	return dates
+}
+
+// davCollection is a calendar of a user as a collection of resources
+type davCollection struct {
+	Calendar
+	resources map[string]*davResource
+	// names maps the events of the calendar to their resources
+	names map[int]string
+}
+
+// loadCollection groups the events of a calendar into resources
+func loadCollection(cal Calendar) *davCollection {
+	c := &davCollection{Calendar: cal, resources: make(map[string]*davResource), names: make(map[int]string)}
+	events := store.List(cal.UserID)
+	byID := make(map[int]Event, len(events))
+	for _, event := range events {
+		byID[event.EventID] = event
+	}
+	for _, event := range events {
+		if event.CalendarID != cal.CalendarID {
+			continue
+		}
+		name := resourceName(event, byID)
+		res := c.resources[name]
+		if res == nil {
+			res = &davResource{Name: name}
+			c.resources[name] = res
+		}
+		res.Events = append(res.Events, event)
+		c.names[event.EventID] = name
+	}
+	for _, res := range c.resources {
+		sort.Slice(res.Events, func(i, j int) bool {
+			a, b := res.Events[i], res.Events[j]
+			if (a.RecurrenceID == nil) != (b.RecurrenceID == nil) {
+				return a.RecurrenceID == nil
+			}
+			return a.EventID < b.EventID
+		})
+	}
+	return c
+}
+
+func (c *davCollection) sortedNames() []string {
+	names := make([]string, 0, len(c.resources))
+	for name := range c.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namesInRange returns the resources with an occurrence in [from, to)
+func (c *davCollection) namesInRange(from, to time.Time) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, event := range getCalendarEventsForRange(c.Calendar, accessOwner, from, to) {
+		// An occurrence of a recurring event has the ID of the event
+		if name, ok := c.names[event.EventID]; ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// changedNames returns the resources of the calendar that audit entries
+// created, changed or removed
+func (c *davCollection) changedNames(entries []auditEntry) []string {
+	// Edited occurrences belong to the resource of their recurring event,
+	// which is either still there or among the entries
+	known := make(map[int]Event)
+	for _, entry := range entries {
+		for _, state := range []*Event{entry.Before, entry.After} {
+			if state != nil {
+				known[state.EventID] = *state
+			}
+		}
+	}
+	for _, res := range c.resources {
+		for _, event := range res.Events {
+			known[event.EventID] = event
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, entry := range entries {
+		for _, state := range []*Event{entry.Before, entry.After} {
+			if state == nil || state.UserID != c.UserID || state.CalendarID != c.CalendarID {
+				continue
+			}
+			if name := resourceName(*state, known); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the resource of the collection an href names, or nil
+func (c *davCollection) lookup(href string) *davResource {
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil
+	}
+	rest, ok := strings.CutPrefix(u.EscapedPath(), davCalendarPath(c.Calendar))
+	if !ok || strings.Contains(rest, "/") {
+		return nil
+	}
+	name, err := url.PathUnescape(rest)
+	if err != nil {
+		return nil
+	}
+	return c.resources[name]
+}
+
+// davCalendars returns the calendars of the home of a user: the primary
+// calendar and the ones the user owns. Calendars shared with the user are
+// not part of it.
+func davCalendars(userID int) []Calendar {
+	calendars := []Calendar{{CalendarID: primaryCalendarID, UserID: userID, Name: primaryCalendarName}}
+	for _, cal := range store.Calendars(userID) {
+		if cal.UserID == userID {
+			calendars = append(calendars, cal)
+		}
+	}
+	sort.Slice(calendars, func(i, j int) bool { return calendars[i].CalendarID < calendars[j].CalendarID })
+	return calendars
+}
+
+// davCalendar reads the calendar collection of a request, which must be in
+// the home of its owner
+func davCalendar(w http.ResponseWriter, r *http.Request) (Calendar, bool) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return Calendar{}, false
+	}
+	calendarID, err := parseCalendarID(r.PathValue("calendar_id"))
+	if err != nil {
+		respondWithStoreError(w, err)
+		return Calendar{}, false
+	}
+	if calendarID == primaryCalendarID {
+		return Calendar{CalendarID: primaryCalendarID, UserID: userID, Name: primaryCalendarName}, true
+	}
+	cal, err := store.Calendar(calendarID)
+	if err == nil && cal.UserID != userID {
+		err = notFoundf("calendar %d not found", calendarID)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return Calendar{}, false
+	}
+	return cal, true
+}
+
+// davProps are the properties of a resource by name. Their values are
+// inner XML, computed only when asked for.
+type davProps map[xml.Name]func() string
+
+// davValue is a property with a fixed value
+func davValue(value string) func() string {
+	return func() string { return value }
+}
+
+// notInAllProp lists the properties allprop leaves out, as RFC 4791 wants
+var notInAllProp = map[xml.Name]bool{calDAVElement("calendar-data"): true}
+
+func davHref(path string) string {
+	return "<d:href>" + xmlText(path) + "</d:href>"
+}
+
+// xmlText escapes character data
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmlElement returns the start and end tags of an element, declaring
+// namespaces that have no prefix in multistatus bodies
+func xmlElement(name xml.Name) (string, string) {
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		return "<" + prefix + ":" + name.Local + ">", "</" + prefix + ":" + name.Local + ">"
+	}
+	if name.Space == "" {
+		return "<" + name.Local + ">", "</" + name.Local + ">"
+	}
+	return `<x:` + name.Local + ` xmlns:x="` + xmlText(name.Space) + `">`, "</x:" + name.Local + ">"
+}
+
+// commonProps are the properties of every resource of a request
+func commonProps(r *http.Request, resourceType string) davProps {
+	return davProps{
+		davElement("resourcetype"): davValue(resourceType),
+		davElement("current-user-principal"): func() string {
+			caller := callerOf(r)
+			if caller.Admin && caller.UserID == 0 {
+				return "<d:unauthenticated/>"
+			}
+			return davHref(davPrincipalPath(caller.UserID))
+		},
+	}
+}
+
+func principalProps(r *http.Request, userID int) davProps {
+	props := commonProps(r, davPrincipalType)
+	props[davElement("displayname")] = davValue(xmlText(fmt.Sprintf("User %d", userID)))
+	props[davElement("principal-URL")] = davValue(davHref(davPrincipalPath(userID)))
+	props[calDAVElement("calendar-home-set")] = davValue(davHref(davHomePath(userID)))
+	return props
+}
+
+func homeProps(r *http.Request, userID int) davProps {
+	props := commonProps(r, davCollectionType)
+	props[davElement("displayname")] = davValue(xmlText(fmt.Sprintf("Calendars of user %d", userID)))
+	props[davElement("owner")] = davValue(davHref(davPrincipalPath(userID)))
+	return props
+}
+
+func calendarProps(r *http.Request, cal Calendar) davProps {
+	props := commonProps(r, davCalendarType)
+	props[davElement("displayname")] = davValue(xmlText(cal.Name))
+	props[davElement("owner")] = davValue(davHref(davPrincipalPath(cal.UserID)))
+	props[davElement("supported-report-set")] = davValue(davSupportedReports)
+	props[davElement("current-user-privilege-set")] = davValue(davOwnerPrivileges)
+	props[calDAVElement("supported-calendar-component-set")] = davValue(davComponentSet)
+	// Any change of the user's events moves the token on, which is all
+	// clients need to notice the changes of the calendar
+	token := func() string {
+		_, seq := store.Changes(cal.UserID, math.MaxInt64)
+		return xmlText(syncToken(seq))
+	}
+	props[davElement("sync-token")] = token
+	props[xml.Name{Space: nsCS, Local: "getctag"}] = token
+	return props
+}
+
+func resourceProps(res *davResource) davProps {
+	return davProps{
+		davElement("resourcetype"):   davValue(davResourceType),
+		davElement("getetag"):        davValue(xmlText(res.etag())),
+		davElement("getcontenttype"): davValue(davResourceMIMEType),
+		davElement("getlastmodified"): func() string {
+			return res.modified().Format(http.TimeFormat)
+		},
+		calDAVElement("calendar-data"): func() string {
+			var b strings.Builder
+			res.writeICS(&b)
+			return xmlText(b.String())
+		},
+	}
+}
+
+// multistatus builds the body of a 207 Multi-Status response
+type multistatus struct {
+	b strings.Builder
+}
+
+func newMultistatus() *multistatus {
+	m := &multistatus{}
+	m.b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	m.b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+	return m
+}
+
+// propstat adds a resource with the properties names asks for, or all of
+// them for no names; those it does not have are reported as not found
+func (m *multistatus) propstat(href string, props davProps, names davPropNames) {
+	var found, missing []xml.Name
+	if len(names) == 0 {
+		for name := range props {
+			if !notInAllProp[name] {
+				found = append(found, name)
+			}
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].Space != found[j].Space {
+				return found[i].Space < found[j].Space
+			}
+			return found[i].Local < found[j].Local
+		})
+	}
+	for _, name := range names {
+		if props[name] != nil {
+			found = append(found, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	m.b.WriteString("<d:response>" + davHref(href))
+	if len(found) > 0 {
+		m.b.WriteString("<d:propstat><d:prop>")
+		for _, name := range found {
+			start, end := xmlElement(name)
+			m.b.WriteString(start + props[name]() + end)
+		}
+		m.b.WriteString("</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>")
+	}
+	if len(missing) > 0 {
+		m.b.WriteString("<d:propstat><d:prop>")
+		for _, name := range missing {
+			start, end := xmlElement(name)
+			m.b.WriteString(start + end)
+		}
+		m.b.WriteString("</d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>")
+	}
+	m.b.WriteString("</d:response>")
+}
+
+// gone adds a resource that does not exist, or no longer does
+func (m *multistatus) gone(href string) {
+	m.b.WriteString("<d:response>" + davHref(href) + "<d:status>HTTP/1.1 404 Not Found</d:status></d:response>")
+}
+
+// send ends the body, with a sync token if one is given, and writes the
+// response
+func (m *multistatus) send(w http.ResponseWriter, token string) {
+	if token != "" {
+		m.b.WriteString("<d:sync-token>" + xmlText(token) + "</d:sync-token>")
+	}
+	m.b.WriteString("</d:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, m.b.String())
+}
+
+// respondWithDAVError answers with a DAV:error body naming the condition
+// that failed
+func respondWithDAVError(w http.ResponseWriter, code int, condition xml.Name) {
+	start, end := xmlElement(condition)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<d:error xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">%s%s</d:error>`+"\n", start, end)
+}
+
+// davPropNames collects the names of the children of a DAV:prop element
+type davPropNames []xml.Name
+
+func (p *davPropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// propfindBody is the body of a PROPFIND; allprop and propname, like no
+// body at all, ask for every property
+type propfindBody struct {
+	XMLName xml.Name     `xml:"DAV: propfind"`
+	Prop    davPropNames `xml:"DAV: prop"`
+}
+
+// calendarQuery is the body of a calendar-query REPORT
+type calendarQuery struct {
+	XMLName xml.Name     `xml:"urn:ietf:params:xml:ns:caldav calendar-query"`
+	Prop    davPropNames `xml:"DAV: prop"`
+	Filter  struct {
+		Comp compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+// compFilter selects components, optionally by time range. Property
+// filters are not evaluated, so a query may return more resources than it
+// asked for, which clients filter themselves.
+type compFilter struct {
+	Name      string       `xml:"name,attr"`
+	TimeRange *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Comps     []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// timeRange is a CalDAV time-range in UTC; either end may be open
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// bounds parses the range; an open end is maxListWindow away from the
+// other one
+func (t *timeRange) bounds() (time.Time, time.Time, error) {
+	if t.Start == "" && t.End == "" {
+		return time.Time{}, time.Time{}, invalidf("time-range needs a start or an end")
+	}
+	var from, to time.Time
+	var err error
+	if t.Start != "" {
+		if from, err = time.Parse(icalDateTimeUTC, t.Start); err != nil {
+			return time.Time{}, time.Time{}, invalidf("invalid time-range start %q", t.Start)
+		}
+	}
+	if t.End != "" {
+		if to, err = time.Parse(icalDateTimeUTC, t.End); err != nil {
+			return time.Time{}, time.Time{}, invalidf("invalid time-range end %q", t.End)
+		}
+	}
+	switch {
+	case t.Start == "":
+		from = to.Add(-maxListWindow)
+	case t.End == "":
+		to = from.Add(maxListWindow)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, invalidf("time-range end must be after its start")
+	}
+	if to.Sub(from) > maxListWindow {
+		return time.Time{}, time.Time{}, invalidf("time-range is longer than %d days", int(maxListWindow.Hours()/24))
+	}
+	return from, to, nil
+}
+
+// calendarMultiget is the body of a calendar-multiget REPORT
+type calendarMultiget struct {
+	XMLName xml.Name     `xml:"urn:ietf:params:xml:ns:caldav calendar-multiget"`
+	Prop    davPropNames `xml:"DAV: prop"`
+	Hrefs   []string     `xml:"DAV: href"`
+}
+
+// syncCollection is the body of a sync-collection REPORT
+type syncCollection struct {
+	XMLName   xml.Name     `xml:"DAV: sync-collection"`
+	SyncToken string       `xml:"DAV: sync-token"`
+	Prop      davPropNames `xml:"DAV: prop"`
+}
+
+// readDAVBody reads the XML body of a PROPFIND or REPORT
+func readDAVBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDAVBody))
+	if err != nil {
+		return nil, invalidf("cannot read the request body: %v", err)
+	}
+	return data, nil
+}
+
+func decodeXML(data []byte, v interface{}) error {
+	if err := xml.Unmarshal(data, v); err != nil {
+		return invalidf("malformed XML body: %v", err)
+	}
+	return nil
+}
+
+// davDepth reads the Depth header of a PROPFIND. Infinite depth is not
+// supported; clients that leave the header out get depth 0.
+func davDepth(w http.ResponseWriter, r *http.Request) (int, bool) {
+	switch r.Header.Get("Depth") {
+	case "", "0":
+		return 0, true
+	case "1":
+		return 1, true
+	case "infinity":
+		respondWithDAVError(w, http.StatusForbidden, davElement("propfind-finite-depth"))
+	default:
+		respondWithError(w, http.StatusBadRequest, "invalid Depth header: want 0 or 1")
+	}
+	return 0, false
+}
+
+// davTarget is a resource listed in a multistatus response
+type davTarget struct {
+	href  string
+	props davProps
+}
+
+// propfind answers a PROPFIND on a resource; at depth 1, children lists its
+// members
+func propfind(w http.ResponseWriter, r *http.Request, self davTarget, children func() []davTarget) {
+	depth, ok := davDepth(w, r)
+	if !ok {
+		return
+	}
+	data, err := readDAVBody(w, r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	var body propfindBody
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := decodeXML(data, &body); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	}
+
+	m := newMultistatus()
+	m.propstat(self.href, self.props, body.Prop)
+	if depth > 0 && children != nil {
+		for _, child := range children() {
+			m.propstat(child.href, child.props, body.Prop)
+		}
+	}
+	m.send(w, "")
+}
+
+// davOptions advertises CalDAV support and the methods of a path
+func davOptions(allowed ...string) http.HandlerFunc {
+	allow := strings.Join(append([]string{http.MethodOptions}, allowed...), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("DAV", "1, calendar-access")
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handler for PROPFIND /dav/; points clients to the principal of the caller
+func propfindDAVRoot(w http.ResponseWriter, r *http.Request) {
+	propfind(w, r, davTarget{davRoot, commonProps(r, davCollectionType)}, nil)
+}
+
+// Handler for PROPFIND /dav/principals/{user_id}/
+func propfindPrincipal(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	propfind(w, r, davTarget{davPrincipalPath(userID), principalProps(r, userID)}, nil)
+}
+
+// Handler for PROPFIND /dav/calendars/{user_id}/; lists the calendars of
+// the user at depth 1
+func propfindHome(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	propfind(w, r, davTarget{davHomePath(userID), homeProps(r, userID)}, func() []davTarget {
+		var targets []davTarget
+		for _, cal := range davCalendars(userID) {
+			targets = append(targets, davTarget{davCalendarPath(cal), calendarProps(r, cal)})
+		}
+		return targets
+	})
+}
+
+// Handler for PROPFIND /dav/calendars/{user_id}/{calendar_id}/; lists the
+// resources of the calendar at depth 1
+func propfindCalendar(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	propfind(w, r, davTarget{davCalendarPath(cal), calendarProps(r, cal)}, func() []davTarget {
+		c := loadCollection(cal)
+		var targets []davTarget
+		for _, name := range c.sortedNames() {
+			targets = append(targets, davTarget{davResourcePath(cal, name), resourceProps(c.resources[name])})
+		}
+		return targets
+	})
+}
+
+// Handler for PROPFIND /dav/calendars/{user_id}/{calendar_id}/{resource}
+func propfindResource(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("resource")
+	res := loadCollection(cal).resources[name]
+	if res == nil {
+		respondWithStoreError(w, notFoundf("resource %s not found", name))
+		return
+	}
+	propfind(w, r, davTarget{davResourcePath(cal, name), resourceProps(res)}, nil)
+}
+
+// Handler for REPORT /dav/calendars/{user_id}/{calendar_id}/; runs a
+// calendar-query, calendar-multiget or sync-collection report
+func reportCalendar(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	data, err := readDAVBody(w, r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	var root struct{ XMLName xml.Name }
+	if err := decodeXML(data, &root); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	switch root.XMLName {
+	case calDAVElement("calendar-query"):
+		err = calendarQueryReport(w, cal, data)
+	case calDAVElement("calendar-multiget"):
+		err = calendarMultigetReport(w, cal, data)
+	case davElement("sync-collection"):
+		err = syncCollectionReport(w, cal, data)
+	default:
+		respondWithDAVError(w, http.StatusForbidden, davElement("supported-report"))
+		return
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+	}
+}
+
+// calendarQueryReport lists the resources with an event in the time range
+// of the query, or all of them without one
+func calendarQueryReport(w http.ResponseWriter, cal Calendar, data []byte) error {
+	var query calendarQuery
+	if err := decodeXML(data, &query); err != nil {
+		return err
+	}
+
+	c := loadCollection(cal)
+	names := c.sortedNames()
+	if top := query.Filter.Comp; top.Name != "" && !strings.EqualFold(top.Name, "VCALENDAR") {
+		names = nil
+	} else {
+		for _, comp := range top.Comps {
+			if !strings.EqualFold(comp.Name, "VEVENT") {
+				// Only events are stored
+				names = nil
+				break
+			}
+			if comp.TimeRange != nil {
+				from, to, err := comp.TimeRange.bounds()
+				if err != nil {
+					return err
+				}
+				names = c.namesInRange(from, to)
+			}
+		}
+	}
+
+	m := newMultistatus()
+	for _, name := range names {
+		m.propstat(davResourcePath(cal, name), resourceProps(c.resources[name]), query.Prop)
+	}
+	m.send(w, "")
+	return nil
+}
+
+// calendarMultigetReport returns the resources of the given hrefs
+func calendarMultigetReport(w http.ResponseWriter, cal Calendar, data []byte) error {
+	var multiget calendarMultiget
+	if err := decodeXML(data, &multiget); err != nil {
+		return err
+	}
+
+	c := loadCollection(cal)
+	m := newMultistatus()
+	for _, href := range multiget.Hrefs {
+		if res := c.lookup(href); res != nil {
+			m.propstat(href, resourceProps(res), multiget.Prop)
+		} else {
+			m.gone(href)
+		}
+	}
+	m.send(w, "")
+	return nil
+}
+
+// syncCollectionReport lists every resource for an empty sync token, and
+// the resources changed or removed since a given one otherwise, with a new
+// token. Tokens are audit sequence numbers, so they stay valid across
+// restarts.
+func syncCollectionReport(w http.ResponseWriter, cal Calendar, data []byte) error {
+	var sync syncCollection
+	if err := decodeXML(data, &sync); err != nil {
+		return err
+	}
+
+	if sync.SyncToken == "" {
+		// The token is taken first, so a change made meanwhile is reported
+		// again rather than missed
+		_, latest := store.Changes(cal.UserID, math.MaxInt64)
+		c := loadCollection(cal)
+		m := newMultistatus()
+		for _, name := range c.sortedNames() {
+			m.propstat(davResourcePath(cal, name), resourceProps(c.resources[name]), sync.Prop)
+		}
+		m.send(w, syncToken(latest))
+		return nil
+	}
+
+	seq, ok := parseSyncToken(sync.SyncToken)
+	if !ok {
+		respondWithDAVError(w, http.StatusForbidden, davElement("valid-sync-token"))
+		return nil
+	}
+	entries, latest := store.Changes(cal.UserID, seq)
+	if seq > latest {
+		respondWithDAVError(w, http.StatusForbidden, davElement("valid-sync-token"))
+		return nil
+	}
+	c := loadCollection(cal)
+	m := newMultistatus()
+	for _, name := range c.changedNames(entries) {
+		if res := c.resources[name]; res != nil {
+			m.propstat(davResourcePath(cal, name), resourceProps(res), sync.Prop)
+		} else {
+			m.gone(davResourcePath(cal, name))
+		}
+	}
+	m.send(w, syncToken(latest))
+	return nil
+}
+
+// Handler for GET /dav/calendars/{user_id}/{calendar_id}/{resource}
+func getResource(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("resource")
+	res := loadCollection(cal).resources[name]
+	if res == nil {
+		respondWithStoreError(w, notFoundf("resource %s not found", name))
+		return
+	}
+	etag := res.etag()
+	if notModified(w, r, etag) {
+		return
+	}
+
+	var body bytes.Buffer
+	if err := res.writeICS(&body); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", res.modified().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
+
+// calendarObject is the content of a resource sent by a client
+type calendarObject struct {
+	master Event
+	// overrides are edited occurrences of master, with RecurrenceID set
+	overrides []Event
+}
+
+// parseCalendarObject reads the VEVENTs of a resource. They must all have
+// the UID the resource is named after, and all but one must be edited
+// occurrences of that one.
+func parseCalendarObject(name string, components []icalComponent) (calendarObject, error) {
+	var object calendarObject
+	uid, ok := strings.CutSuffix(name, ".ics")
+	if !ok || uid == "" {
+		return object, invalidf("resource name %q is not a UID followed by .ics", name)
+	}
+	hasMaster := false
+	for _, c := range components {
+		event, recurrenceID, err := veventToEvent(c)
+		if err != nil {
+			return object, invalidf("VEVENT %d: %v", c.Index, err)
+		}
+		if event.UID != uid {
+			return object, invalidf("VEVENT %d: UID %q does not match the resource name", c.Index, event.UID)
+		}
+		if err := checkFieldSizes(event); err != nil {
+			return object, err
+		}
+		if recurrenceID == nil {
+			if hasMaster {
+				return object, invalidf("VEVENT %d: only one VEVENT may lack a RECURRENCE-ID", c.Index)
+			}
+			object.master, hasMaster = event, true
+			continue
+		}
+		event.RecurrenceID = recurrenceID
+		object.overrides = append(object.overrides, event)
+	}
+	if !hasMaster {
+		return object, invalidf("the calendar object needs a VEVENT without RECURRENCE-ID")
+	}
+	if err := normalizeRRule(&object.master); err != nil {
+		return object, err
+	}
+
+	// Clients may or may not list the edited occurrences as exception
+	// dates; the store always does
+	series := object.master
+	series.ExDates = nil
+	for i, override := range object.overrides {
+		t := *override.RecurrenceID
+		if !series.hasOccurrence(t) {
+			return object, invalidf("RECURRENCE-ID %s is not an occurrence of the event", t.Format(time.RFC3339))
+		}
+		for _, other := range object.overrides[:i] {
+			if other.RecurrenceID.Equal(t) {
+				return object, invalidf("RECURRENCE-ID %s is edited twice", t.Format(time.RFC3339))
+			}
+		}
+		if !object.master.isExcluded(t) {
+			object.master.ExDates = append(object.master.ExDates, t)
+		}
+	}
+	return object, nil
+}
+
+// assignICalFields copies what iCalendar describes of an event; a changed
+// schedule asks the attendees to answer again
+func assignICalFields(event *Event, from Event) error {
+	old := *event
+	event.Title = from.Title
+	event.Description = from.Description
+	event.Location = from.Location
+	event.StartTime, event.EndTime = from.StartTime, from.EndTime
+	event.AllDay, event.TimeZone = from.AllDay, from.TimeZone
+	if event.RecurrenceID == nil {
+		event.RRule, event.ExDates = from.RRule, from.ExDates
+	}
+	if event.rescheduled(old) {
+		event.resetRSVPs()
+	}
+	return checkFieldSizes(*event)
+}
+
+// createResource stores the events of a new resource
+func createResource(cal Calendar, object calendarObject, by principal) error {
+	master := object.master
+	master.CalendarID = cal.CalendarID
+	master.EventID = getNextEventID()
+	if err := normalizeRRule(&master); err != nil {
+		return err
+	}
+	if err := checkFieldSizes(master); err != nil {
+		return err
+	}
+
+	// The event and its edited occurrences are stored together or not at all
+	ops := []batchOp{{Kind: batchCreate, Event: master}}
+	for _, override := range object.overrides {
+		override.CalendarID = cal.CalendarID
+		override.SeriesID = master.EventID
+		ops = append(ops, batchOp{Kind: batchCreate, Event: override})
+	}
+	return applyBatch(cal.UserID, ops, by)
+}
+
+// replaceResource rewrites the events of a resource in one atomic batch:
+// edited occurrences the object leaves out are deleted, new ones created.
+// What iCalendar does not describe, such as tags, reminders and attendees,
+// is kept.
+func replaceResource(cal Calendar, res *davResource, object calendarObject, by principal) error {
+	current := res.master()
+	if current == nil {
+		return conflictf("resource %s has no event left to update", res.Name)
+	}
+	ops := []batchOp{{
+		Kind:    batchUpdate,
+		EventID: current.EventID,
+		Check:   ifMatchValue(eventETag(*current)),
+		Update:  func(event *Event) error { return assignICalFields(event, object.master) },
+	}}
+
+	kept := make([]bool, len(object.overrides))
+	for _, event := range res.Events[1:] {
+		var replacement *Event
+		for i := range object.overrides {
+			if object.overrides[i].RecurrenceID.Equal(*event.RecurrenceID) {
+				replacement, kept[i] = &object.overrides[i], true
+			}
+		}
+		op := batchOp{Kind: batchDelete, EventID: event.EventID, Check: ifMatchValue(eventETag(event))}
+		if replacement != nil {
+			op.Kind = batchUpdate
+			op.Update = func(e *Event) error { return assignICalFields(e, *replacement) }
+		}
+		ops = append(ops, op)
+	}
+	for i, override := range object.overrides {
+		if !kept[i] {
+			override.CalendarID = cal.CalendarID
+			override.SeriesID = current.EventID
+			ops = append(ops, batchOp{Kind: batchCreate, Event: override})
+		}
+	}
+	return applyBatch(cal.UserID, ops, by)
+}
+
+// davPreconditions checks the If-Match and If-None-Match headers of a write
+// against the resource, which is nil if it does not exist
+func davPreconditions(r *http.Request, res *davResource) error {
+	if header := r.Header.Get("If-None-Match"); header != "" && res != nil && etagMatches(header, res.etag(), true) {
+		return preconditionf("resource %s already exists", res.Name)
+	}
+	if header := r.Header.Get("If-Match"); header != "" {
+		if res == nil {
+			return preconditionf("resource does not exist")
+		}
+		if !etagMatches(header, res.etag(), false) {
+			return preconditionf("resource %s has changed", res.Name)
+		}
+	}
+	return nil
+}
+
+// Handler for PUT /dav/calendars/{user_id}/{calendar_id}/{resource}. The
+// stored object is rewritten, with canonical rules and the server's
+// DTSTAMP, so no ETag is returned and clients fetch it again (RFC 4791
+// 5.3.4).
+func putResource(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("resource")
+	components, err := parseVEvents(http.MaxBytesReader(w, r.Body, maxICSUpload))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	object, err := parseCalendarObject(name, components)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	res := loadCollection(cal).resources[name]
+	if err := davPreconditions(r, res); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if res == nil {
+		err = createResource(cal, object, callerOf(r))
+	} else {
+		err = replaceResource(cal, res, object, callerOf(r))
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	if res == nil {
+		w.Header().Set("Location", davResourcePath(cal, name))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for DELETE /dav/calendars/{user_id}/{calendar_id}/{resource}; the
+// events of the resource go to the trash
+func deleteResource(w http.ResponseWriter, r *http.Request) {
+	cal, ok := davCalendar(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("resource")
+	res := loadCollection(cal).resources[name]
+	if res == nil {
+		respondWithStoreError(w, notFoundf("resource %s not found", name))
+		return
+	}
+	if err := davPreconditions(r, res); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	// The edited occurrences go with their recurring event; only those of
+	// an event that is gone already are deleted on their own
+	events := res.Events
+	if res.master() != nil {
+		events = events[:1]
+	}
+	ops := make([]batchOp, len(events))
+	for i, event := range events {
+		ops[i] = batchOp{Kind: batchDelete, EventID: event.EventID, Check: ifMatchValue(eventETag(event))}
+	}
+	if err := applyBatch(cal.UserID, ops, callerOf(r)); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerDAVRoutes serves the calendars of every user over CalDAV: the
+// principal of a user points to the user's calendar home, whose calendar
+// collections hold one .ics resource per event
+func registerDAVRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/caldav", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, davRoot, http.StatusMovedPermanently)
+	})
+
+	mux.HandleFunc("OPTIONS /dav/{$}", davOptions(methodPropfind))
+	mux.HandleFunc("PROPFIND /dav/{$}", propfindDAVRoot)
+	mux.HandleFunc("/dav/{$}", methodNotAllowed("OPTIONS", "PROPFIND"))
+
+	mux.HandleFunc("OPTIONS /dav/principals/{user_id}/{$}", davOptions(methodPropfind))
+	mux.HandleFunc("PROPFIND /dav/principals/{user_id}/{$}", propfindPrincipal)
+	mux.HandleFunc("/dav/principals/{user_id}/{$}", methodNotAllowed("OPTIONS", "PROPFIND"))
+
+	mux.HandleFunc("OPTIONS /dav/calendars/{user_id}/{$}", davOptions(methodPropfind))
+	mux.HandleFunc("PROPFIND /dav/calendars/{user_id}/{$}", propfindHome)
+	mux.HandleFunc("/dav/calendars/{user_id}/{$}", methodNotAllowed("OPTIONS", "PROPFIND"))
+
+	mux.HandleFunc("OPTIONS /dav/calendars/{user_id}/{calendar_id}/{$}", davOptions(methodPropfind, methodReport))
+	mux.HandleFunc("PROPFIND /dav/calendars/{user_id}/{calendar_id}/{$}", propfindCalendar)
+	mux.HandleFunc("REPORT /dav/calendars/{user_id}/{calendar_id}/{$}", reportCalendar)
+	mux.HandleFunc("/dav/calendars/{user_id}/{calendar_id}/{$}", methodNotAllowed("OPTIONS", "PROPFIND", "REPORT"))
+
+	mux.HandleFunc("OPTIONS /dav/calendars/{user_id}/{calendar_id}/{resource}", davOptions(methodPropfind, "GET", "HEAD", "PUT", "DELETE"))
+	mux.HandleFunc("PROPFIND /dav/calendars/{user_id}/{calendar_id}/{resource}", propfindResource)
+	mux.HandleFunc("GET /dav/calendars/{user_id}/{calendar_id}/{resource}", getResource)
+	mux.HandleFunc("PUT /dav/calendars/{user_id}/{calendar_id}/{resource}", putResource)
+	mux.HandleFunc("DELETE /dav/calendars/{user_id}/{calendar_id}/{resource}", deleteResource)
+	mux.HandleFunc("/dav/calendars/{user_id}/{calendar_id}/{resource}", methodNotAllowed("OPTIONS", "PROPFIND", "GET", "HEAD", "PUT", "DELETE"))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// davMultistatus is what the tests read of a 207 Multi-Status body
+type davMultistatus struct {
+	Responses []struct {
+		Href string `xml:"DAV: href"`
+		// Status is only set for resources that are gone
+		Status string `xml:"DAV: status"`
+	} `xml:"DAV: response"`
+	SyncToken string `xml:"DAV: sync-token"`
+}
+
+// hrefs lists the resources of the response, marking the gone ones
+func (m davMultistatus) hrefs() []string {
+	hrefs := []string{}
+	for _, res := range m.Responses {
+		if res.Status != "" {
+			hrefs = append(hrefs, res.Href+" gone")
+		} else {
+			hrefs = append(hrefs, res.Href)
+		}
+	}
+	return hrefs
+}
+
+// davTest is a CalDAV server for user 1, whose primary calendar holds a
+// daily standup and a review and whose work calendar holds an offsite
+type davTest struct {
+	server  *httptest.Server
+	work    Calendar
+	primary Calendar
+	events  map[string]Event
+}
+
+func newDAVTest(t *testing.T, s EventStore) *davTest {
+	saved := store
+	store = s
+	t.Cleanup(func() { store = saved })
+
+	work, err := store.CreateCalendar(Calendar{UserID: 1, Name: "Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &davTest{
+		work:    work,
+		primary: Calendar{CalendarID: primaryCalendarID, UserID: 1, Name: primaryCalendarName},
+		events:  make(map[string]Event),
+	}
+	test.create(t, Event{UserID: 1, UID: "standup", StartTime: davTestTime(2, 9), RRule: "FREQ=DAILY;COUNT=5"})
+	test.create(t, Event{UserID: 1, UID: "review", StartTime: davTestTime(10, 14)})
+	test.create(t, Event{UserID: 1, UID: "offsite", CalendarID: work.CalendarID, StartTime: davTestTime(5, 9)})
+	test.create(t, Event{UserID: 2, UID: "other", StartTime: davTestTime(3, 9)})
+
+	mux := http.NewServeMux()
+	registerDAVRoutes(mux)
+	test.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal{UserID: 1})))
+	}))
+	t.Cleanup(test.server.Close)
+	return test
+}
+
+// davTestTime returns the given day of March 2026 at the given hour
+func davTestTime(day, hour int) time.Time {
+	return time.Date(2026, time.March, day, hour, 0, 0, 0, time.UTC)
+}
+
+// create stores an hour long event, which is known by its UID afterwards
+func (test *davTest) create(t *testing.T, event Event) {
+	event.EventID = store.NextEventID()
+	event.Title = event.UID
+	event.EndTime = event.StartTime.Add(time.Hour)
+	if err := store.Create(event, systemActor); err != nil {
+		t.Fatalf("create %s: %v", event.UID, err)
+	}
+	test.events[event.UID] = event
+}
+
+// do sends a WebDAV request and returns the status and the multistatus body
+func (test *davTest) do(t *testing.T, method, path, depth, body string) (int, davMultistatus) {
+	req, err := http.NewRequest(method, test.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth != "" {
+		req.Header.Set("Depth", depth)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m davMultistatus
+	if resp.StatusCode == http.StatusMultiStatus {
+		if err := xml.Unmarshal(data, &m); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, data)
+		}
+	}
+	return resp.StatusCode, m
+}
+
+func TestPropfind(t *testing.T) {
+	test := newDAVTest(t, newMemoryStore())
+	primary, work := davCalendarPath(test.primary), davCalendarPath(test.work)
+	const etagProp = `<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`
+
+	tests := []struct {
+		name   string
+		path   string
+		depth  string
+		body   string
+		status int
+		hrefs  []string
+	}{
+		{"root", "/dav/", "0", "", http.StatusMultiStatus, []string{"/dav/"}},
+		{"principal", "/dav/principals/1/", "", "", http.StatusMultiStatus, []string{"/dav/principals/1/"}},
+		{"home", "/dav/calendars/1/", "0", "", http.StatusMultiStatus, []string{"/dav/calendars/1/"}},
+		{"home lists its calendars", "/dav/calendars/1/", "1", "", http.StatusMultiStatus, []string{"/dav/calendars/1/", primary, work}},
+		{"calendar lists its resources", primary, "1", etagProp, http.StatusMultiStatus, []string{primary, primary + "review.ics", primary + "standup.ics"}},
+		{"other calendar", work, "1", etagProp, http.StatusMultiStatus, []string{work, work + "offsite.ics"}},
+		{"resource", primary + "review.ics", "0", etagProp, http.StatusMultiStatus, []string{primary + "review.ics"}},
+		{"missing resource", primary + "missing.ics", "0", "", http.StatusNotFound, nil},
+		{"missing calendar", "/dav/calendars/1/99/", "0", "", http.StatusNotFound, nil},
+		{"home of another user", "/dav/calendars/2/", "1", "", http.StatusForbidden, nil},
+		{"infinite depth", "/dav/calendars/1/", "infinity", "", http.StatusForbidden, nil},
+		{"malformed body", primary, "1", "<d:propfind", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, m := test.do(t, methodPropfind, tt.path, tt.depth, tt.body)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d", status, tt.status)
+			}
+			if tt.hrefs != nil && !reflect.DeepEqual(m.hrefs(), tt.hrefs) {
+				t.Errorf("got %v, want %v", m.hrefs(), tt.hrefs)
+			}
+		})
+	}
+}
+
+// calendarQueryBody returns the body of a calendar-query REPORT for VEVENTs
+// in [start, end)
+func calendarQueryBody(start, end string) string {
+	timeRange := ""
+	if start != "" || end != "" {
+		timeRange = fmt.Sprintf(`<c:time-range start="%s" end="%s"/>`, start, end)
+	}
+	return `<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">` +
+		`<d:prop><d:getetag/></d:prop>` +
+		`<c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT">` + timeRange +
+		`</c:comp-filter></c:comp-filter></c:filter></c:calendar-query>`
+}
+
+func TestCalendarQuery(t *testing.T) {
+	test := newDAVTest(t, newMemoryStore())
+	primary, work := davCalendarPath(test.primary), davCalendarPath(test.work)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		hrefs  []string
+	}{
+		{"all events", primary, calendarQueryBody("", ""), http.StatusMultiStatus, []string{primary + "review.ics", primary + "standup.ics"}},
+		{"single event", primary, calendarQueryBody("20260310T000000Z", "20260311T000000Z"), http.StatusMultiStatus, []string{primary + "review.ics"}},
+		{"later occurrence", primary, calendarQueryBody("20260304T000000Z", "20260305T000000Z"), http.StatusMultiStatus, []string{primary + "standup.ics"}},
+		{"after the last occurrence", primary, calendarQueryBody("20260308T000000Z", "20260309T000000Z"), http.StatusMultiStatus, []string{}},
+		{"open end", primary, calendarQueryBody("20260307T000000Z", ""), http.StatusMultiStatus, []string{primary + "review.ics"}},
+		{"other calendar", work, calendarQueryBody("20260301T000000Z", "20260401T000000Z"), http.StatusMultiStatus, []string{work + "offsite.ics"}},
+		{"no events asked for", primary, strings.Replace(calendarQueryBody("", ""), `name="VEVENT"`, `name="VTODO"`, 1), http.StatusMultiStatus, []string{}},
+		{"empty time range", primary, calendarQueryBody("20260310T000000Z", "20260310T000000Z"), http.StatusBadRequest, nil},
+		{"unsupported report", primary, `<d:expand-property xmlns:d="DAV:"/>`, http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, m := test.do(t, methodReport, tt.path, "", tt.body)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d", status, tt.status)
+			}
+			if tt.hrefs != nil && !reflect.DeepEqual(m.hrefs(), tt.hrefs) {
+				t.Errorf("got %v, want %v", m.hrefs(), tt.hrefs)
+			}
+		})
+	}
+}
+
+func syncCollectionBody(token string) string {
+	return `<d:sync-collection xmlns:d="DAV:"><d:sync-token>` + token + `</d:sync-token>` +
+		`<d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`
+}
+
+// TestSyncCollection runs on both in-memory stores, which index the audit
+// log the sync tokens refer to in different ways
+func TestSyncCollection(t *testing.T) {
+	t.Run("store=memory", func(t *testing.T) { testSyncCollection(t, newMemoryStore()) })
+	t.Run("store=sharded", func(t *testing.T) { testSyncCollection(t, newShardedStore(4)) })
+}
+
+func testSyncCollection(t *testing.T, s EventStore) {
+	test := newDAVTest(t, s)
+	primary := davCalendarPath(test.primary)
+
+	status, m := test.do(t, methodReport, primary, "", syncCollectionBody(""))
+	if status != http.StatusMultiStatus {
+		t.Fatalf("initial sync: got status %d", status)
+	}
+	if want := []string{primary + "review.ics", primary + "standup.ics"}; !reflect.DeepEqual(m.hrefs(), want) {
+		t.Fatalf("initial sync: got %v, want %v", m.hrefs(), want)
+	}
+
+	// Each step syncs from the token of the one before
+	token := m.SyncToken
+	update := func(uid string) func() error {
+		return func() error {
+			event := test.events[uid]
+			_, err := store.Update(event.UserID, event.EventID, systemActor, func(e *Event) error {
+				e.Title = "moved"
+				return nil
+			})
+			return err
+		}
+	}
+	tests := []struct {
+		name   string
+		change func() error
+		hrefs  []string
+	}{
+		{"no change", func() error { return nil }, []string{}},
+		{"event updated", update("review"), []string{primary + "review.ics"}},
+		{"event created", func() error {
+			test.create(t, Event{UserID: 1, UID: "lunch", StartTime: davTestTime(4, 12)})
+			return nil
+		}, []string{primary + "lunch.ics"}},
+		{"event deleted", func() error {
+			event := test.events["standup"]
+			return store.Delete(1, event.EventID, systemActor, nil)
+		}, []string{primary + "standup.ics gone"}},
+		{"other calendar changed", update("offsite"), []string{}},
+		{"other user changed", update("other"), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatal(err)
+			}
+			status, m := test.do(t, methodReport, primary, "", syncCollectionBody(token))
+			if status != http.StatusMultiStatus {
+				t.Fatalf("got status %d", status)
+			}
+			if !reflect.DeepEqual(m.hrefs(), tt.hrefs) {
+				t.Errorf("got %v, want %v", m.hrefs(), tt.hrefs)
+			}
+			if m.SyncToken == "" {
+				t.Fatal("got no sync token")
+			}
+			token = m.SyncToken
+		})
+	}
+
+	for _, bad := range []string{"bogus", syncTokenPrefix + "-1", syncToken(1 << 40)} {
+		if status, _ := test.do(t, methodReport, primary, "", syncCollectionBody(bad)); status != http.StatusForbidden {
+			t.Errorf("token %q: got status %d, want %d", bad, status, http.StatusForbidden)
+		}
+	}
+}
+
+func TestDeleteResource(t *testing.T) {
+	test := newDAVTest(t, newMemoryStore())
+	standup := test.events["standup"]
+	if err := updateOccurrence(1, standup.EventID, davTestTime(3, 9), scopeThis, map[string]string{"title": "Moved"}, false, systemActor, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := davCalendarPath(test.primary) + "standup.ics"
+	if status, _ := test.do(t, "DELETE", path, "", ""); status != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", status, http.StatusNoContent)
+	}
+	for _, event := range store.List(1) {
+		if event.UID == "standup" || event.SeriesID == standup.EventID {
+			t.Errorf("event %+v of the resource is left", event)
+		}
+	}
+	if status, _ := test.do(t, methodPropfind, path, "0", ""); status != http.StatusNotFound {
+		t.Errorf("got status %d after the delete, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds that handlers map to HTTP status codes
+var (
+	errNotFound     = errors.New("not found")
+	errConflict     = errors.New("conflict")
+	errInvalid      = errors.New("invalid request")
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+	errPrecondition = errors.New("precondition failed")
+)
+
+// kindError is a descriptive error that also matches one of the error kinds
+// through errors.Is
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func notFoundf(format string, args ...interface{}) error {
+	return &kindError{kind: errNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...interface{}) error {
+	return &kindError{kind: errConflict, msg: fmt.Sprintf(format, args...)}
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &kindError{kind: errInvalid, msg: fmt.Sprintf(format, args...)}
+}
+
+func unauthorizedf(format string, args ...interface{}) error {
+	return &kindError{kind: errUnauthorized, msg: fmt.Sprintf(format, args...)}
+}
+
+func forbiddenf(format string, args ...interface{}) error {
+	return &kindError{kind: errForbidden, msg: fmt.Sprintf(format, args...)}
+}
+
+func preconditionf(format string, args ...interface{}) error {
+	return &kindError{kind: errPrecondition, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// eventCheck vetoes a write to the current version of a stored event by
+// returning an error; it runs under the store lock, so the check and the
+// write are atomic
+type eventCheck func(event Event) error
+
+// verify runs the check; a nil check accepts every event
+func (c eventCheck) verify(event Event) error {
+	if c == nil {
+		return nil
+	}
+	return c(event)
+}
+
+// eventETag returns the strong entity tag of an event version
+func eventETag(event Event) string {
+	return `"` + strconv.Itoa(event.Version) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// lists etag. "*" matches any current entity; weak comparison ignores the W/
+// prefix, strong comparison never matches a weak tag.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "*":
+			return true
+		case weak && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/"):
+			return true
+		case !weak && tag == etag && !strings.HasPrefix(etag, "W/"):
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch turns the If-Match header of a request into a check that fails
+// with a precondition error when the event has changed since the client read
+// it; it returns nil when the header is absent
+func ifMatch(r *http.Request) eventCheck {
+	return ifMatchValue(r.Header.Get("If-Match"))
+}
+
+// ifMatchValue is ifMatch for an If-Match value sent some other way
+func ifMatchValue(header string) eventCheck {
+	if header == "" {
+		return nil
+	}
+	return func(event Event) error {
+		if !etagMatches(header, eventETag(event), false) {
+			return preconditionf("event ID %d has changed: current version is %d", event.EventID, event.Version)
+		}
+		return nil
+	}
+}
+
+// notModified answers a conditional read with 304 when If-None-Match lists
+// the current etag, and reports whether it did
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, etag, true) {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// respondWithEvent sends an event with its ETag
+func respondWithEvent(w http.ResponseWriter, code int, event Event) {
+	w.Header().Set("ETag", eventETag(event))
+	respondWithJSON(w, code, map[string]interface{}{"result": event})
+}
+
+// respondWithCacheableJSON sends a 200 response with a weak ETag derived
+// from the body, or 304 if the client already has it. Polling clients save
+// the transfer, not the query.
+func respondWithCacheableJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:8]) + `"`
+	if notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
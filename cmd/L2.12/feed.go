@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// changeLogSize bounds the changes kept for Last-Event-ID resume
+	changeLogSize = 4096
+	// subscriberBuffer is how many changes a subscriber may fall behind
+	// before it is disconnected
+	subscriberBuffer = 256
+	// sseKeepAlive is the period of comment lines that keep idle streams open
+	sseKeepAlive = 15 * time.Second
+	// sseWriteTimeout drops clients that stop reading
+	sseWriteTimeout = 30 * time.Second
+)
+
+// Change types
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+// change is one entry of the change feed
+type change struct {
+	Seq     int64     `json:"seq"`
+	Type    string    `json:"type"`
+	UserID  int       `json:"user_id"`
+	EventID int       `json:"event_id"`
+	Event   *Event    `json:"event,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// subscriber receives the changes of one user's calendar. Its channel is
+// buffered; a subscriber that falls too far behind is dropped, and lagged is
+// closed so the stream ends and the client resumes from the change log.
+type subscriber struct {
+	userID int
+	ch     chan change
+	lagged chan struct{}
+}
+
+// changeFeed keeps a bounded log of recent changes and fans them out to
+// subscribers. Publishing never blocks, because it runs while the store holds
+// its write lock.
+type changeFeed struct {
+	mu          sync.Mutex
+	log         []change // ring buffer of the latest changes
+	start       int      // index of the oldest change in log
+	seq         int64    // sequence number of the latest change
+	subscribers map[*subscriber]bool
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subscribers: make(map[*subscriber]bool)}
+}
+
+// publish numbers the changes, appends them to the log and hands them to
+// the subscribers of their users
+func (f *changeFeed) publish(changes []change) {
+	if len(changes) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now().UTC()
+	for _, c := range changes {
+		f.seq++
+		c.Seq = f.seq
+		c.Time = now
+		if len(f.log) < changeLogSize {
+			f.log = append(f.log, c)
+		} else {
+			f.log[f.start] = c
+			f.start = (f.start + 1) % changeLogSize
+		}
+
+		for sub := range f.subscribers {
+			if sub.userID != c.UserID {
+				continue
+			}
+			select {
+			case sub.ch <- c:
+			default:
+				delete(f.subscribers, sub)
+				close(sub.lagged)
+			}
+		}
+	}
+}
+
+// subscribe registers a subscriber for the user and returns the logged
+// changes after lastSeq it has missed. resumed is false when lastSeq is no
+// longer (or not yet) in the log, in which case the client has to reload.
+func (f *changeFeed) subscribe(userID int, lastSeq int64) (sub *subscriber, backlog []change, resumed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub = &subscriber{userID: userID, ch: make(chan change, subscriberBuffer), lagged: make(chan struct{})}
+	f.subscribers[sub] = true
+
+	if lastSeq < 0 {
+		return sub, nil, true
+	}
+	oldest := f.seq - int64(len(f.log)) + 1
+	if lastSeq > f.seq || lastSeq < oldest-1 {
+		return sub, nil, false
+	}
+	for i := range f.log {
+		c := f.log[(f.start+i)%len(f.log)]
+		if c.Seq > lastSeq && c.UserID == userID {
+			backlog = append(backlog, c)
+		}
+	}
+	return sub, backlog, true
+}
+
+// unsubscribe removes a subscriber that has not been dropped already
+func (f *changeFeed) unsubscribe(sub *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, sub)
+}
+
+// subscriberCount returns the number of open subscriptions
+func (f *changeFeed) subscriberCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+// disconnect drops every subscriber, so that the streams end and their
+// clients reconnect; it lets a shutting down server drain
+func (f *changeFeed) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.lagged)
+	}
+}
+
+// changesLocked describes the effect of a record on the calendars of the
+// owner and the attendees; the caller must hold the write lock and call it
+// before the record is applied
+func (s *memoryStore) changesLocked(rec storeRecord) []change {
+	switch rec.Op {
+	case opPut:
+		event := *rec.Event
+		kind := changeUpdated
+		old, exists := s.events[event.UserID][event.EventID]
+		if !exists {
+			kind = changeCreated
+		}
+		changes := []change{{Type: kind, UserID: event.UserID, EventID: event.EventID, Event: &event}}
+		if exists {
+			return append(changes, attendeeChanges(&old, &event)...)
+		}
+		return append(changes, attendeeChanges(nil, &event)...)
+	case opDelete:
+		changes := []change{{Type: changeDeleted, UserID: rec.UserID, EventID: rec.EventID}}
+		if old, exists := s.events[rec.UserID][rec.EventID]; exists {
+			changes = append(changes, attendeeChanges(&old, nil)...)
+		}
+		return changes
+	case opMove:
+		var changes []change
+		for _, event := range rec.Events {
+			event := event
+			changes = append(changes,
+				change{Type: changeDeleted, UserID: rec.UserID, EventID: event.EventID},
+				change{Type: changeCreated, UserID: event.UserID, EventID: event.EventID, Event: &event})
+			old, exists := s.events[rec.UserID][event.EventID]
+			if !exists {
+				continue
+			}
+			// An attendee that receives the event is told about it once
+			for _, c := range attendeeChanges(&old, &event) {
+				if c.UserID != event.UserID {
+					changes = append(changes, c)
+				}
+			}
+		}
+		return changes
+	case opRestore:
+		event := *rec.Event
+		changes := []change{{Type: changeCreated, UserID: event.UserID, EventID: event.EventID, Event: &event}}
+		return append(changes, attendeeChanges(nil, &event)...)
+	}
+	return nil
+}
+
+// Handler for GET /v1/users/{user_id}/changes; streams the changes of the
+// user's calendar as Server-Sent Events
+func streamChangesV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	lastSeq := int64(-1)
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		if lastSeq, err = strconv.ParseInt(value, 10, 64); err != nil || lastSeq < 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid Last-Event-ID header")
+			return
+		}
+	}
+
+	feed := store.Feed()
+	sub, backlog, resumed := feed.subscribe(userID, lastSeq)
+	defer feed.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(format string, args ...interface{}) bool {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	sendChange := func(c change) bool {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return false
+		}
+		return send("id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, data)
+	}
+
+	if !resumed {
+		// The missed changes are gone; the client must reload the calendar
+		if !send("event: reset\ndata: {}\n\n") {
+			return
+		}
+	} else if !send(": connected\n\n") {
+		return
+	}
+	for _, c := range backlog {
+		if !sendChange(c) {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case c := <-sub.ch:
+			if !sendChange(c) {
+				return
+			}
+		case <-keepAlive.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		case <-sub.lagged:
+			// Deliver what was buffered, then let the client resume
+			for {
+				select {
+				case c := <-sub.ch:
+					if !sendChange(c) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "events.wal"
+	snapshotFileName = "events.snapshot"
+)
+
+// snapshot is the on-disk image of the whole store
+type snapshot struct {
+	NextEventID int     `json:"next_event_id"`
+	Events      []Event `json:"events"`
+	Users       []User  `json:"users,omitempty"`
+
+	Deliveries        []Delivery `json:"deliveries,omitempty"`
+	ReminderWatermark time.Time  `json:"reminder_watermark"`
+
+	Trash []Event      `json:"trash,omitempty"`
+	Audit []auditEntry `json:"audit,omitempty"`
+	// RecordSeq is the sequence number of the latest record included
+	RecordSeq int64 `json:"record_seq,omitempty"`
+
+	Calendars      []Calendar `json:"calendars,omitempty"`
+	NextCalendarID int        `json:"next_calendar_id,omitempty"`
+}
+
+// fileStore is a memoryStore made durable by an append-only write-ahead log.
+// Every change is appended to the log before it is applied in memory, and the
+// log is periodically compacted into a snapshot.
+type fileStore struct {
+	*memoryStore
+
+	dir           string
+	wal           *os.File
+	walRecords    int
+	snapshotEvery int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newFileStore opens (or creates) a store in dir and recovers its state from
+// the latest snapshot and the write-ahead log. A snapshot is taken after
+// snapshotEvery logged changes and, if interval is positive, on that period.
+func newFileStore(dir string, snapshotEvery int, interval time.Duration) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	s := &fileStore{
+		memoryStore:   newMemoryStore(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+		stop:          make(chan struct{}),
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
+	s.memoryStore.journal = s.appendWAL
+
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.snapshotLoop(interval)
+	}
+	return s, nil
+}
+
+func (s *fileStore) Create(event Event, by principal) error {
+	defer s.compact()
+	return s.memoryStore.Create(event, by)
+}
+
+func (s *fileStore) Update(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.Update(userID, eventID, by, fn)
+}
+
+func (s *fileStore) Move(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.Move(userID, eventID, toUserID, by, fn)
+}
+
+func (s *fileStore) Delete(userID, eventID int, by principal, check eventCheck) error {
+	defer s.compact()
+	return s.memoryStore.Delete(userID, eventID, by, check)
+}
+
+func (s *fileStore) PutUser(user User) error {
+	defer s.compact()
+	return s.memoryStore.PutUser(user)
+}
+
+func (s *fileStore) UpdateUser(userID int, fn func(*User) error) (User, error) {
+	defer s.compact()
+	return s.memoryStore.UpdateUser(userID, fn)
+}
+
+func (s *fileStore) UpdateReminders(update reminderUpdate) error {
+	defer s.compact()
+	return s.memoryStore.UpdateReminders(update)
+}
+
+func (s *fileStore) Stats() storeStats {
+	stats := s.memoryStore.Stats()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats.WALRecords = s.walRecords
+	return stats
+}
+
+// compact takes a snapshot once enough records have been logged. The records
+// are already durable, so a failed snapshot only delays compaction.
+func (s *fileStore) compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshotEvery <= 0 || s.walRecords < s.snapshotEvery {
+		return
+	}
+	if err := s.snapshotLocked(); err != nil {
+		slog.Error("fileStore: snapshot failed", "err", err)
+	}
+}
+
+// Close takes a final snapshot and closes the log
+func (s *fileStore) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.snapshotLocked()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Snapshot writes the current state to disk and truncates the log
+func (s *fileStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.walRecords == 0 {
+		return nil
+	}
+	return s.snapshotLocked()
+}
+
+func (s *fileStore) snapshotLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				slog.Error("fileStore: periodic snapshot failed", "err", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// appendWAL durably appends a record to the log; it is installed as the
+// memoryStore journal and therefore runs under the write lock
+func (s *fileStore) appendWAL(rec storeRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := s.wal.Write(data); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	s.walRecords++
+	return nil
+}
+
+// snapshotLocked must be called with the write lock held
+func (s *fileStore) snapshotLocked() error {
+	snap := snapshot{NextEventID: int(s.eventIDs.current()) + 1, Events: s.all(), Users: s.allUsers(), ReminderWatermark: s.watermark, Trash: s.trashed(), RecordSeq: s.recordSeq, NextCalendarID: int(s.calendarIDs.current()) + 1}
+	for _, cal := range s.calendars {
+		snap.Calendars = append(snap.Calendars, cal)
+	}
+	for _, delivery := range s.deliveries {
+		snap.Deliveries = append(snap.Deliveries, delivery)
+	}
+	for _, entries := range s.audit {
+		snap.Audit = append(snap.Audit, entries...)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+
+	// Records replayed on top of a newer snapshot are idempotent, so a crash
+	// between the rename and the truncation is harmless
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	s.walRecords = 0
+	return nil
+}
+
+func (s *fileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	for _, event := range snap.Events {
+		s.put(event)
+	}
+	for _, user := range snap.Users {
+		s.users[user.UserID] = user
+	}
+	for _, delivery := range snap.Deliveries {
+		s.deliveries[delivery.ID] = delivery
+	}
+	for _, event := range snap.Trash {
+		if s.trash[event.UserID] == nil {
+			s.trash[event.UserID] = make(map[int]Event)
+		}
+		s.trash[event.UserID][event.EventID] = event
+	}
+	sort.Slice(snap.Audit, func(i, j int) bool { return snap.Audit[i].Seq < snap.Audit[j].Seq })
+	for _, entry := range snap.Audit {
+		s.audit[entry.EventID] = append(s.audit[entry.EventID], s.auditIndex.add(entry))
+	}
+	for _, cal := range snap.Calendars {
+		s.calendars[cal.CalendarID] = cal
+	}
+	s.calendarIDs.observe(int64(snap.NextCalendarID) - 1)
+	s.watermark = snap.ReminderWatermark
+	s.recordSeq = snap.RecordSeq
+	s.eventIDs.observe(int64(snap.NextEventID) - 1)
+	return nil
+}
+
+// replayWAL applies every complete record in the log. A torn record at the
+// end of the log (a crash in the middle of a write) is discarded; a corrupt
+// record anywhere else is an error.
+func (s *fileStore) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if len(data) == 0 && readErr == io.EOF {
+			break
+		}
+		if readErr != nil && readErr != io.EOF {
+			f.Close()
+			return fmt.Errorf("read wal: %w", readErr)
+		}
+
+		// A record without its trailing newline was cut short by a crash
+		var rec storeRecord
+		decodeErr := io.ErrUnexpectedEOF
+		if readErr == nil {
+			decodeErr = json.Unmarshal(bytes.TrimSpace(data), &rec)
+		}
+		if decodeErr != nil {
+			if _, err := reader.Peek(1); err != io.EOF {
+				f.Close()
+				return fmt.Errorf("corrupt wal record at line %d: %v", line, decodeErr)
+			}
+			slog.Warn("fileStore: discarding incomplete wal record", "line", line)
+			break
+		}
+		if err := s.apply(rec); err != nil {
+			f.Close()
+			return fmt.Errorf("apply wal record at line %d: %w", line, err)
+		}
+		offset += int64(len(data))
+		s.walRecords++
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	s.wal = f
+	return nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxFreeBusyWindow bounds the range of free/busy and slot queries
+	maxFreeBusyWindow = 92 * 24 * time.Hour
+	defaultSlotStep   = 15 * time.Minute
+	defaultSlotLimit  = 10
+	// minSlotStep and maxSlotLimit bound the work of a slot query
+	minSlotStep  = 5 * time.Minute
+	maxSlotLimit = 100
+)
+
+// Free/busy policies, which decide whose busy time a caller may query
+const (
+	// freeBusyAll lets every caller see when any user is busy
+	freeBusyAll = "all"
+	// freeBusyPrivate limits callers to the users they act for and to the
+	// calendars other users shared with them
+	freeBusyPrivate = "private"
+)
+
+// freeBusyPolicy is set with -freebusy-policy; showing everybody's busy
+// time takes an explicit opt-in
+var freeBusyPolicy = freeBusyPrivate
+
+// busySource is the part of a user's calendar whose events count as busy
+type busySource struct {
+	UserID int
+	// Calendars, if not nil, limits the source to the user's own events in
+	// these calendars
+	Calendars map[int]bool
+}
+
+// freeBusySource returns what the caller may see of when userID is busy.
+// Users and admins acting for them see every event, as does anybody under
+// the all policy; otherwise only calendars shared with the caller count, at
+// any access level.
+func freeBusySource(r *http.Request, userID int) (busySource, error) {
+	caller := callerOf(r)
+	if caller.canActAs(userID) || freeBusyPolicy == freeBusyAll {
+		return busySource{UserID: userID}, nil
+	}
+	shared := make(map[int]bool)
+	for _, cal := range store.Calendars(caller.UserID) {
+		if cal.UserID == userID && allows(cal.accessOf(caller), accessFreeBusy) {
+			shared[cal.CalendarID] = true
+		}
+	}
+	if len(shared) == 0 {
+		return busySource{}, forbiddenf("not allowed to see the free/busy time of user %d", userID)
+	}
+	return busySource{UserID: userID, Calendars: shared}, nil
+}
+
+// freeBusySources returns the sources of the users, failing on the first
+// user the caller may not see
+func freeBusySources(r *http.Request, userIDs []int) ([]busySource, error) {
+	sources := make([]busySource, len(userIDs))
+	for i, userID := range userIDs {
+		source, err := freeBusySource(r, userID)
+		if err != nil {
+			return nil, err
+		}
+		sources[i] = source
+	}
+	return sources, nil
+}
+
+// interval is a half-open time range [Start, End)
+type interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// slot is a suggested meeting time
+type slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Score int       `json:"score"`
+}
+
+// busyIntervals returns the merged busy time of the sources inside
+// [from, to). All-day events mark a date rather than a time and do not block
+// time.
+func busyIntervals(sources []busySource, from, to time.Time) []interval {
+	var busy []interval
+	for _, source := range sources {
+		for _, event := range getEventsForRange(source.UserID, from, to) {
+			if event.AllDay {
+				continue
+			}
+			if source.Calendars != nil && (event.UserID != source.UserID || !source.Calendars[event.CalendarID]) {
+				continue
+			}
+			start, end := event.span()
+			busy = append(busy, interval{Start: start, End: end})
+		}
+	}
+	return mergeIntervals(busy, from, to)
+}
+
+// mergeIntervals clips intervals to [from, to) and merges the overlapping or
+// touching ones
+func mergeIntervals(intervals []interval, from, to time.Time) []interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+	var merged []interval
+	for _, iv := range intervals {
+		if iv.Start.Before(from) {
+			iv.Start = from
+		}
+		if iv.End.After(to) {
+			iv.End = to
+		}
+		if !iv.Start.Before(iv.End) {
+			continue
+		}
+		if n := len(merged); n > 0 && !iv.Start.After(merged[n-1].End) {
+			if iv.End.After(merged[n-1].End) {
+				merged[n-1].End = iv.End
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// slotQuery describes a meeting slot search
+type slotQuery struct {
+	From, To  time.Time
+	Location  *time.Location
+	Duration  time.Duration
+	Buffer    time.Duration
+	Step      time.Duration
+	WorkStart time.Duration // offset from local midnight
+	WorkEnd   time.Duration
+	Weekdays  map[time.Weekday]bool
+	Limit     int
+}
+
+// findSlots returns candidate meeting slots inside working hours that keep at
+// least Buffer away from every busy interval. Slots that sit flush against
+// the edge of a free gap leave the rest of the gap whole and rank higher, as
+// do earlier days.
+func findSlots(busy []interval, q slotQuery) []slot {
+	// Grow every busy interval by the buffer so the gaps already respect it
+	padded := make([]interval, len(busy))
+	for i, iv := range busy {
+		padded[i] = interval{Start: iv.Start.Add(-q.Buffer), End: iv.End.Add(q.Buffer)}
+	}
+	padded = mergeIntervals(padded, q.From.Add(-q.Buffer), q.To.Add(q.Buffer))
+
+	var slots []slot
+	first := q.From.In(q.Location)
+	day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, q.Location)
+	for dayIndex := 0; day.Before(q.To); dayIndex++ {
+		if q.Weekdays[day.Weekday()] {
+			work := interval{Start: clockOn(day, q.WorkStart), End: clockOn(day, q.WorkEnd)}
+			if work.Start.Before(q.From) {
+				work.Start = q.From
+			}
+			if work.End.After(q.To) {
+				work.End = q.To
+			}
+			for _, gap := range freeGaps(padded, work) {
+				slots = append(slots, gapSlots(gap, q, dayIndex)...)
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+
+	sort.SliceStable(slots, func(i, j int) bool {
+		if slots[i].Score != slots[j].Score {
+			return slots[i].Score > slots[j].Score
+		}
+		return slots[i].Start.Before(slots[j].Start)
+	})
+	if len(slots) > q.Limit {
+		slots = slots[:q.Limit]
+	}
+	return slots
+}
+
+// clockOn returns the wall clock time offset after midnight of day in the
+// day's location; on days with a DST change it differs from day.Add(offset)
+func clockOn(day time.Time, offset time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// freeGaps returns the parts of window not covered by the sorted busy intervals
+func freeGaps(busy []interval, window interval) []interval {
+	var gaps []interval
+	cursor := window.Start
+	for _, iv := range busy {
+		if !iv.End.After(cursor) {
+			continue
+		}
+		if !iv.Start.Before(window.End) {
+			break
+		}
+		if iv.Start.After(cursor) {
+			gaps = append(gaps, interval{Start: cursor, End: iv.Start})
+		}
+		cursor = iv.End
+	}
+	if cursor.Before(window.End) {
+		gaps = append(gaps, interval{Start: cursor, End: window.End})
+	}
+	return gaps
+}
+
+// gapSlots lays out slots of the requested duration inside a free gap
+func gapSlots(gap interval, q slotQuery, dayIndex int) []slot {
+	var slots []slot
+	last := gap.End.Add(-q.Duration)
+	for start := gap.Start; !start.After(last); start = start.Add(q.Step) {
+		slots = append(slots, scoredSlot(gap, start, q, dayIndex))
+	}
+	// Always offer the slot that ends exactly at the end of the gap
+	if len(slots) > 0 && !slots[len(slots)-1].Start.Equal(last) {
+		slots = append(slots, scoredSlot(gap, last, q, dayIndex))
+	}
+	return slots
+}
+
+func scoredSlot(gap interval, start time.Time, q slotQuery, dayIndex int) slot {
+	end := start.Add(q.Duration)
+	score := 100 - 10*dayIndex
+	if start.Equal(gap.Start) || end.Equal(gap.End) {
+		score += 5
+	}
+	return slot{Start: start.In(q.Location), End: end.In(q.Location), Score: score}
+}
+
+// parseUserIDs parses a comma-separated list of user IDs
+func parseUserIDs(params url.Values, key string) ([]int, error) {
+	value := params.Get(key)
+	if value == "" {
+		return nil, fmt.Errorf("missing %s parameter", key)
+	}
+	var userIDs []int
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(value, ",") {
+		userID, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter: %s", key, err)
+		}
+		if !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
+// parseDurationParam parses an optional Go duration parameter
+func parseDurationParam(params url.Values, key string, def time.Duration) (time.Duration, error) {
+	value := params.Get(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s parameter: want a duration such as 45m", key)
+	}
+	return d, nil
+}
+
+// parseClockParam parses an optional HH:MM parameter as an offset from midnight
+func parseClockParam(params url.Values, key string, def time.Duration) (time.Duration, error) {
+	value := params.Get(key)
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		if value != "24:00" {
+			return 0, fmt.Errorf("invalid %s parameter: want HH:MM", key)
+		}
+		return 24 * time.Hour, nil
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseWindow reads the from/to parameters of a multi-user query in the tz
+// parameter or the first user's time zone
+func parseWindow(params url.Values, userIDs []int) (time.Time, time.Time, *time.Location, error) {
+	loc, err := requestLocation(params, userIDs[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	from, err := parseInstant(params, "from", loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	to, err := parseInstant(params, "to", loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, nil, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > maxFreeBusyWindow {
+		return time.Time{}, time.Time{}, nil, fmt.Errorf("window is longer than %d days", int(maxFreeBusyWindow.Hours()/24))
+	}
+	return from, to, loc, nil
+}
+
+// Handler for GET /v1/freebusy?user_ids=3,7,12&from=...&to=...
+func freeBusyHandler(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	userIDs, err := parseUserIDs(queryParams, "user_ids")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sources, err := freeBusySources(r, userIDs)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	from, to, loc, err := parseWindow(queryParams, userIDs)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	perUser := make(map[string][]interval, len(sources))
+	for _, source := range sources {
+		perUser[strconv.Itoa(source.UserID)] = inLocation(busyIntervals([]busySource{source}, from, to), loc)
+	}
+	busy := inLocation(busyIntervals(sources, from, to), loc)
+	free := inLocation(freeGaps(busy, interval{Start: from, End: to}), loc)
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"busy":     busy,
+		"free":     free,
+		"per_user": perUser,
+	}})
+}
+
+// Handler for GET /v1/slots?user_ids=3,7,12&from=...&to=...&duration=45m
+func slotsHandler(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	userIDs, err := parseUserIDs(queryParams, "user_ids")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sources, err := freeBusySources(r, userIDs)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	from, to, loc, err := parseWindow(queryParams, userIDs)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q := slotQuery{From: from, To: to, Location: loc, Limit: defaultSlotLimit}
+	if q.Duration, err = parseDurationParam(queryParams, "duration", 0); err != nil || q.Duration == 0 {
+		respondWithError(w, http.StatusBadRequest, "missing or invalid duration parameter: want a duration such as 45m")
+		return
+	}
+	if q.Buffer, err = parseDurationParam(queryParams, "buffer", 0); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.Step, err = parseDurationParam(queryParams, "step", defaultSlotStep); err != nil || q.Step < minSlotStep {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid step parameter: want a duration of at least %s", minSlotStep))
+		return
+	}
+	if q.WorkStart, err = parseClockParam(queryParams, "work_start", 9*time.Hour); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.WorkEnd, err = parseClockParam(queryParams, "work_end", 18*time.Hour); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.WorkEnd <= q.WorkStart {
+		respondWithError(w, http.StatusBadRequest, "work_end must be after work_start")
+		return
+	}
+	if limit := queryParams.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxSlotLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit parameter: want 1 to %d", maxSlotLimit))
+			return
+		}
+	}
+	weekdays := queryParams.Get("weekdays")
+	if weekdays == "" {
+		weekdays = "MO,TU,WE,TH,FR"
+	}
+	q.Weekdays = make(map[time.Weekday]bool)
+	for _, code := range strings.Split(weekdays, ",") {
+		wd, ok := weekdayCodes[strings.ToUpper(strings.TrimSpace(code))]
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid weekdays parameter: unknown day %q", code))
+			return
+		}
+		q.Weekdays[wd] = true
+	}
+
+	slots := findSlots(busyIntervals(sources, from.Add(-q.Buffer), to.Add(q.Buffer)), q)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": slots})
+}
+
+// inLocation converts intervals for display in loc
+func inLocation(intervals []interval, loc *time.Location) []interval {
+	out := make([]interval, len(intervals))
+	for i, iv := range intervals {
+		out[i] = interval{Start: iv.Start.In(loc), End: iv.End.In(loc)}
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFreeBusyAccess(t *testing.T) {
+	const query = "/v1/freebusy?user_ids=2&from=2026-03-02T00:00:00Z&to=2026-03-03T00:00:00Z"
+	tests := []struct {
+		name string
+		// policy is the -freebusy-policy, the default if empty
+		policy string
+		caller principal
+		// share is the access user 2 grants the caller to the work
+		// calendar, if any
+		share  string
+		status int
+		busy   int
+	}{
+		{"own calendar", freeBusyPrivate, principal{UserID: 2}, "", http.StatusOK, 2},
+		{"admin", freeBusyPrivate, principal{Admin: true}, "", http.StatusOK, 2},
+		{"stranger", "", principal{UserID: 1}, "", http.StatusForbidden, 0},
+		{"free/busy share", freeBusyPrivate, principal{UserID: 1}, accessFreeBusy, http.StatusOK, 1},
+		{"read share", freeBusyPrivate, principal{UserID: 1}, accessRead, http.StatusOK, 1},
+		{"stranger under the all policy", freeBusyAll, principal{UserID: 1}, "", http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.policy != "" {
+				policy := freeBusyPolicy
+				freeBusyPolicy = tt.policy
+				t.Cleanup(func() { freeBusyPolicy = policy })
+			}
+			test := newAPITest(t)
+
+			work := Calendar{UserID: 2, Name: "Work", Shares: map[int]string{}}
+			if tt.share != "" {
+				work.Shares[tt.caller.UserID] = tt.share
+			}
+			work, err := store.CreateCalendar(work)
+			if err != nil {
+				t.Fatal(err)
+			}
+			createTestEvent(t, 2, 9)
+			shared := createTestEvent(t, 2, 14)
+			if _, err := store.Update(2, shared.EventID, systemActor, func(event *Event) error {
+				event.CalendarID = work.CalendarID
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			status, body := test.do(t, tt.caller, "GET", query, "")
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d: %v", status, tt.status, body)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			busy := body["result"].(map[string]interface{})["busy"].([]interface{})
+			if len(busy) != tt.busy {
+				t.Errorf("got busy intervals %v, want %d", busy, tt.busy)
+			}
+		})
+	}
+}
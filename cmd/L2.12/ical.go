@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icalDateTimeUTC = "20060102T150405Z"
+	icalDateTime    = "20060102T150405"
+	icalDate        = "20060102"
+
+	// icalLineLimit is the maximum content line length in octets (RFC 5545 3.1)
+	icalLineLimit = 75
+	// maxICSUpload bounds the size of an imported calendar file
+	maxICSUpload = 10 << 20
+)
+
+// icalProperty is a single unfolded content line
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalComponent is a VEVENT with the properties that belong directly to it
+type icalComponent struct {
+	Index int // 1-based position among the VEVENTs of the file
+	Line  int // line of the BEGIN:VEVENT
+	Props []icalProperty
+}
+
+// get returns the first property with the given name
+func (c *icalComponent) get(name string) (icalProperty, bool) {
+	for _, prop := range c.Props {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return icalProperty{}, false
+}
+
+// importRejection describes a VEVENT that was not imported
+type importRejection struct {
+	Index  int    `json:"index"`
+	Line   int    `json:"line"`
+	UID    string `json:"uid,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// importResult is the outcome of an .ics import
+type importResult struct {
+	Imported []int             `json:"imported"`
+	Skipped  []importRejection `json:"skipped"`
+	Rejected []importRejection `json:"rejected"`
+}
+
+// eventUID returns the iCalendar UID of an event, deriving a stable one for
+// events that were not imported
+func eventUID(event Event) string {
+	if event.UID != "" {
+		return event.UID
+	}
+	return fmt.Sprintf("event-%d-%d@l2-calendar", event.UserID, event.EventID)
+}
+
+// unfoldICal reads content lines, joining folded continuation lines. It also
+// returns the physical line number where each content line starts.
+func unfoldICal(r io.Reader) ([]string, []int, error) {
+	var lines []string
+	var numbers []int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxICSUpload)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, n)
+	}
+	return lines, numbers, scanner.Err()
+}
+
+// parseContentLine splits "NAME;PARAM=VALUE:value" into its parts; parameter
+// values may be quoted and contain ':' or ';'
+func parseContentLine(line string) (icalProperty, error) {
+	prop := icalProperty{Params: make(map[string]string)}
+	inQuotes := false
+	nameEnd, valueStart := -1, -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		}
+		if inQuotes {
+			continue
+		}
+		if c == ';' && nameEnd < 0 {
+			nameEnd = i
+		}
+		if c == ':' {
+			valueStart = i
+			break
+		}
+	}
+	if valueStart < 0 {
+		return prop, fmt.Errorf("malformed content line %q", line)
+	}
+	if nameEnd < 0 {
+		nameEnd = valueStart
+	}
+	prop.Name = strings.ToUpper(line[:nameEnd])
+	prop.Value = line[valueStart+1:]
+
+	if nameEnd < valueStart {
+		for _, param := range splitQuoted(line[nameEnd+1:valueStart], ';') {
+			key, val, ok := strings.Cut(param, "=")
+			if !ok {
+				return prop, fmt.Errorf("malformed parameter %q", param)
+			}
+			prop.Params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+		}
+	}
+	return prop, nil
+}
+
+// splitQuoted splits s on sep outside double quotes
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseVEvents extracts the VEVENT components of a calendar. Properties of
+// nested components such as VALARM are not attributed to the event.
+func parseVEvents(r io.Reader) ([]icalComponent, error) {
+	lines, numbers, err := unfoldICal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []icalComponent
+	var current *icalComponent
+	depth := 0 // nesting level inside the current VEVENT
+	for i, line := range lines {
+		prop, err := parseContentLine(line)
+		if err != nil {
+			if current != nil {
+				// Keep the broken line so the event is rejected with a reason
+				current.Props = append(current.Props, icalProperty{Name: "X-INVALID", Value: err.Error()})
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %v", numbers[i], err)
+		}
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") && current == nil:
+			current = &icalComponent{Index: len(events) + 1, Line: numbers[i]}
+			depth = 0
+		case prop.Name == "BEGIN" && current != nil:
+			depth++
+		case prop.Name == "END" && current != nil && depth > 0:
+			depth--
+		case prop.Name == "END" && current != nil && strings.EqualFold(prop.Value, "VEVENT"):
+			events = append(events, *current)
+			current = nil
+		case current != nil && depth == 0:
+			current.Props = append(current.Props, prop)
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("line %d: VEVENT is not terminated", current.Line)
+	}
+	return events, nil
+}
+
+// parseICalDateTime parses a DATE or DATE-TIME property value, honoring the
+// VALUE=DATE and TZID parameters
+func parseICalDateTime(value string, params map[string]string) (time.Time, error) {
+	if strings.EqualFold(params["VALUE"], "DATE") || len(value) == len(icalDate) {
+		return time.Parse(icalDate, value)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse(icalDateTimeUTC, value)
+	}
+	loc := time.UTC
+	if tzid := params["TZID"]; tzid != "" {
+		var err error
+		loc, err = time.LoadLocation(strings.TrimPrefix(tzid, "/"))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown TZID %q", tzid)
+		}
+	}
+	t, err := time.ParseInLocation(icalDateTime, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date-time %q", value)
+	}
+	return t.UTC(), nil
+}
+
+// isICalDate reports whether a property holds a DATE rather than a DATE-TIME
+func isICalDate(prop icalProperty) bool {
+	return strings.EqualFold(prop.Params["VALUE"], "DATE") || len(prop.Value) == len(icalDate)
+}
+
+// parseICalDuration parses an RFC 5545 duration such as "PT1H30M" or "-P1W"
+func parseICalDuration(value string) (time.Duration, error) {
+	s := value
+	sign := time.Duration(1)
+	switch {
+	case strings.HasPrefix(s, "-"):
+		sign = -1
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+
+	var total time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s {
+		switch {
+		case c == 'T':
+			inTime = true
+		case c >= '0' && c <= '9':
+			num += string(c)
+		default:
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			unit := map[bool]map[rune]time.Duration{
+				false: {'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour},
+				true:  {'H': time.Hour, 'M': time.Minute, 'S': time.Second},
+			}[inTime][c]
+			if unit == 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			total += time.Duration(n) * unit
+			num = ""
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return sign * total, nil
+}
+
+// unescapeICalText reverses the TEXT escaping of RFC 5545 3.3.11
+func unescapeICalText(value string) string {
+	replacer := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return replacer.Replace(value)
+}
+
+// escapeICalText applies the TEXT escaping of RFC 5545 3.3.11
+func escapeICalText(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return replacer.Replace(value)
+}
+
+// veventToEvent converts a VEVENT into an Event. The returned recurrence ID
+// is set for a VEVENT that overrides one occurrence of a recurring event.
+func veventToEvent(c icalComponent) (Event, *time.Time, error) {
+	var event Event
+	if prop, ok := c.get("X-INVALID"); ok {
+		return event, nil, fmt.Errorf("%s", prop.Value)
+	}
+
+	uid, ok := c.get("UID")
+	if !ok || uid.Value == "" {
+		return event, nil, fmt.Errorf("missing UID")
+	}
+	event.UID = uid.Value
+
+	dtstart, ok := c.get("DTSTART")
+	if !ok {
+		return event, nil, fmt.Errorf("missing DTSTART")
+	}
+	start, err := parseICalDateTime(dtstart.Value, dtstart.Params)
+	if err != nil {
+		return event, nil, fmt.Errorf("DTSTART: %v", err)
+	}
+	event.StartTime = start
+	event.EndTime = start
+	if isICalDate(dtstart) {
+		event.AllDay = true
+	} else if tzid := dtstart.Params["TZID"]; tzid != "" {
+		event.TimeZone = strings.TrimPrefix(tzid, "/")
+	}
+
+	if dtend, ok := c.get("DTEND"); ok {
+		end, err := parseICalDateTime(dtend.Value, dtend.Params)
+		if err != nil {
+			return event, nil, fmt.Errorf("DTEND: %v", err)
+		}
+		// DTEND of an all-day event is the exclusive day after its last date
+		if event.AllDay && end.After(start) {
+			end = end.AddDate(0, 0, -1)
+		}
+		event.EndTime = end
+	} else if duration, ok := c.get("DURATION"); ok {
+		d, err := parseICalDuration(duration.Value)
+		if err != nil {
+			return event, nil, fmt.Errorf("DURATION: %v", err)
+		}
+		event.EndTime = start.Add(d)
+	}
+	if event.EndTime.Before(event.StartTime) {
+		return event, nil, fmt.Errorf("DTEND is before DTSTART")
+	}
+
+	summary, _ := c.get("SUMMARY")
+	event.Title = unescapeICalText(summary.Value)
+	if event.Title == "" {
+		return event, nil, fmt.Errorf("missing SUMMARY")
+	}
+	description, _ := c.get("DESCRIPTION")
+	event.Description = unescapeICalText(description.Value)
+	location, _ := c.get("LOCATION")
+	event.Location = unescapeICalText(location.Value)
+
+	if rrule, ok := c.get("RRULE"); ok {
+		if _, err := parseRRule(rrule.Value); err != nil {
+			return event, nil, fmt.Errorf("RRULE: %v", err)
+		}
+		event.RRule = rrule.Value
+	}
+	for _, prop := range c.Props {
+		if prop.Name != "EXDATE" {
+			continue
+		}
+		for _, value := range strings.Split(prop.Value, ",") {
+			t, err := parseICalDateTime(value, prop.Params)
+			if err != nil {
+				return event, nil, fmt.Errorf("EXDATE: %v", err)
+			}
+			event.ExDates = append(event.ExDates, t)
+		}
+	}
+
+	if prop, ok := c.get("RECURRENCE-ID"); ok {
+		t, err := parseICalDateTime(prop.Value, prop.Params)
+		if err != nil {
+			return event, nil, fmt.Errorf("RECURRENCE-ID: %v", err)
+		}
+		if event.RRule != "" {
+			return event, nil, fmt.Errorf("an overridden occurrence cannot have an RRULE")
+		}
+		return event, &t, nil
+	}
+	return event, nil, nil
+}
+
+// importICS creates the user's events from an iCalendar file. Events whose
+// UID is already present are skipped; invalid events are rejected one by one.
+func importICS(userID int, r io.Reader, by principal) (importResult, error) {
+	components, err := parseVEvents(r)
+	if err != nil {
+		return importResult{}, err
+	}
+
+	result := importResult{Imported: []int{}, Skipped: []importRejection{}, Rejected: []importRejection{}}
+	reject := func(c icalComponent, uid string, err error) {
+		result.Rejected = append(result.Rejected, importRejection{Index: c.Index, Line: c.Line, UID: uid, Reason: err.Error()})
+	}
+	skip := func(c icalComponent, uid string, reason string) {
+		result.Skipped = append(result.Skipped, importRejection{Index: c.Index, Line: c.Line, UID: uid, Reason: reason})
+	}
+
+	// Series are imported before the occurrences that override them
+	type override struct {
+		component    icalComponent
+		event        Event
+		recurrenceID time.Time
+	}
+	var overrides []override
+
+	existing := make(map[string]bool)
+	for _, event := range store.List(userID) {
+		if event.RecurrenceID == nil {
+			existing[eventUID(event)] = true
+		}
+	}
+
+	for _, c := range components {
+		event, recurrenceID, err := veventToEvent(c)
+		if err != nil {
+			reject(c, event.UID, err)
+			continue
+		}
+		if recurrenceID != nil {
+			overrides = append(overrides, override{component: c, event: event, recurrenceID: *recurrenceID})
+			continue
+		}
+		if existing[event.UID] {
+			skip(c, event.UID, "duplicate UID")
+			continue
+		}
+		eventID := getNextEventID()
+		if err := createEvent(userID, eventID, event, by); err != nil {
+			reject(c, event.UID, err)
+			continue
+		}
+		existing[event.UID] = true
+		result.Imported = append(result.Imported, eventID)
+	}
+
+	for _, o := range overrides {
+		eventID, err := importOverride(userID, o.event, o.recurrenceID, by)
+		switch {
+		case err == errDuplicateOverride:
+			skip(o.component, o.event.UID, err.Error())
+		case err != nil:
+			reject(o.component, o.event.UID, err)
+		default:
+			result.Imported = append(result.Imported, eventID)
+		}
+	}
+	return result, nil
+}
+
+var errDuplicateOverride = fmt.Errorf("duplicate UID and RECURRENCE-ID")
+
+// importOverride detaches one occurrence of an imported series and replaces
+// it with the overriding event
+func importOverride(userID int, event Event, recurrenceID time.Time, by principal) (int, error) {
+	var series *Event
+	for _, existing := range store.List(userID) {
+		if existing.RecurrenceID != nil && existing.UID == event.UID && existing.RecurrenceID.Equal(recurrenceID) {
+			return 0, errDuplicateOverride
+		}
+		if existing.RRule != "" && eventUID(existing) == event.UID {
+			e := existing
+			series = &e
+		}
+	}
+	if series == nil {
+		return 0, fmt.Errorf("RECURRENCE-ID refers to an unknown recurring event")
+	}
+
+	if !series.isExcluded(recurrenceID) {
+		_, err := store.Update(userID, series.EventID, by, func(e *Event) error {
+			if !e.hasOccurrence(recurrenceID) {
+				return fmt.Errorf("RECURRENCE-ID is not an occurrence of the recurring event")
+			}
+			e.ExDates = append(e.ExDates, recurrenceID)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	event.SeriesID = series.EventID
+	event.RecurrenceID = &recurrenceID
+	eventID := getNextEventID()
+	if err := createEvent(userID, eventID, event, by); err != nil {
+		return 0, err
+	}
+	return eventID, nil
+}
+
+// icalWriter writes folded CRLF-terminated content lines
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+// timeLine writes a DATE-TIME property in the form matching the event kind:
+// a DATE for all-day events, a local time with TZID for zoned events, UTC
+// otherwise
+func (iw *icalWriter) timeLine(name string, event Event, times ...time.Time) {
+	values := make([]string, len(times))
+	switch {
+	case event.AllDay:
+		name += ";VALUE=DATE"
+		for i, t := range times {
+			values[i] = t.Format(icalDate)
+		}
+	case event.TimeZone != "":
+		name += ";TZID=" + event.TimeZone
+		loc := event.location()
+		for i, t := range times {
+			values[i] = t.In(loc).Format(icalDateTime)
+		}
+	default:
+		for i, t := range times {
+			values[i] = t.UTC().Format(icalDateTimeUTC)
+		}
+	}
+	iw.line(name, strings.Join(values, ","))
+}
+
+func (iw *icalWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	line := name + ":" + value
+	var b strings.Builder
+	for len(line) > icalLineLimit {
+		// Fold on a UTF-8 boundary; continuation lines start with a space
+		cut := icalLineLimit
+		if b.Len() > 0 {
+			cut--
+		}
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	_, iw.err = io.WriteString(iw.w, b.String())
+}
+
+// exportICS writes the user's events as a VCALENDAR feed
+func exportICS(w io.Writer, userID int) error {
+	events := store.List(userID)
+	sort.Slice(events, func(i, j int) bool { return events[i].EventID < events[j].EventID })
+	byID := make(map[int]Event, len(events))
+	for _, event := range events {
+		byID[event.EventID] = event
+	}
+	stamp := time.Now().UTC().Format(icalDateTimeUTC)
+
+	iw := &icalWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//L2//Calendar//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("X-WR-CALNAME", escapeICalText(fmt.Sprintf("User %d", userID)))
+	for _, event := range events {
+		uid := eventUID(event)
+		if series, ok := byID[event.SeriesID]; ok && event.RecurrenceID != nil {
+			uid = eventUID(series)
+		}
+		iw.vevent(event, uid, stamp)
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+// vevent writes an event as a VEVENT component
+func (iw *icalWriter) vevent(event Event, uid, stamp string) {
+	iw.line("BEGIN", "VEVENT")
+	iw.line("UID", uid)
+	iw.line("DTSTAMP", stamp)
+	iw.timeLine("DTSTART", event, event.StartTime)
+	if event.AllDay {
+		iw.timeLine("DTEND", event, event.EndTime.AddDate(0, 0, 1))
+	} else {
+		iw.timeLine("DTEND", event, event.EndTime)
+	}
+	iw.line("SUMMARY", escapeICalText(event.Title))
+	if event.Description != "" {
+		iw.line("DESCRIPTION", escapeICalText(event.Description))
+	}
+	if event.Location != "" {
+		iw.line("LOCATION", escapeICalText(event.Location))
+	}
+	if event.RRule != "" {
+		iw.line("RRULE", event.RRule)
+	}
+	if len(event.ExDates) > 0 {
+		iw.timeLine("EXDATE", event, event.ExDates...)
+	}
+	if event.RecurrenceID != nil {
+		iw.timeLine("RECURRENCE-ID", event, *event.RecurrenceID)
+	}
+	iw.line("END", "VEVENT")
+}
+
+// Handler for GET /export_ics
+func exportICSHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := requestUserID(r, r.URL.Query())
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="user-%d.ics"`, userID))
+	w.WriteHeader(http.StatusOK)
+	exportICS(w, userID)
+}
+
+// Handler for POST /import_ics; the calendar is sent either as the request
+// body or as the "file" field of a multipart form
+func importICSHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := requestUserID(r, r.URL.Query())
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxICSUpload)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "missing file parameter")
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	result, err := importICS(userID, body, callerOf(r))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey bounds the length of an Idempotency-Key header
+const maxIdempotencyKey = 255
+
+// idempotentResponse is the recorded response to a request with an
+// Idempotency-Key; done is closed once the response is complete
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	expires     time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache remembers the responses to requests with an
+// Idempotency-Key for ttl, so a client that retries after losing the
+// response gets the original one instead of a second write. Keys are scoped
+// to the caller. The cache lives in memory and starts empty after a restart.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+	nextSweep time.Time
+}
+
+// idempotency is the cache used by the idempotent handlers; it is set at
+// startup
+var idempotency = newIdempotencyCache(24 * time.Hour)
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, responses: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the response recorded for key, or registers a new one that
+// the caller has to complete with finish. fresh tells which of the two it is.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte, now time.Time) (resp *idempotentResponse, fresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for k, resp := range c.responses {
+			if now.After(resp.expires) {
+				delete(c.responses, k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+	if resp, ok := c.responses[key]; ok && !now.After(resp.expires) {
+		return resp, false
+	}
+	resp = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{}), expires: now.Add(c.ttl)}
+	c.responses[key] = resp
+	return resp, true
+}
+
+// finish completes a registered response; server errors and handlers that
+// wrote nothing are forgotten so that the client can retry them
+func (c *idempotencyCache) finish(key string, resp *idempotentResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp.status = rec.status
+	resp.header = rec.Header().Clone()
+	resp.body = rec.body.Bytes()
+	if (rec.status == 0 || rec.status >= 500) && c.responses[key] == resp {
+		delete(c.responses, key)
+	}
+	close(resp.done)
+}
+
+// responseRecorder passes a response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotent makes a handler honor the Idempotency-Key header: the first
+// request with a key is served and its response recorded, and retries with
+// the same key and body get that response again with an Idempotent-Replayed
+// header. Reusing a key for another request is an error, as is retrying
+// while the first request is still running.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			respondWithError(w, http.StatusBadRequest, "Idempotency-Key is longer than "+strconv.Itoa(maxIdempotencyKey)+" characters")
+			return
+		}
+
+		// The handler applies its own, possibly smaller, limit to the copy
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxICSUpload))
+		if err != nil {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type")} {
+			hash.Write([]byte(part))
+			hash.Write([]byte{0})
+		}
+		hash.Write(body)
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], hash.Sum(nil))
+
+		cacheKey := callerOf(r).key() + "\x00" + key
+
+		resp, fresh := idempotency.begin(cacheKey, fingerprint, time.Now())
+		if !fresh {
+			if resp.fingerprint != fingerprint {
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+				return
+			}
+			select {
+			case <-resp.done:
+			default:
+				respondWithError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+				return
+			}
+			// The replay keeps the ID of the request being served
+			for name, values := range resp.header {
+				if name != http.CanonicalHeaderKey(requestIDHeader) {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer idempotency.finish(cacheKey, resp, rec)
+		next(rec, r)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// intervalTree indexes the time spans of one user's events. It is a treap
+// ordered by (start, event ID) where every node also keeps the largest end of
+// its subtree, so overlap queries skip whole subtrees that end too early.
+// Nodes hold only the event ID; the events stay in the event map.
+type intervalTree struct {
+	root *intervalNode
+	size int
+}
+
+// intervalNode keys are whole seconds rounded outwards, so query results are
+// candidates that callers re-check for exact overlap
+type intervalNode struct {
+	start, end  int64
+	eventID     int
+	priority    uint64
+	maxEnd      int64
+	left, right *intervalNode
+}
+
+func floorSeconds(t time.Time) int64 {
+	return t.Unix()
+}
+
+func ceilSeconds(t time.Time) int64 {
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
+	}
+	return t.Unix()
+}
+
+// insert adds an event under its span
+func (t *intervalTree) insert(event Event) {
+	start, end := event.span()
+	node := &intervalNode{
+		start:    floorSeconds(start),
+		end:      ceilSeconds(end),
+		eventID:  event.EventID,
+		priority: rand.Uint64(),
+	}
+	node.maxEnd = node.end
+	t.root = insertNode(t.root, node)
+	t.size++
+}
+
+// remove deletes an event inserted with the same span
+func (t *intervalTree) remove(event Event) {
+	start, _ := event.span()
+	var removed bool
+	t.root, removed = removeNode(t.root, floorSeconds(start), event.EventID)
+	if removed {
+		t.size--
+	}
+}
+
+// query calls fn with the ID of every event whose span may intersect
+// [from, to), in start order; it is safe to call on a nil tree
+func (t *intervalTree) query(from, to time.Time, fn func(eventID int)) {
+	if t == nil {
+		return
+	}
+	queryNode(t.root, floorSeconds(from), ceilSeconds(to), fn)
+}
+
+func (n *intervalNode) less(start int64, eventID int) bool {
+	return n.start < start || (n.start == start && n.eventID < eventID)
+}
+
+func (n *intervalNode) update() {
+	n.maxEnd = n.end
+	if n.left != nil && n.left.maxEnd > n.maxEnd {
+		n.maxEnd = n.left.maxEnd
+	}
+	if n.right != nil && n.right.maxEnd > n.maxEnd {
+		n.maxEnd = n.right.maxEnd
+	}
+}
+
+func rotateRight(n *intervalNode) *intervalNode {
+	l := n.left
+	n.left = l.right
+	n.update()
+	l.right = n
+	l.update()
+	return l
+}
+
+func rotateLeft(n *intervalNode) *intervalNode {
+	r := n.right
+	n.right = r.left
+	n.update()
+	r.left = n
+	r.update()
+	return r
+}
+
+func insertNode(n, node *intervalNode) *intervalNode {
+	if n == nil {
+		return node
+	}
+	if node.less(n.start, n.eventID) {
+		n.left = insertNode(n.left, node)
+		if n.left.priority > n.priority {
+			return rotateRight(n)
+		}
+	} else {
+		n.right = insertNode(n.right, node)
+		if n.right.priority > n.priority {
+			return rotateLeft(n)
+		}
+	}
+	n.update()
+	return n
+}
+
+func removeNode(n *intervalNode, start int64, eventID int) (*intervalNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	var removed bool
+	switch {
+	case n.start == start && n.eventID == eventID:
+		return mergeNodes(n.left, n.right), true
+	case n.less(start, eventID):
+		n.right, removed = removeNode(n.right, start, eventID)
+	default:
+		n.left, removed = removeNode(n.left, start, eventID)
+	}
+	n.update()
+	return n, removed
+}
+
+func mergeNodes(a, b *intervalNode) *intervalNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		a.right = mergeNodes(a.right, b)
+		a.update()
+		return a
+	default:
+		b.left = mergeNodes(a, b.left)
+		b.update()
+		return b
+	}
+}
+
+func queryNode(n *intervalNode, from, to int64, fn func(eventID int)) {
+	if n == nil || n.maxEnd < from {
+		return
+	}
+	queryNode(n.left, from, to, fn)
+	if n.start >= to {
+		// Everything to the right starts even later
+		return
+	}
+	if n.end >= from {
+		fn(n.eventID)
+	}
+	queryNode(n.right, from, to, fn)
+}
+
+// overlaps reports whether the span [start, end] intersects [from, to). A
+// zero-length span matches when it lies inside the window.
+func overlaps(start, end, from, to time.Time) bool {
+	return start.Before(to) && (!start.Before(from) || end.After(from))
+}
+
+// span returns the absolute time range an event occupies; an all-day event
+// covers its dates in UTC up to the end of its last date
+func (e *Event) span() (time.Time, time.Time) {
+	if e.AllDay {
+		return e.StartTime, e.EndTime.AddDate(0, 0, 1)
+	}
+	if e.EndTime.Before(e.StartTime) {
+		return e.StartTime, e.StartTime
+	}
+	return e.StartTime, e.EndTime
+}
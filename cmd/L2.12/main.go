@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
-
-	"log"
-	"sync"
 )
 
 // Event represents a calendar event
@@ -21,6 +26,37 @@ type Event struct {
 	StartTime   time.Time `json:"start_time"`
 	EndTime     time.Time `json:"end_time"`
 	Location    string    `json:"location"`
+	// CalendarID is the calendar of the owner the event belongs to; zero is
+	// the owner's primary calendar
+	CalendarID int `json:"calendar_id,omitempty"`
+	// AllDay events span whole dates; their times are midnight UTC of the
+	// first and last date and they have no time zone
+	AllDay bool `json:"all_day,omitempty"`
+	// TimeZone is the IANA zone the event was scheduled in
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// RRule is an RFC 5545 recurrence rule, e.g. "FREQ=WEEKLY;BYDAY=MO"
+	RRule   string      `json:"rrule,omitempty"`
+	ExDates []time.Time `json:"exdates,omitempty"`
+	// RecurrenceID is the original start of an occurrence of a recurring event
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+	// SeriesID links an occurrence edited on its own to its recurring event
+	SeriesID int `json:"series_id,omitempty"`
+	// UID is the iCalendar identifier of an imported event
+	UID string `json:"uid,omitempty"`
+	// Version is incremented by the store on every change and is sent as
+	// the ETag of the event
+	Version int `json:"version"`
+	// Reminders are lead times in minutes before the start of every
+	// occurrence at which the user's webhook is notified
+	Reminders []int `json:"reminders,omitempty"`
+	// Tags are lower-case labels used to filter and report on events
+	Tags []string `json:"tags,omitempty"`
+	// Attendees are the users the owner of the event invited to it; each
+	// of them sees the event in their own calendar
+	Attendees []Attendee `json:"attendees,omitempty"`
+	// DeletedAt is set on events in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // ToJSON serializes Event to JSON
@@ -28,19 +64,8 @@ func (e *Event) ToJSON() ([]byte, error) {
 	return json.Marshal(e)
 }
 
-var (
-	eventsStore = make(map[int]map[int]Event)
-	mu          = &sync.RWMutex{}
-	eventIDGen  = 1 // Simple incrementing ID generator
-)
-
-// Middleware for logging requests
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Request: %s %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
-	})
-}
+// store is the storage backend selected at startup
+var store EventStore = newMemoryStore()
 
 // Helper function to parse int parameter
 func parseInt(params url.Values, key string) (int, error) {
@@ -61,64 +86,130 @@ func parseDate(params url.Values, key string) (time.Time, error) {
 	if value == "" {
 		return time.Time{}, fmt.Errorf("missing %s parameter", key)
 	}
-	t, err := time.Parse("2006-01-02", value)
+	t, err := parseTimeValue(value)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("invalid %s parameter: %s", key, err)
 	}
 	return t, nil
 }
 
+// Helper function to parse an RFC 3339 timestamp or a date value
+func parseTimeValue(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Helper function to parse a comma-separated list of dates
+func parseDateList(params url.Values, key string) ([]time.Time, error) {
+	value := params.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+	var dates []time.Time
+	for _, item := range strings.Split(value, ",") {
+		t, err := parseTimeValue(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter: %s", key, err)
+		}
+		dates = append(dates, t)
+	}
+	return dates, nil
+}
+
+// Helper function to read the recurrence scope parameter
+func scopeParam(params url.Values) string {
+	if scope := params.Get("scope"); scope != "" {
+		return scope
+	}
+	return scopeAll
+}
+
 // Helper function to get the next unique event ID
 func getNextEventID() int {
-	mu.Lock()
-	defer mu.Unlock()
-	eventId := eventIDGen
-	eventIDGen++
-	return eventId
+	return store.NextEventID()
 }
 
-// Helper function to get events for a date range
+// Helper function to get events for a date range, sorted by start time,
+// including the events other users invited the user to; all-day events are
+// matched by their date in the time zone of startTime
 func getEventsForRange(userID int, startTime, endTime time.Time) []Event {
-	var events []Event
-	mu.RLock()
-	defer mu.RUnlock()
-	if eventsStore[userID] == nil {
-		return events
-	}
-	for _, event := range eventsStore[userID] {
-		if event.StartTime.After(startTime) && event.StartTime.Before(endTime) {
+	from := startTime.Add(-allDayWindowSlack)
+	to := endTime.Add(allDayWindowSlack)
+	candidates := store.Range(userID, from, to)
+	for _, series := range store.Series(userID) {
+		candidates = append(candidates, expandOccurrences(series, from, to)...)
+	}
+	for _, event := range invitedEvents(userID) {
+		if event.RRule != "" {
+			candidates = append(candidates, expandOccurrences(event, from, to)...)
+		} else {
+			candidates = append(candidates, event)
+		}
+	}
+
+	events := candidates[:0]
+	for _, event := range candidates {
+		if event.inWindow(startTime, endTime) {
 			events = append(events, event)
 		}
 	}
+	sortEvents(events)
 	return events
 }
 
 // Business logic functions
-func createEvent(userID, eventID int, event Event) error {
-	mu.Lock()
-	defer mu.Unlock()
-	if eventsStore[userID] == nil {
-		eventsStore[userID] = make(map[int]Event)
+func createEvent(userID, eventID int, event Event, by principal) error {
+	event.UserID = userID
+	event.EventID = eventID
+	if err := normalizeRRule(&event); err != nil {
+		return err
 	}
-	if _, exists := eventsStore[userID][eventID]; exists {
-		return fmt.Errorf("event ID %d already exists for user %d", eventID, userID)
+	if err := checkFieldSizes(event); err != nil {
+		return err
 	}
-	eventsStore[userID][eventID] = event
-	return nil
+	return store.Create(event, by)
 }
 
-func updateEvent(userID, eventID int, updates map[string]string) error {
-	mu.Lock()
-	defer mu.Unlock()
-	if eventsStore[userID] == nil {
-		return fmt.Errorf("user %d has no events", userID)
+// normalizeRRule validates the recurrence rule of an event and rewrites it in
+// canonical form
+func normalizeRRule(event *Event) error {
+	if event.RRule == "" {
+		return nil
 	}
-	event, exists := eventsStore[userID][eventID]
-	if !exists {
-		return fmt.Errorf("event ID %d not found for user %d", eventID, userID)
+	rule, err := parseRRule(event.RRule)
+	if err != nil {
+		return invalidf("%v", err)
 	}
-	// Apply updates to the event
+	event.RRule = rule.String()
+	return nil
+}
+
+func updateEvent(userID, eventID int, updates map[string]string, by principal, check eventCheck) error {
+	_, err := store.Update(userID, eventID, by, func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		return applyUpdates(event, updates)
+	})
+	return err
+}
+
+// updateFields lists the fields that updates can change, in the order the
+// form endpoint reads them
+var updateFields = []string{"title", "description", "location", "start_time", "end_time", "all_day", "time_zone", "rrule", "exdates", "reminders", "tags", "attendees", "calendar_id"}
+
+// applyUpdates applies form-style field updates to an event. An empty value
+// clears an optional field; the times are re-validated whenever one of
+// start_time, end_time, all_day or time_zone changes. Rescheduling an event
+// asks its attendees to answer again.
+func applyUpdates(event *Event, updates map[string]string) error {
+	old := *event
 	if title, ok := updates["title"]; ok {
+		if title == "" {
+			return invalidf("title cannot be empty")
+		}
 		event.Title = title
 	}
 	if description, ok := updates["description"]; ok {
@@ -127,33 +218,144 @@ func updateEvent(userID, eventID int, updates map[string]string) error {
 	if location, ok := updates["location"]; ok {
 		event.Location = location
 	}
-	// Update other fields as needed
-	eventsStore[userID][eventID] = event
-	return nil
+	if err := applyTimeUpdates(event, updates); err != nil {
+		return err
+	}
+	if rrule, ok := updates["rrule"]; ok {
+		if rrule == "" {
+			event.RRule = ""
+			event.ExDates = nil
+		} else {
+			if event.RecurrenceID != nil {
+				return invalidf("cannot make a single occurrence recurring")
+			}
+			rule, err := parseRRule(rrule)
+			if err != nil {
+				return invalidf("%v", err)
+			}
+			event.RRule = rule.String()
+		}
+	}
+	if exdates, ok := updates["exdates"]; ok {
+		event.ExDates = nil
+		for _, value := range strings.Split(exdates, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			t, err := parseTimeValue(value)
+			if err != nil {
+				return invalidf("invalid exdates: %s", err)
+			}
+			event.ExDates = append(event.ExDates, t)
+		}
+		if len(event.ExDates) > 0 && event.RRule == "" {
+			return invalidf("exdates need a recurring event")
+		}
+	}
+	if reminders, ok := updates["reminders"]; ok {
+		minutes, err := parseReminders(reminders)
+		if err != nil {
+			return err
+		}
+		event.Reminders = minutes
+	}
+	if value, ok := updates["tags"]; ok {
+		tags, err := parseTags(value)
+		if err != nil {
+			return err
+		}
+		event.Tags = tags
+	}
+	if value, ok := updates["calendar_id"]; ok {
+		calendarID, err := parseCalendarID(value)
+		if err != nil {
+			return err
+		}
+		event.CalendarID = calendarID
+	}
+	if value, ok := updates["attendees"]; ok {
+		userIDs, err := parseAttendees(value)
+		if err != nil {
+			return err
+		}
+		if err := event.setAttendees(userIDs); err != nil {
+			return err
+		}
+	}
+	if event.rescheduled(old) {
+		event.resetRSVPs()
+	}
+	return checkFieldSizes(*event)
 }
 
-func deleteEvent(userID, eventID int) error {
-	mu.Lock()
-	defer mu.Unlock()
-	if eventsStore[userID] == nil {
-		return fmt.Errorf("user %d has no events", userID)
+// applyTimeUpdates moves an event; fields that are not updated keep their
+// current value. An empty time_zone means UTC.
+func applyTimeUpdates(event *Event, updates map[string]string) error {
+	startValue, hasStart := updates["start_time"]
+	endValue, hasEnd := updates["end_time"]
+	timeZone, hasZone := updates["time_zone"]
+	allDayValue, hasAllDay := updates["all_day"]
+	if !hasStart && !hasEnd && !hasZone && !hasAllDay {
+		return nil
+	}
+
+	layout := time.RFC3339
+	if event.AllDay {
+		layout = "2006-01-02"
+	}
+	if !hasStart {
+		startValue = event.StartTime.In(event.location()).Format(layout)
+	}
+	if !hasEnd {
+		endValue = event.EndTime.In(event.location()).Format(layout)
+	}
+	if !hasZone {
+		timeZone = event.TimeZone
+	}
+	allDay := event.AllDay && !hasAllDay
+	if hasAllDay {
+		switch allDayValue {
+		case "true":
+			allDay = true
+		case "false", "":
+		default:
+			return invalidf("invalid all_day: want true or false")
+		}
 	}
-	_, exists := eventsStore[userID][eventID]
-	if !exists {
-		return fmt.Errorf("event ID %d not found for user %d", eventID, userID)
+
+	if err := assignEventTimes(event, startValue, endValue, timeZone, allDay); err != nil {
+		return err
+	}
+	if hasAllDay && !allDay && event.AllDay {
+		return invalidf("an all-day event needs start_time and end_time timestamps to become a timed event")
 	}
-	delete(eventsStore[userID], eventID)
 	return nil
 }
 
+// moveEvent applies updates to an event and moves it to the calendar of
+// toUserID
+func moveEvent(userID, eventID, toUserID int, updates map[string]string, by principal, check eventCheck) (Event, error) {
+	return store.Move(userID, eventID, toUserID, by, func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		return applyUpdates(event, updates)
+	})
+}
+
+// deleteEvent moves an event to the trash
+func deleteEvent(userID, eventID int, by principal, check eventCheck) error {
+	return store.Delete(userID, eventID, by, check)
+}
+
 // Handler for POST /create_event
 func createEventHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	params := r.Form
 
-	userID, err := parseInt(params, "user_id")
+	userID, err := requestUserID(r, params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithStoreError(w, err)
 		return
 	}
 
@@ -163,13 +365,40 @@ func createEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	startTime, err := parseDate(params, "start_time")
+	if params.Get("start_time") == "" {
+		respondWithError(w, http.StatusBadRequest, "missing start_time parameter")
+		return
+	}
+	if params.Get("end_time") == "" {
+		respondWithError(w, http.StatusBadRequest, "missing end_time parameter")
+		return
+	}
+
+	exDates, err := parseDateList(params, "exdate")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reminders, err := parseReminders(params.Get("reminders"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tags, err := parseTags(params.Get("tags"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	attendees, err := parseAttendees(params.Get("attendees"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	endTime, err := parseDate(params, "end_time")
+	calendarID, err := parseCalendarID(params.Get("calendar_id"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
@@ -178,16 +407,32 @@ func createEventHandler(w http.ResponseWriter, r *http.Request) {
 	eventID := getNextEventID()
 
 	event := Event{
-		UserID:    userID,
-		EventID:   eventID,
-		Title:     title,
-		StartTime: startTime,
-		EndTime:   endTime,
+		UserID:     userID,
+		EventID:    eventID,
+		CalendarID: calendarID,
+		Title:      title,
+		RRule:      params.Get("rrule"),
+		ExDates:    exDates,
+		Reminders:  reminders,
+		Tags:       tags,
+	}
+	if err := event.setAttendees(attendees); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = setEventTimes(&event, params.Get("start_time"), params.Get("end_time"), params.Get("time_zone"), params.Get("all_day") == "true")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	err = createEvent(userID, eventID, event)
+	if strictMode(params, userID) {
+		err = createEventExclusive(userID, eventID, event, callerOf(r))
+	} else {
+		err = createEvent(userID, eventID, event, callerOf(r))
+	}
 	if err != nil {
-		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+		respondWithLegacyError(w, err)
 		return
 	}
 
@@ -199,9 +444,9 @@ func updateEventHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	params := r.Form
 
-	userID, err := parseInt(params, "user_id")
+	userID, err := requestUserID(r, params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithStoreError(w, err)
 		return
 	}
 
@@ -211,25 +456,70 @@ func updateEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A field that is present but empty is cleared
 	updates := make(map[string]string)
-	if title := params.Get("title"); title != "" {
-		updates["title"] = title
-	}
-	if description := params.Get("description"); description != "" {
-		updates["description"] = description
+	for _, field := range updateFields {
+		if values, ok := params[field]; ok {
+			updates[field] = values[0]
+		}
 	}
-	if location := params.Get("location"); location != "" {
-		updates["location"] = location
+
+	toUserID := userID
+	if params.Get("to_user_id") != "" {
+		if toUserID, err = parseInt(params, "to_user_id"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := authorizeUser(r, toUserID); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
 	}
 
-	if len(updates) == 0 {
+	if len(updates) == 0 && toUserID == userID {
 		respondWithError(w, http.StatusBadRequest, "no updates provided")
 		return
 	}
 
-	err = updateEvent(userID, eventID, updates)
+	if toUserID != userID {
+		if params.Get("occurrence") != "" {
+			respondWithError(w, http.StatusBadRequest, "a single occurrence cannot be moved to another user")
+			return
+		}
+		move := moveEvent
+		if strictMode(params, toUserID) {
+			move = moveEventExclusive
+		}
+		if _, err := move(userID, eventID, toUserID, updates, callerOf(r), ifMatch(r)); err != nil {
+			respondWithLegacyError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "Event updated"})
+		return
+	}
+
+	if params.Get("occurrence") != "" {
+		occurrence, err := parseDate(params, "occurrence")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = updateOccurrence(userID, eventID, occurrence, scopeParam(params), updates, strictMode(params, userID), callerOf(r), ifMatch(r))
+		if err != nil {
+			respondWithLegacyError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "Event updated"})
+		return
+	}
+
+	if strictMode(params, userID) {
+		err = updateEventExclusive(userID, eventID, updates, callerOf(r), ifMatch(r))
+	} else {
+		err = updateEvent(userID, eventID, updates, callerOf(r), ifMatch(r))
+	}
 	if err != nil {
-		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+		respondWithLegacyError(w, err)
 		return
 	}
 
@@ -241,9 +531,9 @@ func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	params := r.Form
 
-	userID, err := parseInt(params, "user_id")
+	userID, err := requestUserID(r, params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithStoreError(w, err)
 		return
 	}
 
@@ -253,9 +543,24 @@ func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = deleteEvent(userID, eventID)
+	if params.Get("occurrence") != "" {
+		occurrence, err := parseDate(params, "occurrence")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = deleteOccurrence(userID, eventID, occurrence, scopeParam(params), callerOf(r), ifMatch(r))
+		if err != nil {
+			respondWithLegacyError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "Event deleted"})
+		return
+	}
+
+	err = deleteEvent(userID, eventID, callerOf(r), ifMatch(r))
 	if err != nil {
-		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+		respondWithLegacyError(w, err)
 		return
 	}
 
@@ -266,74 +571,121 @@ func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
 func eventsForDayHandler(w http.ResponseWriter, r *http.Request) {
 	queryParams := r.URL.Query()
 
-	userID, err := parseInt(queryParams, "user_id")
+	userID, err := requestUserID(r, queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	loc, err := requestLocation(queryParams, userID)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	date, err := parseDate(queryParams, "date")
+	date, err := parseDay(queryParams, "date", loc)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
 	startTime := date
 	endTime := date.AddDate(0, 0, 1)
 
-	events := getEventsForRange(userID, startTime, endTime)
+	events, err := getSelectedEventsForRange(userID, queryParams.Get("calendars"), startTime, endTime)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": events})
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": filter.filterEvents(events)})
 }
 
 // Handler for GET /events_for_week
 func eventsForWeekHandler(w http.ResponseWriter, r *http.Request) {
 	queryParams := r.URL.Query()
 
-	userID, err := parseInt(queryParams, "user_id")
+	userID, err := requestUserID(r, queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	loc, err := requestLocation(queryParams, userID)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	date, err := parseDate(queryParams, "date")
+	date, err := parseDay(queryParams, "date", loc)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
 	startTime := date
 	endTime := date.AddDate(0, 0, 7)
 
-	events := getEventsForRange(userID, startTime, endTime)
+	events, err := getSelectedEventsForRange(userID, queryParams.Get("calendars"), startTime, endTime)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": events})
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": filter.filterEvents(events)})
 }
 
 // Handler for GET /events_for_month
 func eventsForMonthHandler(w http.ResponseWriter, r *http.Request) {
 	queryParams := r.URL.Query()
 
-	userID, err := parseInt(queryParams, "user_id")
+	userID, err := requestUserID(r, queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	loc, err := requestLocation(queryParams, userID)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	date, err := parseDate(queryParams, "date")
+	date, err := parseDay(queryParams, "date", loc)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
 	startTime := date
 	// Calculate end of month
-	nextMonth := date.AddDate(0, 1, 0)
-	endTime := time.Date(nextMonth.Year(), nextMonth.Month(), 1, 0, 0, 0, 0, date.Location())
+	endTime := time.Date(date.Year(), date.Month()+1, 1, 0, 0, 0, 0, loc)
 
-	events := getEventsForRange(userID, startTime, endTime)
+	events, err := getSelectedEventsForRange(userID, queryParams.Get("calendars"), startTime, endTime)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": events})
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": filter.filterEvents(events)})
 }
 
 // respondWithJSON sends a JSON response
@@ -345,24 +697,211 @@ func respondWithJSON(w http.ResponseWriter, code int, data interface{}) {
 
 // respondWithError sends an error JSON response
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+	respondWithJSON(w, code, withRequestID(w, map[string]interface{}{"error": message}))
+}
+
+// respondWithLegacyError keeps 503 for failures of the form endpoints but
+// reports conflicts, invalid input, forbidden writes and failed preconditions
+// with their own status
+func respondWithLegacyError(w http.ResponseWriter, err error) {
+	switch {
+	case respondWithConflict(w, err):
+	case errors.Is(err, errInvalid), errors.Is(err, errForbidden), errors.Is(err, errPrecondition):
+		respondWithError(w, errorStatus(err), err.Error())
+	default:
+		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+	}
+}
+
+// openStore creates the storage backend selected by name
+func openStore(kind, dataDir string, snapshotEvery int, snapshotInterval time.Duration, shards int) (EventStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "sharded":
+		if shards < 1 {
+			return nil, fmt.Errorf("invalid shard count %d", shards)
+		}
+		return newShardedStore(shards), nil
+	case "file":
+		return newFileStore(dataDir, snapshotEvery, snapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown storage %q (want memory, sharded or file)", kind)
+	}
 }
 
 func main() {
-	// Configure port from config (for simplicity, hardcoding here)
-	port := ":8080"
+	storage := flag.String("storage", "memory", "event storage: memory, sharded (in memory, locked per group of users) or file; only file keeps the events across restarts")
+	shards := flag.Int("shards", 16, "number of shards of the sharded storage")
+	dataDir := flag.String("data-dir", "data", "directory for the file storage; needs -storage file")
+	snapshotEvery := flag.Int("snapshot-every", 1000, "take a snapshot after this many logged changes")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "period between snapshots (0 disables)")
+	reminderInterval := flag.Duration("reminder-interval", 5*time.Second, "period between reminder scheduler runs")
+	reminderBackoff := flag.Duration("reminder-backoff", 10*time.Second, "delay before the first webhook retry; doubles with every attempt")
+	reminderAttempts := flag.Int("reminder-attempts", 8, "webhook attempts before a reminder is given up")
+	flag.BoolVar(&webhookAllowPrivate, "webhook-allow-private", false, "let webhooks reach loopback, link-local and private network addresses")
+	trashRetention := flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted events stay in the trash (0 keeps them forever)")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "period between trash purges")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour, "how long responses to requests with an Idempotency-Key are replayed")
+	secret := flag.String("auth-secret", "", "key that signs bearer tokens")
+	port := flag.Int("port", 8080, "TCP port to listen on")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "time allowed to read request headers")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "time allowed to read a whole request (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 60*time.Second, "time allowed to write a response (0 disables); change streams set their own")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long an idle keep-alive connection stays open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long a shutdown waits for in-flight requests")
+	flag.Int64Var(&maxJSONBody, "max-body-size", maxJSONBody, "largest accepted JSON request body in bytes")
+	userRate := flag.Float64("rate-limit", 10, "requests per second allowed per authenticated caller (0 disables)")
+	userBurst := flag.Int("rate-burst", 20, "requests a caller may make at once before -rate-limit applies")
+	ipRate := flag.Float64("ip-rate-limit", 20, "requests per second allowed per client IP (0 disables)")
+	ipBurst := flag.Int("ip-rate-burst", 40, "requests a client IP may make at once before -ip-rate-limit applies")
+	flag.StringVar(&freeBusyPolicy, "freebusy-policy", freeBusyPolicy, "whose busy time /v1/freebusy and /v1/slots show: private (users the caller acts for and calendars shared with the caller) or all (any user's)")
+	flag.IntVar(&maxEventsPerUser, "max-events-per-user", maxEventsPerUser, "events a user may store (0 is unlimited)")
+	flag.IntVar(&maxTitleLength, "max-title-length", maxTitleLength, "longest event title in characters (0 is unlimited)")
+	flag.IntVar(&maxDescriptionLength, "max-description-length", maxDescriptionLength, "longest event description in characters (0 is unlimited)")
+	flag.IntVar(&maxLocationLength, "max-location-length", maxLocationLength, "longest event location in characters (0 is unlimited)")
+	flag.TextVar(logLevel, "log-level", logLevel, "minimum level of the JSON log: debug, info, warn or error")
+	configPath := flag.String("config", os.Getenv("CALENDAR_CONFIG"), "JSON config file keyed by flag name (default $CALENDAR_CONFIG)")
+	printAdminToken := flag.Bool("print-admin-token", false, "print an admin token for the auth secret and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags take precedence over %s<FLAG> environment variables (-read-timeout is %s),\nwhich take precedence over the config file.\n", envPrefix, envName("read-timeout"))
+	}
+	flag.Parse()
+	slog.SetDefault(newLogger())
+	if err := loadConfig(flag.CommandLine, *configPath); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	if *port < 0 || *port > 65535 {
+		fatal("invalid configuration: port out of range", "port", *port)
+	}
+	if maxJSONBody <= 0 {
+		fatal("invalid configuration: max-body-size must be positive", "max_body_size", maxJSONBody)
+	}
+	if freeBusyPolicy != freeBusyAll && freeBusyPolicy != freeBusyPrivate {
+		fatal("invalid configuration: freebusy-policy must be all or private", "freebusy_policy", freeBusyPolicy)
+	}
+	// The memory and sharded storages write nothing to disk; a data directory
+	// given with them would suggest the events survive a restart
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "data-dir" && *storage != "file" {
+			fatal("invalid configuration: data-dir needs storage file, the others keep the events in memory only", "storage", *storage)
+		}
+	})
+
+	authSecret = []byte(*secret)
+	if *printAdminToken {
+		if *secret == "" {
+			fatal("-print-admin-token needs -auth-secret or CALENDAR_AUTH_SECRET")
+		}
+		token, err := adminToken()
+		if err != nil {
+			fatal("failed to sign admin token", "err", err)
+		}
+		fmt.Println(token)
+		return
+	}
+	if *secret == "" {
+		// Without a configured secret tokens only live as long as the process
+		generated, err := generateSecret()
+		if err != nil {
+			fatal("failed to generate auth secret", "err", err)
+		}
+		authSecret = generated
+		token, err := adminToken()
+		if err != nil {
+			fatal("failed to sign admin token", "err", err)
+		}
+		// The token goes to the terminal only, never into the log
+		slog.Warn("no auth secret configured; generated one for this run and printed an admin token to stderr")
+		fmt.Fprintf(os.Stderr, "admin token for this run: %s\n", token)
+	}
+
+	s, err := openStore(*storage, *dataDir, *snapshotEvery, *snapshotInterval, *shards)
+	if err != nil {
+		fatal("failed to open storage", "storage", *storage, "err", err)
+	}
+	store = s
+
+	idempotency = newIdempotencyCache(*idempotencyTTL)
+
+	reminders := newReminderScheduler(*reminderInterval, *reminderBackoff, *reminderAttempts)
+	reminders.Start()
+
+	var purger *trashPurger
+	if *trashRetention > 0 {
+		purger = newTrashPurger(*trashRetention, *purgeInterval)
+		purger.Start()
+	}
 
 	// Register handlers with middleware
-	http.HandleFunc("/create_event", createEventHandler)
-	http.HandleFunc("/update_event", updateEventHandler)
-	http.HandleFunc("/delete_event", deleteEventHandler)
-	http.HandleFunc("/events_for_day", eventsForDayHandler)
-	http.HandleFunc("/events_for_week", eventsForWeekHandler)
-	http.HandleFunc("/events_for_month", eventsForMonthHandler)
-
-	// Apply logging middleware
-	http.Handle("/", loggingMiddleware(http.DefaultServeMux))
-
-	log.Printf("Starting server on port %s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	mux := http.DefaultServeMux
+	handleMethod(mux, http.MethodPost, "/create_event", idempotent(createEventHandler))
+	handleMethod(mux, http.MethodPost, "/update_event", updateEventHandler)
+	handleMethod(mux, http.MethodPost, "/delete_event", deleteEventHandler)
+	handleMethod(mux, http.MethodPost, "/respond_event", respondEventHandler)
+	handleMethod(mux, http.MethodPost, "/restore_event", restoreEventHandler)
+	handleMethod(mux, http.MethodGet, "/events_for_day", eventsForDayHandler)
+	handleMethod(mux, http.MethodGet, "/events_for_week", eventsForWeekHandler)
+	handleMethod(mux, http.MethodGet, "/events_for_month", eventsForMonthHandler)
+	handleMethod(mux, http.MethodGet, "/export_ics", exportICSHandler)
+	handleMethod(mux, http.MethodPost, "/import_ics", idempotent(importICSHandler))
+	handleMethod(mux, http.MethodGet, "/metrics", metricsHandler)
+	registerAPIRoutes(mux)
+	registerDAVRoutes(mux)
+
+	// Clients are limited by IP before authentication, so that floods of bad
+	// tokens are throttled too, and by caller after it
+	var handler http.Handler = rateLimited(newRateLimiter(*userRate, *userBurst), callerKey, mux)
+	handler = rateLimited(newRateLimiter(*ipRate, *ipBurst), clientIP, authMiddleware(handler))
+
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(*port),
+		Handler:           loggingMiddleware(mux, handler),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	// Change streams never finish on their own and would hold up the drain
+	srv.RegisterOnShutdown(store.Feed().disconnect)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	failed := false
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "port", *port)
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		slog.Error("server failed", "err", err)
+		failed = true
+	case <-ctx.Done():
+		stop()
+		slog.Info("shutting down; draining in-flight requests", "timeout", shutdownTimeout.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown did not drain", "err", err)
+			failed = true
+		}
+		cancel()
+	}
+
+	// Background jobs write to the store, so they stop before it is flushed
+	reminders.Stop()
+	if purger != nil {
+		purger.Stop()
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("failed to close storage", "storage", *storage, "err", err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods are the methods reported under their own name; anything
+// else is "other", so clients cannot blow up the number of series
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+	methodPropfind: true, methodReport: true,
+}
+
+type routeKey struct {
+	method, route string
+}
+
+type requestKey struct {
+	routeKey
+	code int
+}
+
+// histogram counts observations per bucket; counts are not cumulative
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	if i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// requestMetrics aggregates the served requests by method, route and status
+type requestMetrics struct {
+	mu        sync.Mutex
+	inFlight  int
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+}
+
+// httpMetrics collects the requests seen by loggingMiddleware
+var httpMetrics = newRequestMetrics()
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{requests: make(map[requestKey]uint64), durations: make(map[routeKey]*histogram)}
+}
+
+// begin counts a request in flight until end is called
+func (m *requestMetrics) begin() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+}
+
+func (m *requestMetrics) end(method, route string, code int, elapsed time.Duration) {
+	if !metricMethods[method] {
+		method = "other"
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	key := routeKey{method, route}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.requests[requestKey{key, code}]++
+	h := m.durations[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[key] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// labelValue escapes a value for the Prometheus text format
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsWriter writes the Prometheus text exposition format
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w metricsWriter) gauge(name, help string, value int) {
+	w.header(name, "gauge", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// write exposes the request metrics, sorted so that scrapes are stable
+func (m *requestMetrics) write(w metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	w.header("calendar_http_requests_total", "counter", "HTTP requests served, by method, route pattern and status code.")
+	for _, key := range requests {
+		fmt.Fprintf(w, "calendar_http_requests_total{method=\"%s\",route=\"%s\",code=\"%d\"} %d\n",
+			key.method, labelValue.Replace(key.route), key.code, m.requests[key])
+	}
+
+	routes := make([]routeKey, 0, len(m.durations))
+	for key := range m.durations {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	const duration = "calendar_http_request_duration_seconds"
+	w.header(duration, "histogram", "Time to serve HTTP requests, by method and route pattern.")
+	for _, key := range routes {
+		h := m.durations[key]
+		labels := fmt.Sprintf("method=\"%s\",route=\"%s\"", key.method, labelValue.Replace(key.route))
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", duration, labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", duration, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", duration, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", duration, labels, h.count)
+	}
+
+	w.gauge("calendar_http_requests_in_flight", "HTTP requests being served.", m.inFlight)
+}
+
+// writeStoreMetrics exposes the size of the store
+func writeStoreMetrics(w metricsWriter, stats storeStats) {
+	w.gauge("calendar_store_events", "Stored events, recurring or not.", stats.Events)
+	w.gauge("calendar_store_recurring_events", "Stored recurring events.", stats.Series)
+	w.gauge("calendar_store_users", "Users with events or invitations.", stats.Users)
+	w.gauge("calendar_store_calendars", "Named calendars besides the primary ones.", stats.Calendars)
+	w.gauge("calendar_store_trashed_events", "Deleted events waiting in the trash.", stats.Trashed)
+	w.gauge("calendar_store_audit_entries", "Entries of the audit log.", stats.AuditEntries)
+	w.gauge("calendar_store_pending_reminders", "Reminder deliveries not yet delivered or given up.", stats.PendingDeliveries)
+	w.gauge("calendar_store_wal_records", "Records logged since the last snapshot (file storage only).", stats.WALRecords)
+	w.gauge("calendar_change_subscribers", "Open change streams.", stats.Subscribers)
+}
+
+// Handler for GET /metrics; the metrics in the Prometheus text format, for
+// admins only
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !callerOf(r).Admin {
+		respondWithError(w, http.StatusForbidden, "only admins can read metrics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{bufio.NewWriter(w)}
+	httpMetrics.write(mw)
+	writeStoreMetrics(mw, store.Stats())
+	mw.Flush()
+}
@@ -0,0 +1,40 @@
+package main
+
+import "unicode/utf8"
+
+// Quotas, set at startup; zero means unlimited. Field lengths count
+// characters.
+var (
+	maxEventsPerUser     = 10000
+	maxTitleLength       = 200
+	maxDescriptionLength = 8000
+	maxLocationLength    = 500
+)
+
+// checkFieldSizes rejects an event whose text fields are longer than the
+// quotas allow
+func checkFieldSizes(event Event) error {
+	for _, field := range []struct {
+		name  string
+		value string
+		limit int
+	}{
+		{"title", event.Title, maxTitleLength},
+		{"description", event.Description, maxDescriptionLength},
+		{"location", event.Location, maxLocationLength},
+	} {
+		if field.limit > 0 && utf8.RuneCountInString(field.value) > field.limit {
+			return invalidf("%s is too long: at most %d characters", field.name, field.limit)
+		}
+	}
+	return nil
+}
+
+// checkQuotaLocked fails unless the user has room for added more events;
+// the caller must hold the lock
+func (s *memoryStore) checkQuotaLocked(userID, added int) error {
+	if maxEventsPerUser > 0 && len(s.events[userID])+added > maxEventsPerUser {
+		return forbiddenf("quota exceeded: user %d cannot have more than %d events", userID, maxEventsPerUser)
+	}
+	return nil
+}
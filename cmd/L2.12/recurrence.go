@@ -0,0 +1,638 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies supported from RFC 5545
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+	freqYearly  = "YEARLY"
+)
+
+// Scopes for editing or deleting a single occurrence of a recurring event
+const (
+	scopeAll       = "all"
+	scopeThis      = "this"
+	scopeFollowing = "following"
+)
+
+// maxRecurrencePeriods bounds rule expansion so a rule that never matches
+// (e.g. BYMONTHDAY=31 with FREQ=MONTHLY;BYDAY=MO) cannot loop forever
+const maxRecurrencePeriods = 100000
+
+// errRecurrenceTruncated reports an expansion that reached
+// maxRecurrencePeriods before the end of the series or of the window
+var errRecurrenceTruncated = errors.New("recurrence expansion truncated")
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// weekdayNum is a BYDAY entry such as MO, 2TU or -1FR
+type weekdayNum struct {
+	Ordinal int // 0 means every such weekday of the period
+	Weekday time.Weekday
+}
+
+func (w weekdayNum) String() string {
+	code := strings.ToUpper(w.Weekday.String()[:2])
+	if w.Ordinal == 0 {
+		return code
+	}
+	return strconv.Itoa(w.Ordinal) + code
+}
+
+// RecurrenceRule is a parsed RRULE
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []weekdayNum
+	ByMonthDay []int
+	Count      int
+	Until      time.Time
+}
+
+// parseRRule parses an RRULE value such as "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10"
+func parseRRule(value string) (*RecurrenceRule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	rule := &RecurrenceRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rrule part %q", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+			switch rule.Freq {
+			case freqDaily, freqWeekly, freqMonthly, freqYearly:
+			default:
+				return nil, fmt.Errorf("unsupported rrule FREQ %q", val)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid rrule INTERVAL %q", val)
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid rrule COUNT %q", val)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseICalTime(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rrule UNTIL %q", val)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				wd, err := parseWeekdayNum(day)
+				if err != nil {
+					return nil, err
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid rrule BYMONTHDAY %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		case "WKST":
+			// Weeks always start on Monday
+		default:
+			return nil, fmt.Errorf("unsupported rrule part %q", key)
+		}
+	}
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("rrule is missing FREQ")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, fmt.Errorf("rrule cannot have both COUNT and UNTIL")
+	}
+	// RFC 5545 allows BYDAY ordinals only with MONTHLY and YEARLY rules
+	if rule.Freq == freqDaily || rule.Freq == freqWeekly {
+		for _, wd := range rule.ByDay {
+			if wd.Ordinal != 0 {
+				return nil, fmt.Errorf("rrule BYDAY %s: ordinals need FREQ=MONTHLY or FREQ=YEARLY", wd)
+			}
+		}
+	}
+	return rule, nil
+}
+
+func parseWeekdayNum(value string) (weekdayNum, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if len(value) < 2 {
+		return weekdayNum{}, fmt.Errorf("invalid rrule BYDAY %q", value)
+	}
+	wd, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return weekdayNum{}, fmt.Errorf("invalid rrule BYDAY %q", value)
+	}
+	num := weekdayNum{Weekday: wd}
+	if prefix := value[:len(value)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -53 || n > 53 {
+			return weekdayNum{}, fmt.Errorf("invalid rrule BYDAY %q", value)
+		}
+		num.Ordinal = n
+	}
+	return num, nil
+}
+
+// parseICalTime parses a DATE or UTC DATE-TIME value as used by UNTIL
+func parseICalTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date-time %q", value)
+}
+
+// String formats the rule back into RRULE syntax
+func (r *RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, wd := range r.ByDay {
+			days[i] = wd.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			days[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// each calls fn with every occurrence start of a series beginning at dtstart,
+// in order, until fn returns false or the occurrences reach the limit. It
+// fails with errRecurrenceTruncated if it gives up after
+// maxRecurrencePeriods periods instead.
+func (r *RecurrenceRule) each(dtstart, limit time.Time, fn func(time.Time) bool) error {
+	count := 0
+	for k := 0; k < maxRecurrencePeriods; k++ {
+		periodStart, candidates := r.period(dtstart, k)
+		if !periodStart.Before(limit) && len(candidates) == 0 {
+			return nil
+		}
+		for _, t := range candidates {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return nil
+			}
+			if !t.Before(limit) {
+				return nil
+			}
+			count++
+			if !fn(t) {
+				return nil
+			}
+			if r.Count > 0 && count >= r.Count {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w after %d periods", errRecurrenceTruncated, maxRecurrencePeriods)
+}
+
+// period returns the start of the k-th period of the series and the sorted
+// occurrence candidates inside it
+func (r *RecurrenceRule) period(dtstart time.Time, k int) (time.Time, []time.Time) {
+	loc := dtstart.Location()
+	hour, min, sec := dtstart.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, min, sec, dtstart.Nanosecond(), loc)
+	}
+	y, m, d := dtstart.Date()
+	step := k * r.Interval
+
+	var candidates []time.Time
+	var start time.Time
+	switch r.Freq {
+	case freqDaily:
+		start = at(y, m, d+step)
+		if r.matchesDay(start) {
+			candidates = append(candidates, start)
+		}
+	case freqWeekly:
+		offset := (int(dtstart.Weekday()) + 6) % 7 // days since Monday
+		start = at(y, m, d-offset+7*step)
+		if len(r.ByDay) == 0 {
+			candidates = append(candidates, at(y, m, d+7*step))
+		}
+		for i := 0; i < 7 && len(r.ByDay) > 0; i++ {
+			day := at(start.Year(), start.Month(), start.Day()+i)
+			if r.matchesDay(day) {
+				candidates = append(candidates, day)
+			}
+		}
+	case freqMonthly:
+		start = at(y, m+time.Month(step), 1)
+		candidates = r.monthCandidates(start, d, at)
+	case freqYearly:
+		start = at(y+step, time.January, 1)
+		switch {
+		case len(r.ByMonthDay) > 0:
+			for month := time.January; month <= time.December; month++ {
+				candidates = append(candidates, r.monthCandidates(at(start.Year(), month, 1), d, at)...)
+			}
+		case len(r.ByDay) > 0:
+			candidates = r.spanWeekdays(start, at(start.Year()+1, time.January, 1), at)
+		default:
+			if t := at(start.Year(), m, d); t.Month() == m {
+				candidates = append(candidates, t)
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	return start, candidates
+}
+
+// monthCandidates expands BYMONTHDAY and BYDAY within the month starting at
+// monthStart; without either it repeats the day of month of the series start
+func (r *RecurrenceRule) monthCandidates(monthStart time.Time, day int, at func(int, time.Month, int) time.Time) []time.Time {
+	y, m := monthStart.Year(), monthStart.Month()
+	next := at(y, m+1, 1)
+	daysInMonth := at(y, m+1, 0).Day()
+
+	var candidates []time.Time
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = daysInMonth + md + 1
+			}
+			if md < 1 || md > daysInMonth {
+				continue
+			}
+			t := at(y, m, md)
+			if len(r.ByDay) == 0 || r.matchesDay(t) {
+				candidates = append(candidates, t)
+			}
+		}
+	case len(r.ByDay) > 0:
+		candidates = r.spanWeekdays(monthStart, next, at)
+	default:
+		if day <= daysInMonth {
+			candidates = append(candidates, at(y, m, day))
+		}
+	}
+	return candidates
+}
+
+// spanWeekdays expands BYDAY entries inside [from, to), where ordinals count
+// from the start (positive) or the end (negative) of the span
+func (r *RecurrenceRule) spanWeekdays(from, to time.Time, at func(int, time.Month, int) time.Time) []time.Time {
+	var candidates []time.Time
+	for _, wd := range r.ByDay {
+		var days []time.Time
+		for t := from; t.Before(to); t = at(t.Year(), t.Month(), t.Day()+1) {
+			if t.Weekday() == wd.Weekday {
+				days = append(days, t)
+			}
+		}
+		switch {
+		case wd.Ordinal == 0:
+			candidates = append(candidates, days...)
+		case wd.Ordinal > 0 && wd.Ordinal <= len(days):
+			candidates = append(candidates, days[wd.Ordinal-1])
+		case wd.Ordinal < 0 && -wd.Ordinal <= len(days):
+			candidates = append(candidates, days[len(days)+wd.Ordinal])
+		}
+	}
+	return candidates
+}
+
+// matchesDay applies BYDAY and BYMONTHDAY as filters on a single day
+func (r *RecurrenceRule) matchesDay(t time.Time) bool {
+	if len(r.ByDay) > 0 {
+		found := false
+		for _, wd := range r.ByDay {
+			if wd.Weekday == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ByMonthDay) > 0 {
+		daysInMonth := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		found := false
+		for _, md := range r.ByMonthDay {
+			if md == t.Day() || daysInMonth+md+1 == t.Day() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// isExcluded reports whether t is one of the event's exception dates
+func (e *Event) isExcluded(t time.Time) bool {
+	for _, ex := range e.ExDates {
+		if ex.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the parsed recurrence rule of the event, or nil for a single event
+func (e *Event) rule() *RecurrenceRule {
+	if e.RRule == "" {
+		return nil
+	}
+	rule, err := parseRRule(e.RRule)
+	if err != nil {
+		// Rules are validated on write, so this only happens with corrupt data
+		return nil
+	}
+	return rule
+}
+
+// expandOccurrences returns the concrete occurrences of a recurring event
+// that overlap [startTime, endTime)
+func expandOccurrences(event Event, startTime, endTime time.Time) []Event {
+	rule := event.rule()
+	if rule == nil {
+		return nil
+	}
+	duration := event.EndTime.Sub(event.StartTime)
+	var occurrences []Event
+	event.eachOccurrence(rule, endTime, func(t time.Time) bool {
+		if event.isExcluded(t) {
+			return true
+		}
+		occurrence := event.occurrence(t, duration)
+		if start, end := occurrence.span(); overlaps(start, end, startTime, endTime) {
+			occurrences = append(occurrences, occurrence)
+		}
+		return true
+	})
+	return occurrences
+}
+
+// eachOccurrence runs the rule of the event from the start of the series up
+// to limit; occurrences it cannot reach within maxRecurrencePeriods are
+// missing from the result, which is logged
+func (e *Event) eachOccurrence(rule *RecurrenceRule, limit time.Time, fn func(time.Time) bool) {
+	if err := rule.each(e.seriesStart(), limit, fn); err != nil {
+		slog.Warn("recurrence: occurrences dropped", "user_id", e.UserID, "event_id", e.EventID, "rrule", e.RRule, "limit", limit, "err", err)
+	}
+}
+
+// seriesStart returns the start of a recurring event in its own time zone, so
+// that occurrences keep their local time across DST changes
+func (e *Event) seriesStart() time.Time {
+	return e.StartTime.In(e.location())
+}
+
+// occurrence builds the instance of a recurring event starting at t
+func (e Event) occurrence(t time.Time, duration time.Duration) Event {
+	recurrenceID := t
+	e.StartTime = t
+	e.EndTime = t.Add(duration)
+	e.RecurrenceID = &recurrenceID
+	e.ExDates = nil
+	return e
+}
+
+// hasOccurrence reports whether t is a (non-excluded) occurrence of the event
+func (e *Event) hasOccurrence(t time.Time) bool {
+	rule := e.rule()
+	if rule == nil || e.isExcluded(t) {
+		return false
+	}
+	found := false
+	e.eachOccurrence(rule, t.Add(time.Nanosecond), func(occ time.Time) bool {
+		found = occ.Equal(t)
+		return !found
+	})
+	return found
+}
+
+// occurrencesBefore counts the generated occurrences that start before t
+func (e *Event) occurrencesBefore(t time.Time) int {
+	rule := e.rule()
+	if rule == nil {
+		return 0
+	}
+	n := 0
+	e.eachOccurrence(rule, t, func(time.Time) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// truncateSeries ends the series of event right before the occurrence at t
+func truncateSeries(event *Event, t time.Time) {
+	rule := event.rule()
+	rule.Count = 0
+	rule.Until = t.Add(-time.Second)
+	event.RRule = rule.String()
+
+	var exDates []time.Time
+	for _, ex := range event.ExDates {
+		if ex.Before(t) {
+			exDates = append(exDates, ex)
+		}
+	}
+	event.ExDates = exDates
+}
+
+// splitSeries builds the new series that continues event from the occurrence
+// at t, keeping the remaining COUNT and exception dates. The new series is an
+// event of its own and gets a UID of its own.
+func splitSeries(event Event, t time.Time) Event {
+	rule := event.rule()
+	if rule.Count > 0 {
+		rule.Count -= event.occurrencesBefore(t)
+	}
+	var exDates []time.Time
+	for _, ex := range event.ExDates {
+		if !ex.Before(t) {
+			exDates = append(exDates, ex)
+		}
+	}
+	duration := event.EndTime.Sub(event.StartTime)
+	event.StartTime = t
+	event.EndTime = t.Add(duration)
+	event.RRule = rule.String()
+	event.ExDates = exDates
+	event.UID = ""
+	return event
+}
+
+// updateOccurrence edits one occurrence of a recurring event, or that
+// occurrence and every following one, depending on scope. In strict mode
+// the edit must not make the event overlap other events.
+func updateOccurrence(userID, eventID int, occurrence time.Time, scope string, updates map[string]string, strict bool, by principal, check eventCheck) error {
+	update := updateEvent
+	if strict {
+		update = updateEventExclusive
+	}
+	switch scope {
+	case scopeAll:
+		return update(userID, eventID, updates, by, check)
+	case scopeThis, scopeFollowing:
+	default:
+		return invalidf("invalid scope %q", scope)
+	}
+
+	series, err := getSeries(userID, eventID, occurrence)
+	if err != nil {
+		return err
+	}
+	if err := check.verify(series); err != nil {
+		return err
+	}
+	if scope == scopeFollowing && occurrence.Equal(series.StartTime) {
+		return update(userID, eventID, updates, by, check)
+	}
+
+	// The detached part becomes a new event, written in one atomic batch
+	// with the series so a failure changes neither
+	var detached Event
+	if scope == scopeThis {
+		detached = series.occurrence(occurrence, series.EndTime.Sub(series.StartTime))
+		detached.RRule = ""
+		detached.SeriesID = series.EventID
+	} else {
+		detached = splitSeries(series, occurrence)
+	}
+	detached.EventID = 0
+	replaced := detached
+	if err := applyUpdates(&detached, updates); err != nil {
+		return err
+	}
+	if err := normalizeRRule(&detached); err != nil {
+		return err
+	}
+	if err := checkFieldSizes(detached); err != nil {
+		return err
+	}
+
+	return applyBatch(userID, []batchOp{{
+		Kind:    batchUpdate,
+		EventID: eventID,
+		Check:   check,
+		Update: func(event *Event) error {
+			if !event.hasOccurrence(occurrence) {
+				return notFoundf("event ID %d has no occurrence at %s", eventID, occurrence.Format(time.RFC3339))
+			}
+			if scope == scopeThis {
+				event.ExDates = append(event.ExDates, occurrence)
+			} else {
+				truncateSeries(event, occurrence)
+			}
+			return nil
+		},
+	}, {
+		Kind:      batchCreate,
+		Event:     detached,
+		Exclusive: strict,
+		Replaces:  &replaced,
+	}}, by)
+}
+
+// deleteOccurrence removes one occurrence of a recurring event, or that
+// occurrence and every following one, depending on scope
+func deleteOccurrence(userID, eventID int, occurrence time.Time, scope string, by principal, check eventCheck) error {
+	switch scope {
+	case scopeAll:
+		return deleteEvent(userID, eventID, by, check)
+	case scopeThis, scopeFollowing:
+	default:
+		return invalidf("invalid scope %q", scope)
+	}
+
+	series, err := getSeries(userID, eventID, occurrence)
+	if err != nil {
+		return err
+	}
+	if err := check.verify(series); err != nil {
+		return err
+	}
+	if scope == scopeFollowing && occurrence.Equal(series.StartTime) {
+		return deleteEvent(userID, eventID, by, check)
+	}
+
+	_, err = store.Update(userID, eventID, by, func(event *Event) error {
+		if err := check.verify(*event); err != nil {
+			return err
+		}
+		if !event.hasOccurrence(occurrence) {
+			return notFoundf("event ID %d has no occurrence at %s", eventID, occurrence.Format(time.RFC3339))
+		}
+		if scope == scopeThis {
+			event.ExDates = append(event.ExDates, occurrence)
+		} else {
+			truncateSeries(event, occurrence)
+		}
+		return nil
+	})
+	return err
+}
+
+// getSeries loads a recurring event and checks that occurrence belongs to it
+func getSeries(userID, eventID int, occurrence time.Time) (Event, error) {
+	event, err := store.Get(userID, eventID)
+	if err != nil {
+		return Event{}, err
+	}
+	if event.RRule == "" {
+		return Event{}, invalidf("event ID %d is not recurring", eventID)
+	}
+	if !event.hasOccurrence(occurrence) {
+		return Event{}, notFoundf("event ID %d has no occurrence at %s", eventID, occurrence.Format(time.RFC3339))
+	}
+	return event, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRRuleByDayOrdinals(t *testing.T) {
+	tests := []struct {
+		rrule string
+		ok    bool
+	}{
+		{"FREQ=DAILY;BYDAY=MO,FR", true},
+		{"FREQ=DAILY;BYDAY=1MO", false},
+		{"FREQ=WEEKLY;BYDAY=MO,WE", true},
+		{"FREQ=WEEKLY;BYDAY=-1FR", false},
+		{"FREQ=MONTHLY;BYDAY=-1FR", true},
+		{"FREQ=YEARLY;BYDAY=1MO", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rrule, func(t *testing.T) {
+			_, err := parseRRule(tt.rrule)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestRecurrenceTruncated(t *testing.T) {
+	start := time.Date(2026, time.March, 2, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		rrule string
+		limit time.Time
+		err   error
+	}{
+		{"ends", "FREQ=DAILY;COUNT=3", start.AddDate(1, 0, 0), nil},
+		{"reaches the limit", "FREQ=DAILY", start.AddDate(1, 0, 0), nil},
+		{"past the periods", "FREQ=DAILY", start.AddDate(0, 0, maxRecurrencePeriods+1), errRecurrenceTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRRule(tt.rrule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rule.each(start, tt.limit, func(time.Time) bool { return true })
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
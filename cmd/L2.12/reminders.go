@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxReminderLead bounds how long before an event a reminder may fire
+	maxReminderLead = 28 * 24 * time.Hour
+	// deliveryRetention is how long finished deliveries are kept
+	deliveryRetention = 7 * 24 * time.Hour
+	// webhookTimeout bounds a single delivery attempt
+	webhookTimeout = 10 * time.Second
+	// webhookWorkers is how many deliveries are sent at once, so that a slow
+	// webhook holds up only its own reminders
+	webhookWorkers = 8
+)
+
+// webhookAllowPrivate is set with -webhook-allow-private. Unless it is set,
+// webhooks may only reach public addresses, so that users cannot make the
+// server call loopback, link-local or private network services.
+var webhookAllowPrivate = false
+
+// errPrivateAddress rejects a webhook that resolves to an address that is
+// not public
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// publicAddress reports whether a webhook may connect to an IP address
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// newWebhookClient returns the client deliveries are sent with. The address
+// of every connection, redirects included, is checked after the host name
+// is resolved, so a name that resolves to an internal address is refused
+// too; proxies are not used, as they would be checked instead of the
+// webhook.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if webhookAllowPrivate {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, address)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// Delivery states
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+	deliveryCanceled  = "canceled"
+)
+
+// Delivery is one reminder of one event occurrence on its way to the user's
+// webhook
+type Delivery struct {
+	ID      string `json:"id"`
+	UserID  int    `json:"user_id"`
+	EventID int    `json:"event_id"`
+	// Occurrence is the stored start of the event or occurrence
+	Occurrence    time.Time `json:"occurrence"`
+	MinutesBefore int       `json:"minutes_before"`
+	FireAt        time.Time `json:"fire_at"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttempt   time.Time `json:"next_attempt"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// reminderUpdate is an atomic change of the reminder state: deliveries to
+// add or replace, deliveries to forget and the new scheduling watermark
+type reminderUpdate struct {
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+	Removed    []string   `json:"removed,omitempty"`
+	Watermark  *time.Time `json:"watermark,omitempty"`
+}
+
+// reminderPayload is the JSON body POSTed to a webhook
+type reminderPayload struct {
+	ID            string    `json:"id"`
+	UserID        int       `json:"user_id"`
+	MinutesBefore int       `json:"minutes_before"`
+	RemindAt      time.Time `json:"remind_at"`
+	Event         Event     `json:"event"`
+}
+
+func (s *memoryStore) Reminders() ([]Delivery, time.Time) {
+	var deliveries []Delivery
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, delivery := range s.deliveries {
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, s.watermark
+}
+
+func (s *memoryStore) UpdateReminders(update reminderUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commit(storeRecord{Op: opReminders, Reminders: &update}); err != nil {
+		return err
+	}
+	s.applyReminders(update)
+	return nil
+}
+
+// applyReminders must be called with the write lock held
+func (s *memoryStore) applyReminders(update reminderUpdate) {
+	for _, delivery := range update.Deliveries {
+		s.deliveries[delivery.ID] = delivery
+	}
+	for _, id := range update.Removed {
+		delete(s.deliveries, id)
+	}
+	if update.Watermark != nil {
+		s.watermark = *update.Watermark
+	}
+}
+
+// parseReminders parses a comma-separated list of reminder lead times, each
+// either whole minutes or a duration such as 15m or 1h30m
+func parseReminders(value string) ([]int, error) {
+	var minutes []int
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			d, derr := time.ParseDuration(item)
+			if derr != nil || d%time.Minute != 0 {
+				return nil, invalidf("invalid reminder %q: want minutes or a duration such as 15m", item)
+			}
+			n = int(d / time.Minute)
+		}
+		minutes = append(minutes, n)
+	}
+	return normalizeReminders(minutes)
+}
+
+// normalizeReminders validates reminder lead times in minutes and returns
+// them sorted without duplicates
+func normalizeReminders(minutes []int) ([]int, error) {
+	seen := make(map[int]bool)
+	var out []int
+	for _, n := range minutes {
+		if n < 0 || time.Duration(n)*time.Minute > maxReminderLead {
+			return nil, invalidf("reminder of %d minutes is out of range: want 0 to %d", n, int(maxReminderLead/time.Minute))
+		}
+		if !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// validateWebhookURL checks that a webhook is an absolute http(s) URL; an
+// empty value disables reminders. Hosts that are plainly not public are
+// refused here, names that resolve to such addresses when a reminder is sent.
+func validateWebhookURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidf("invalid webhook_url: want an absolute http or https URL")
+	}
+	if webhookAllowPrivate {
+		return nil
+	}
+	host := u.Hostname()
+	if ip, err := netip.ParseAddr(host); (err == nil && !publicAddress(ip)) || strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return invalidf("invalid webhook_url: %s is not a public address", host)
+	}
+	return nil
+}
+
+// reminderStart returns the instant an event starts for its reminders; an
+// all-day event starts at midnight in the user's time zone
+func reminderStart(event Event, loc *time.Location) time.Time {
+	if event.AllDay {
+		return floatingDate(event.StartTime, loc)
+	}
+	return event.StartTime
+}
+
+func deliveryID(userID, eventID int, occurrence time.Time, minutes int) string {
+	return fmt.Sprintf("%d-%d-%d-%d", userID, eventID, occurrence.Unix(), minutes)
+}
+
+// reminderScheduler turns event reminders into webhook deliveries. Every tick
+// it records the reminders that fell due since the last tick together with
+// the new watermark in one store update, so after a restart nothing is
+// scheduled twice and reminders missed while the server was down are sent
+// late rather than dropped. Pending deliveries are retried with exponential
+// backoff. A crash between a successful POST and recording it leads to a
+// resend, so receivers should deduplicate on the X-Reminder-ID header.
+type reminderScheduler struct {
+	client      *http.Client
+	interval    time.Duration
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReminderScheduler(interval, backoff time.Duration, maxAttempts int) *reminderScheduler {
+	return &reminderScheduler{
+		client:      newWebhookClient(),
+		interval:    interval,
+		backoff:     backoff,
+		maxBackoff:  64 * backoff,
+		maxAttempts: maxAttempts,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (s *reminderScheduler) Start() {
+	go s.run()
+}
+
+// Stop ends the scheduler and waits for the current tick to finish
+func (s *reminderScheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *reminderScheduler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.tick(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// tick schedules the reminders due by now, sends the pending deliveries and
+// forgets old finished ones
+func (s *reminderScheduler) tick(now time.Time) {
+	if err := s.schedule(now); err != nil {
+		slog.Error("reminders: scheduling failed", "err", err)
+		return
+	}
+	s.deliver(now)
+	s.prune(now)
+}
+
+// schedule records a pending delivery for every reminder of the users' own
+// events that fires after the watermark and no later than now, and moves the
+// watermark to now. The first run only sets the watermark, so past reminders
+// are not sent.
+func (s *reminderScheduler) schedule(now time.Time) error {
+	deliveries, watermark := store.Reminders()
+	if watermark.IsZero() {
+		return store.UpdateReminders(reminderUpdate{Watermark: &now})
+	}
+	if !now.After(watermark) {
+		return nil
+	}
+
+	known := make(map[string]bool, len(deliveries))
+	for _, delivery := range deliveries {
+		known[delivery.ID] = true
+	}
+	var due []Delivery
+	for _, userID := range store.UserIDs() {
+		user := store.GetUser(userID)
+		if user.WebhookURL == "" {
+			continue
+		}
+		loc := user.location()
+		for _, event := range getEventsForRange(userID, watermark.In(loc), now.Add(maxReminderLead).In(loc)) {
+			// The reminders of an event are its owner's; invitations
+			// carry them too but do not remind the attendees
+			if event.UserID != userID {
+				continue
+			}
+			start := reminderStart(event, loc)
+			for _, minutes := range event.Reminders {
+				fireAt := start.Add(-time.Duration(minutes) * time.Minute)
+				if !fireAt.After(watermark) || fireAt.After(now) {
+					continue
+				}
+				id := deliveryID(userID, event.EventID, event.StartTime, minutes)
+				if known[id] {
+					continue
+				}
+				known[id] = true
+				due = append(due, Delivery{
+					ID:            id,
+					UserID:        userID,
+					EventID:       event.EventID,
+					Occurrence:    event.StartTime,
+					MinutesBefore: minutes,
+					FireAt:        fireAt,
+					Status:        deliveryPending,
+					NextAttempt:   fireAt,
+				})
+			}
+		}
+	}
+	return store.UpdateReminders(reminderUpdate{Deliveries: due, Watermark: &now})
+}
+
+// deliver attempts every pending delivery whose next attempt is due, oldest
+// first, on up to webhookWorkers at once, and records each outcome as soon
+// as it is known. It returns when all of them are done.
+func (s *reminderScheduler) deliver(now time.Time) {
+	deliveries, _ := store.Reminders()
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt) })
+
+	due := make(chan Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range due {
+				delivery = s.attempt(delivery, now)
+				if err := store.UpdateReminders(reminderUpdate{Deliveries: []Delivery{delivery}}); err != nil {
+					slog.Error("reminders: recording delivery failed", "delivery_id", delivery.ID, "err", err)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(due)
+	for _, delivery := range deliveries {
+		if delivery.Status != deliveryPending || delivery.NextAttempt.After(now) {
+			continue
+		}
+		select {
+		case due <- delivery:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and returns it with the outcome recorded
+func (s *reminderScheduler) attempt(delivery Delivery, now time.Time) Delivery {
+	webhook, payload, err := reminderTarget(delivery)
+	if err != nil {
+		delivery.Status = deliveryCanceled
+		delivery.LastError = err.Error()
+		return delivery
+	}
+
+	delivery.Attempts++
+	permanent, err := s.post(webhook, delivery.ID, payload)
+	switch {
+	case err == nil:
+		delivery.Status = deliveryDelivered
+		delivery.LastError = ""
+	case permanent || delivery.Attempts >= s.maxAttempts:
+		delivery.Status = deliveryFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.NextAttempt = now.Add(s.retryDelay(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+	return delivery
+}
+
+// retryDelay doubles the backoff with every failed attempt up to maxBackoff
+func (s *reminderScheduler) retryDelay(attempts int) time.Duration {
+	delay := s.backoff
+	for i := 1; i < attempts && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay
+}
+
+// reminderTarget resolves the webhook and payload of a delivery from the
+// current state, failing if the user, event, occurrence or reminder is gone
+func reminderTarget(delivery Delivery) (string, reminderPayload, error) {
+	var payload reminderPayload
+	webhook := store.GetUser(delivery.UserID).WebhookURL
+	if webhook == "" {
+		return "", payload, fmt.Errorf("no webhook configured")
+	}
+	event, err := store.Get(delivery.UserID, delivery.EventID)
+	if err != nil {
+		return "", payload, fmt.Errorf("event was deleted")
+	}
+	if event.RRule != "" {
+		if !event.hasOccurrence(delivery.Occurrence) {
+			return "", payload, fmt.Errorf("occurrence was removed")
+		}
+		event = event.occurrence(delivery.Occurrence, event.EndTime.Sub(event.StartTime))
+	} else if !event.StartTime.Equal(delivery.Occurrence) {
+		return "", payload, fmt.Errorf("event was rescheduled")
+	}
+	found := false
+	for _, minutes := range event.Reminders {
+		found = found || minutes == delivery.MinutesBefore
+	}
+	if !found {
+		return "", payload, fmt.Errorf("reminder was removed")
+	}
+
+	payload = reminderPayload{
+		ID:            delivery.ID,
+		UserID:        delivery.UserID,
+		MinutesBefore: delivery.MinutesBefore,
+		RemindAt:      delivery.FireAt,
+		Event:         event,
+	}
+	return webhook, payload, nil
+}
+
+// post sends a payload to a webhook. Any 2xx response is a success; other
+// 4xx responses except 408 and 429 are permanent failures, as are webhooks
+// that resolve to addresses that are not public.
+func (s *reminderScheduler) post(webhook, id string, payload reminderPayload) (permanent bool, err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return true, err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Reminder-ID", id)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Is(err, errPrivateAddress), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	permanent = resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests
+	return permanent, fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+// prune forgets finished deliveries older than deliveryRetention; they fire
+// before the watermark and cannot be scheduled again
+func (s *reminderScheduler) prune(now time.Time) {
+	deliveries, _ := store.Reminders()
+	var removed []string
+	for _, delivery := range deliveries {
+		if delivery.Status != deliveryPending && delivery.FireAt.Before(now.Add(-deliveryRetention)) {
+			removed = append(removed, delivery.ID)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if err := store.UpdateReminders(reminderUpdate{Removed: removed}); err != nil {
+		slog.Error("reminders: pruning failed", "err", err)
+	}
+}
+
+// Handler for GET /v1/users/{user_id}/reminders
+func listRemindersV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	deliveries, _ := store.Reminders()
+	result := []Delivery{}
+	for _, delivery := range deliveries {
+		if delivery.UserID == userID {
+			result = append(result, delivery)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].FireAt.Before(result[j].FireAt) })
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedReminder is one webhook call seen by a webhookReceiver
+type receivedReminder struct {
+	ID          string
+	ContentType string
+	Payload     reminderPayload
+}
+
+// webhookReceiver is a webhook that records the reminders POSTed to it and
+// answers with the given statuses in turn, then with 200
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []receivedReminder
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rec := &webhookReceiver{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload reminderPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.received = append(rec.received, receivedReminder{
+			ID:          r.Header.Get("X-Reminder-ID"),
+			ContentType: r.Header.Get("Content-Type"),
+			Payload:     payload,
+		})
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// calls returns the reminders received so far
+func (rec *webhookReceiver) calls() []receivedReminder {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]receivedReminder(nil), rec.received...)
+}
+
+// allowPrivateWebhooks lets the scheduler reach the webhook receivers of a
+// test, which listen on the loopback interface
+func allowPrivateWebhooks(t *testing.T) {
+	allow := webhookAllowPrivate
+	webhookAllowPrivate = true
+	t.Cleanup(func() { webhookAllowPrivate = allow })
+}
+
+// reminderTestBase is the time the scheduler of the tests first runs
+var reminderTestBase = time.Date(2026, time.March, 2, 9, 0, 0, 0, time.UTC)
+
+// newReminderTest installs an empty store and returns a scheduler whose
+// watermark is at reminderTestBase
+func newReminderTest(t *testing.T) *reminderScheduler {
+	saved := store
+	store = newMemoryStore()
+	t.Cleanup(func() { store = saved })
+	allowPrivateWebhooks(t)
+
+	scheduler := newReminderScheduler(time.Second, time.Minute, 3)
+	scheduler.tick(reminderTestBase)
+	return scheduler
+}
+
+// createReminderEvent stores an event of userID starting at start with the
+// given reminders
+func createReminderEvent(t *testing.T, userID int, start time.Time, reminders []int, attendees ...Attendee) Event {
+	event := Event{
+		UserID:    userID,
+		EventID:   store.NextEventID(),
+		Title:     "Review",
+		StartTime: start,
+		EndTime:   start.Add(time.Hour),
+		Reminders: reminders,
+		Attendees: attendees,
+	}
+	if err := store.Create(event, systemActor); err != nil {
+		t.Fatalf("create event: %v", err)
+	}
+	return event
+}
+
+// deliveryOf returns the stored delivery with the ID
+func deliveryOf(t *testing.T, id string) Delivery {
+	deliveries, _ := store.Reminders()
+	for _, delivery := range deliveries {
+		if delivery.ID == id {
+			return delivery
+		}
+	}
+	t.Fatalf("no delivery %s", id)
+	return Delivery{}
+}
+
+func TestReminderDelivery(t *testing.T) {
+	scheduler := newReminderTest(t)
+	hook := newWebhookReceiver(t)
+	store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+	start := reminderTestBase.Add(time.Hour)
+	event := createReminderEvent(t, 1, start, []int{10, 30})
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		calls int
+	}{
+		{"before the first reminder", start.Add(-31 * time.Minute), 0},
+		{"at the first reminder", start.Add(-30 * time.Minute), 1},
+		{"between the reminders", start.Add(-20 * time.Minute), 1},
+		{"after the second reminder", start.Add(-9 * time.Minute), 2},
+		{"after the event", start.Add(time.Hour), 2},
+	}
+	for _, tt := range tests {
+		scheduler.tick(tt.now)
+		if got := len(hook.calls()); got != tt.calls {
+			t.Fatalf("%s: got %d webhook calls, want %d", tt.name, got, tt.calls)
+		}
+	}
+
+	calls := hook.calls()
+	for i, minutes := range []int{30, 10} {
+		call := calls[i]
+		wantID := deliveryID(1, event.EventID, start, minutes)
+		if call.ID != wantID || call.Payload.ID != wantID {
+			t.Errorf("call %d: got ID %q (header) and %q (payload), want %q", i, call.ID, call.Payload.ID, wantID)
+		}
+		if call.ContentType != "application/json" {
+			t.Errorf("call %d: got Content-Type %q", i, call.ContentType)
+		}
+		payload := call.Payload
+		if payload.UserID != 1 || payload.MinutesBefore != minutes || payload.Event.EventID != event.EventID {
+			t.Errorf("call %d: got payload %+v", i, payload)
+		}
+		if want := start.Add(-time.Duration(minutes) * time.Minute); !payload.RemindAt.Equal(want) {
+			t.Errorf("call %d: got remind_at %s, want %s", i, payload.RemindAt, want)
+		}
+		if !payload.Event.StartTime.Equal(start) || payload.Event.Title != event.Title {
+			t.Errorf("call %d: got event %+v", i, payload.Event)
+		}
+		if delivery := deliveryOf(t, wantID); delivery.Status != deliveryDelivered || delivery.Attempts != 1 {
+			t.Errorf("call %d: got delivery %+v", i, delivery)
+		}
+	}
+}
+
+func TestReminderRecurringOccurrence(t *testing.T) {
+	scheduler := newReminderTest(t)
+	hook := newWebhookReceiver(t)
+	store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+	start := reminderTestBase.Add(time.Hour)
+	event := Event{
+		UserID:    1,
+		EventID:   store.NextEventID(),
+		Title:     "Standup",
+		StartTime: start,
+		EndTime:   start.Add(15 * time.Minute),
+		RRule:     "FREQ=DAILY",
+		Reminders: []int{5},
+	}
+	if err := store.Create(event, systemActor); err != nil {
+		t.Fatal(err)
+	}
+
+	second := start.AddDate(0, 0, 1)
+	scheduler.tick(start)
+	scheduler.tick(second.Add(-5 * time.Minute))
+	calls := hook.calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %d webhook calls, want 2", len(calls))
+	}
+	if got := calls[1].Payload.Event.StartTime; !got.Equal(second) {
+		t.Errorf("got occurrence at %s, want %s", got, second)
+	}
+	if calls[0].ID == calls[1].ID {
+		t.Errorf("occurrences share the reminder ID %s", calls[0].ID)
+	}
+}
+
+func TestReminderRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// ticks are the minutes after the reminder fires at which the
+		// scheduler runs
+		ticks    []int
+		calls    int
+		status   string
+		attempts int
+	}{
+		{"retried after a server error", []int{503}, []int{0, 0, 1}, 2, deliveryDelivered, 2},
+		{"waits for the backoff", []int{503}, []int{0}, 1, deliveryPending, 1},
+		{"backoff doubles", []int{500, 500}, []int{0, 1, 2, 3}, 3, deliveryDelivered, 3},
+		{"rate limits are retried", []int{429}, []int{0, 1}, 2, deliveryDelivered, 2},
+		{"client errors are permanent", []int{404}, []int{0, 1, 5}, 1, deliveryFailed, 1},
+		{"gives up after the last attempt", []int{503, 503, 503}, []int{0, 1, 3, 10}, 3, deliveryFailed, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler := newReminderTest(t)
+			hook := newWebhookReceiver(t, tt.statuses...)
+			store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+			start := reminderTestBase.Add(time.Hour)
+			event := createReminderEvent(t, 1, start, []int{15})
+			fireAt := start.Add(-15 * time.Minute)
+
+			for _, minutes := range tt.ticks {
+				scheduler.tick(fireAt.Add(time.Duration(minutes) * time.Minute))
+			}
+			if got := len(hook.calls()); got != tt.calls {
+				t.Errorf("got %d webhook calls, want %d", got, tt.calls)
+			}
+			delivery := deliveryOf(t, deliveryID(1, event.EventID, start, 15))
+			if delivery.Status != tt.status || delivery.Attempts != tt.attempts {
+				t.Errorf("got status %s after %d attempts, want %s after %d", delivery.Status, delivery.Attempts, tt.status, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestReminderCanceled(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(event Event) error
+		reason string
+	}{
+		{"event deleted", func(event Event) error {
+			return store.Delete(event.UserID, event.EventID, systemActor, nil)
+		}, "event was deleted"},
+		{"event rescheduled", func(event Event) error {
+			_, err := store.Update(event.UserID, event.EventID, systemActor, func(e *Event) error {
+				e.StartTime = e.StartTime.Add(time.Hour)
+				e.EndTime = e.EndTime.Add(time.Hour)
+				return nil
+			})
+			return err
+		}, "event was rescheduled"},
+		{"reminder removed", func(event Event) error {
+			_, err := store.Update(event.UserID, event.EventID, systemActor, func(e *Event) error {
+				e.Reminders = []int{5}
+				return nil
+			})
+			return err
+		}, "reminder was removed"},
+		{"webhook removed", func(event Event) error {
+			return store.PutUser(User{UserID: event.UserID})
+		}, "no webhook configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler := newReminderTest(t)
+			hook := newWebhookReceiver(t, http.StatusServiceUnavailable)
+			store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+			start := reminderTestBase.Add(time.Hour)
+			event := createReminderEvent(t, 1, start, []int{15})
+			fireAt := start.Add(-15 * time.Minute)
+
+			// The first attempt fails, the change lands before the retry
+			scheduler.tick(fireAt)
+			if err := tt.change(event); err != nil {
+				t.Fatal(err)
+			}
+			scheduler.tick(fireAt.Add(time.Minute))
+
+			if got := len(hook.calls()); got != 1 {
+				t.Errorf("got %d webhook calls, want 1", got)
+			}
+			delivery := deliveryOf(t, deliveryID(1, event.EventID, start, 15))
+			if delivery.Status != deliveryCanceled || delivery.LastError != tt.reason {
+				t.Errorf("got status %s (%s), want %s (%s)", delivery.Status, delivery.LastError, deliveryCanceled, tt.reason)
+			}
+		})
+	}
+}
+
+func TestReminderInvitee(t *testing.T) {
+	scheduler := newReminderTest(t)
+	organizerHook := newWebhookReceiver(t)
+	inviteeHook := newWebhookReceiver(t)
+	store.PutUser(User{UserID: 1, WebhookURL: organizerHook.URL})
+	store.PutUser(User{UserID: 2, WebhookURL: inviteeHook.URL})
+	start := reminderTestBase.Add(time.Hour)
+	event := createReminderEvent(t, 1, start, []int{15}, Attendee{UserID: 2, Status: rsvpAccepted})
+
+	scheduler.tick(start.Add(-15 * time.Minute))
+	scheduler.tick(start)
+
+	if calls := organizerHook.calls(); len(calls) != 1 || calls[0].Payload.UserID != 1 || calls[0].Payload.Event.EventID != event.EventID {
+		t.Errorf("organizer got %+v, want one reminder of event %d", calls, event.EventID)
+	}
+	if calls := inviteeHook.calls(); len(calls) != 0 {
+		t.Errorf("invitee got %d reminders of the organizer's event, want 0", len(calls))
+	}
+	deliveries, _ := store.Reminders()
+	for _, delivery := range deliveries {
+		if delivery.UserID != 1 {
+			t.Errorf("got delivery %+v for user %d", delivery, delivery.UserID)
+		}
+	}
+}
+
+func TestReminderRestart(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// before and after are the minutes after the reminder fires at which
+		// the scheduler runs before and after the restart
+		before   []int
+		after    []int
+		calls    int
+		attempts int
+	}{
+		{"fired while down", nil, nil, []int{5, 6}, 1, 1},
+		{"delivered before the restart", nil, []int{0}, []int{1, 10}, 1, 1},
+		{"retried after the restart", []int{503}, []int{0}, []int{1, 10}, 2, 2},
+	}
+	for _, snapshotEvery := range []int{1, 1000} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/snapshot-every=%d", tt.name, snapshotEvery), func(t *testing.T) {
+				saved := store
+				t.Cleanup(func() { store = saved })
+				allowPrivateWebhooks(t)
+				dir := t.TempDir()
+				open := func() *fileStore {
+					s, err := newFileStore(dir, snapshotEvery, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					store = s
+					return s
+				}
+
+				s := open()
+				scheduler := newReminderScheduler(time.Second, time.Minute, 3)
+				scheduler.tick(reminderTestBase)
+				hook := newWebhookReceiver(t, tt.statuses...)
+				store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+				start := reminderTestBase.Add(time.Hour)
+				event := createReminderEvent(t, 1, start, []int{15})
+				fireAt := start.Add(-15 * time.Minute)
+				for _, minutes := range tt.before {
+					scheduler.tick(fireAt.Add(time.Duration(minutes) * time.Minute))
+				}
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				s = open()
+				defer s.Close()
+				scheduler = newReminderScheduler(time.Second, time.Minute, 3)
+				for _, minutes := range tt.after {
+					scheduler.tick(fireAt.Add(time.Duration(minutes) * time.Minute))
+				}
+
+				id := deliveryID(1, event.EventID, start, 15)
+				calls := hook.calls()
+				if len(calls) != tt.calls {
+					t.Fatalf("got %d webhook calls, want %d", len(calls), tt.calls)
+				}
+				for _, call := range calls {
+					if call.ID != id {
+						t.Errorf("got a call for %s, want only %s", call.ID, id)
+					}
+				}
+				if delivery := deliveryOf(t, id); delivery.Status != deliveryDelivered || delivery.Attempts != tt.attempts {
+					t.Errorf("got status %s after %d attempts, want %s after %d", delivery.Status, delivery.Attempts, deliveryDelivered, tt.attempts)
+				}
+			})
+		}
+	}
+}
+
+func TestReminderSlowWebhook(t *testing.T) {
+	scheduler := newReminderTest(t)
+	// The slow webhook answers once the other one was called, or gives up
+	fastCalled := make(chan struct{})
+	released := make(chan bool, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastCalled:
+			released <- true
+		case <-time.After(2 * time.Second):
+			released <- false
+		}
+	}))
+	t.Cleanup(slow.Close)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastCalled)
+	}))
+	t.Cleanup(fast.Close)
+	store.PutUser(User{UserID: 1, WebhookURL: slow.URL})
+	store.PutUser(User{UserID: 2, WebhookURL: fast.URL})
+	start := reminderTestBase.Add(time.Hour)
+	// The reminder of the slow webhook is due first
+	createReminderEvent(t, 1, start, []int{20})
+	createReminderEvent(t, 2, start, []int{15})
+
+	scheduler.tick(start.Add(-15 * time.Minute))
+	if !<-released {
+		t.Error("the slow webhook held up the reminder of the other user")
+	}
+}
+
+func TestReminderPrivateWebhook(t *testing.T) {
+	scheduler := newReminderTest(t)
+	hook := newWebhookReceiver(t)
+	// The webhook was stored while private addresses were allowed, or its
+	// name resolves to the loopback address now
+	store.PutUser(User{UserID: 1, WebhookURL: hook.URL})
+	webhookAllowPrivate = false
+	start := reminderTestBase.Add(time.Hour)
+	event := createReminderEvent(t, 1, start, []int{15})
+
+	scheduler.tick(start.Add(-15 * time.Minute))
+	if got := len(hook.calls()); got != 0 {
+		t.Errorf("got %d webhook calls, want 0", got)
+	}
+	delivery := deliveryOf(t, deliveryID(1, event.EventID, start, 15))
+	if delivery.Status != deliveryFailed || delivery.Attempts != 1 {
+		t.Errorf("got status %s after %d attempts (%s), want %s after 1", delivery.Status, delivery.Attempts, delivery.LastError, deliveryFailed)
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"https://hooks.example.com/reminders", true},
+		{"http://203.0.113.7:8080/hook", true},
+		{"ftp://hooks.example.com/", false},
+		{"/relative", false},
+		{"http://127.0.0.1:9000/", false},
+		{"http://localhost/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.1.2.3/", false},
+		{"http://192.168.0.10/", false},
+		{"http://[::1]/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://0.0.0.0/", false},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("validateWebhookURL(%q) = %v, want valid %t", tt.url, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// tagHours adds up the scheduled time of events per tag
+type tagHours struct {
+	tags     map[string]time.Duration
+	untagged time.Duration
+	total    time.Duration
+}
+
+// add counts d under every tag of the event; an event with several tags
+// counts in full for each of them
+func (h *tagHours) add(event *Event, d time.Duration) {
+	if h.tags == nil {
+		h.tags = make(map[string]time.Duration)
+	}
+	for _, tag := range event.Tags {
+		h.tags[tag] += d
+	}
+	if len(event.Tags) == 0 {
+		h.untagged += d
+	}
+	h.total += d
+}
+
+// tagHoursView is the JSON form of tagHours, in hours
+type tagHoursView struct {
+	Hours         map[string]float64 `json:"hours"`
+	UntaggedHours float64            `json:"untagged_hours"`
+	TotalHours    float64            `json:"total_hours"`
+}
+
+func (h *tagHours) view() tagHoursView {
+	v := tagHoursView{
+		Hours:         make(map[string]float64, len(h.tags)),
+		UntaggedHours: hours(h.untagged),
+		TotalHours:    hours(h.total),
+	}
+	for tag, d := range h.tags {
+		v.Hours[tag] = hours(d)
+	}
+	return v
+}
+
+// hours converts a duration to hours rounded to the hundredth
+func hours(d time.Duration) float64 {
+	return math.Round(d.Hours()*100) / 100
+}
+
+// tagWeek is the report of one week, starting on Monday
+type tagWeek struct {
+	Week  string `json:"week"`
+	Start string `json:"start"`
+	tagHoursView
+}
+
+// weekStart returns the local midnight of the Monday of t's week
+func weekStart(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// tagReport splits the scheduled time of events inside [from, to) by tag
+// and by week. All-day events mark a date rather than a time and are left
+// out; overlapping events count in full each.
+func tagReport(events []Event, from, to time.Time, loc *time.Location) (weeks []tagWeek, totals tagHours) {
+	var starts []time.Time
+	perWeek := make(map[string]*tagHours)
+	for week := weekStart(from, loc); week.Before(to); week = week.AddDate(0, 0, 7) {
+		starts = append(starts, week)
+		perWeek[week.Format(time.DateOnly)] = &tagHours{}
+	}
+
+	for i := range events {
+		event := &events[i]
+		if event.AllDay {
+			continue
+		}
+		start, end := event.span()
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		for week := weekStart(start, loc); week.Before(end); week = week.AddDate(0, 0, 7) {
+			lo, hi := start, week.AddDate(0, 0, 7)
+			if week.After(lo) {
+				lo = week
+			}
+			if end.Before(hi) {
+				hi = end
+			}
+			perWeek[week.Format(time.DateOnly)].add(event, hi.Sub(lo))
+			totals.add(event, hi.Sub(lo))
+		}
+	}
+
+	weeks = make([]tagWeek, 0, len(starts))
+	for _, week := range starts {
+		year, number := week.ISOWeek()
+		weeks = append(weeks, tagWeek{
+			Week:         fmt.Sprintf("%d-W%02d", year, number),
+			Start:        week.Format(time.DateOnly),
+			tagHoursView: perWeek[week.Format(time.DateOnly)].view(),
+		})
+	}
+	return weeks, totals
+}
+
+// Handler for GET /v1/users/{user_id}/reports/tags?from=...&to=...&tag=...&
+// calendars=...; sums up the scheduled hours of the user per tag and per
+// week over the days from up to but excluding to
+func tagReportV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	queryParams := r.URL.Query()
+
+	loc, err := requestLocation(queryParams, userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseDay(queryParams, "from", loc)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseDay(queryParams, "to", loc)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !to.After(from) {
+		respondWithError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+	if to.Sub(from) > maxListWindow {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("window is longer than %d days", int(maxListWindow.Hours()/24)))
+		return
+	}
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	events, err := getSelectedEventsForRange(userID, queryParams.Get("calendars"), from, to)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	weeks, totals := tagReport(filter.filterEvents(events), from, to, loc)
+
+	tags := make([]string, 0, len(totals.tags))
+	for tag := range totals.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	respondWithCacheableJSON(w, r, map[string]interface{}{"result": map[string]interface{}{
+		"from":      from.Format(time.DateOnly),
+		"to":        to.Format(time.DateOnly),
+		"time_zone": loc.String(),
+		"tags":      tags,
+		"weeks":     weeks,
+		"totals":    totals.view(),
+	}})
+}
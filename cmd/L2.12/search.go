@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	// defaultListWindow is the span searched past a single from or to bound
+	defaultListWindow = 366 * 24 * time.Hour
+	// maxListWindow bounds the span in which recurring events are expanded
+	maxListWindow = 5 * 366 * 24 * time.Hour
+	maxTagLength  = 64
+)
+
+// normalizeTags trims, lower-cases, deduplicates and sorts tags
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		if len(tag) > maxTagLength || strings.ContainsAny(tag, ",;") {
+			return nil, invalidf("invalid tag %q: want at most %d characters without commas", tag, maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// parseTags parses a comma-separated tag list
+func parseTags(value string) ([]string, error) {
+	return normalizeTags(strings.Split(value, ","))
+}
+
+// eventFilter selects events by text, location and tags
+type eventFilter struct {
+	// Terms must all occur in the title, description or location
+	Terms    []string
+	Location string
+	// Tags must all be carried by the event
+	Tags []string
+}
+
+// parseEventFilter reads the q, location and tag parameters; tag may be
+// repeated or comma-separated
+func parseEventFilter(params url.Values) (eventFilter, error) {
+	var f eventFilter
+	f.Terms = strings.Fields(strings.ToLower(params.Get("q")))
+	f.Location = strings.TrimSpace(params.Get("location"))
+	var err error
+	if f.Tags, err = normalizeTags(strings.Split(strings.Join(params["tag"], ","), ",")); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// empty reports whether the filter lets every event through
+func (f eventFilter) empty() bool {
+	return len(f.Terms) == 0 && f.Location == "" && len(f.Tags) == 0
+}
+
+// matches reports whether the event passes every criterion of the filter;
+// text and location compare case-insensitively
+func (f eventFilter) matches(event *Event) bool {
+	if f.Location != "" && !strings.EqualFold(event.Location, f.Location) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !event.hasTag(tag) {
+			return false
+		}
+	}
+	if len(f.Terms) > 0 {
+		text := strings.ToLower(event.Title + "\n" + event.Description + "\n" + event.Location)
+		for _, term := range f.Terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// filterEvents keeps the matching events in place
+func (f eventFilter) filterEvents(events []Event) []Event {
+	if f.empty() {
+		return events
+	}
+	kept := events[:0]
+	for i := range events {
+		if f.matches(&events[i]) {
+			kept = append(kept, events[i])
+		}
+	}
+	return kept
+}
+
+// hasTag reports whether the event carries a normalized tag
+func (e *Event) hasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// sortEvents orders events by start time, then event ID, which is unique for
+// the occurrences of one listing
+func sortEvents(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool { return eventKeyOf(events[i]).less(eventKeyOf(events[j])) })
+}
+
+// eventKey is the position of an event in a sorted listing
+type eventKey struct {
+	start   int64
+	eventID int
+}
+
+func eventKeyOf(event Event) eventKey {
+	return eventKey{start: event.StartTime.UnixNano(), eventID: event.EventID}
+}
+
+func (k eventKey) less(o eventKey) bool {
+	return k.start < o.start || (k.start == o.start && k.eventID < o.eventID)
+}
+
+// encodeCursor returns the opaque cursor of the page that follows key
+func encodeCursor(key eventKey) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", key.start, key.eventID)))
+}
+
+func decodeCursor(cursor string) (eventKey, error) {
+	var key eventKey
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return key, invalidf("invalid cursor")
+	}
+	start, eventID, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return key, invalidf("invalid cursor")
+	}
+	if key.start, err = strconv.ParseInt(start, 10, 64); err != nil {
+		return key, invalidf("invalid cursor")
+	}
+	if key.eventID, err = strconv.Atoi(eventID); err != nil {
+		return key, invalidf("invalid cursor")
+	}
+	return key, nil
+}
+
+// paginate returns the sorted events after the cursor, at most limit of
+// them, and the cursor of the next page if there is one
+func paginate(events []Event, cursor string, limit int) ([]Event, string, error) {
+	sortEvents(events)
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		i := sort.Search(len(events), func(i int) bool { return after.less(eventKeyOf(events[i])) })
+		events = events[i:]
+	}
+	if len(events) <= limit {
+		return events, "", nil
+	}
+	return events[:limit], encodeCursor(eventKeyOf(events[limit-1])), nil
+}
+
+// parseListWindow reads the optional from and to bounds of a listing; with a
+// single bound the other one is defaultListWindow away
+func parseListWindow(params url.Values, loc *time.Location) (from, to time.Time, bounded bool, err error) {
+	hasFrom, hasTo := params.Get("from") != "", params.Get("to") != ""
+	if !hasFrom && !hasTo {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	if hasFrom {
+		if from, err = parseInstant(params, "from", loc); err != nil {
+			return time.Time{}, time.Time{}, false, invalidf("%v", err)
+		}
+	}
+	if hasTo {
+		if to, err = parseInstant(params, "to", loc); err != nil {
+			return time.Time{}, time.Time{}, false, invalidf("%v", err)
+		}
+	}
+	switch {
+	case !hasFrom:
+		from = to.Add(-defaultListWindow)
+	case !hasTo:
+		to = from.Add(defaultListWindow)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, false, invalidf("to must be after from")
+	}
+	if to.Sub(from) > maxListWindow {
+		return time.Time{}, time.Time{}, false, invalidf("window is longer than %d days", int(maxListWindow.Hours()/24))
+	}
+	return from, to, true, nil
+}
+
+// parseLimit reads the page size parameter
+func parseLimit(params url.Values) (int, error) {
+	value := params.Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, invalidf("invalid limit parameter: want 1 to %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+// Handler for GET /v1/users/{user_id}/events?q=...&location=...&tag=...&
+// from=...&to=...&limit=...&cursor=...; without bounds it lists the stored
+// events and invitations, with bounds the occurrences inside them
+func listEventsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter, err := parseEventFilter(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	limit, err := parseLimit(queryParams)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	loc, err := requestLocation(queryParams, userID)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	from, to, bounded, err := parseListWindow(queryParams, loc)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var events []Event
+	if bounded {
+		events = getEventsForRange(userID, from, to)
+	} else {
+		events = append(store.List(userID), invitedEvents(userID)...)
+	}
+	page, next, err := paginate(filter.filterEvents(events), queryParams.Get("cursor"), limit)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if page == nil {
+		page = []Event{}
+	}
+
+	response := map[string]interface{}{"result": page}
+	if next != "" {
+		response["next_cursor"] = next
+	}
+	respondWithCacheableJSON(w, r, response)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// shardedStore spreads the users over several memory stores, each with its
+// own lock, so that writes to the calendars of different users do not wait
+// for each other. A user's events, trash, settings and calendars live in
+// the shard of the user; event IDs and calendar IDs come from counters
+// shared by all shards, and so does the index that numbers the audit
+// entries. Reminder state is global and lives in the first shard. Like the
+// memory store it keeps nothing on disk.
+type shardedStore struct {
+	shards []*memoryStore
+	feed   *changeFeed
+}
+
+func newShardedStore(n int) *shardedStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardedStore{shards: make([]*memoryStore, n), feed: newChangeFeed()}
+	eventIDs, calendarIDs, auditIndex := &sequence{}, &sequence{}, newAuditIndex()
+	for i := range s.shards {
+		shard := newMemoryStore()
+		shard.feed = s.feed
+		shard.eventIDs = eventIDs
+		shard.calendarIDs = calendarIDs
+		shard.auditIndex = auditIndex
+		s.shards[i] = shard
+	}
+	return s
+}
+
+// shard returns the shard that holds the calendar of the user
+func (s *shardedStore) shard(userID int) *memoryStore {
+	return s.shards[uint(userID)%uint(len(s.shards))]
+}
+
+// calendarShard returns the shard that holds a calendar
+func (s *shardedStore) calendarShard(calendarID int) (*memoryStore, error) {
+	for _, shard := range s.shards {
+		if _, err := shard.Calendar(calendarID); err == nil {
+			return shard, nil
+		}
+	}
+	return nil, notFoundf("calendar %d not found", calendarID)
+}
+
+func (s *shardedStore) NextEventID() int {
+	return s.shards[0].NextEventID()
+}
+
+func (s *shardedStore) Create(event Event, by principal) error {
+	return s.shard(event.UserID).Create(event, by)
+}
+
+func (s *shardedStore) Update(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	return s.shard(userID).Update(userID, eventID, by, fn)
+}
+
+func (s *shardedStore) CreateExclusive(event Event, by principal) error {
+	return s.shard(event.UserID).CreateExclusive(event, by)
+}
+
+func (s *shardedStore) UpdateExclusive(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	return s.shard(userID).UpdateExclusive(userID, eventID, by, fn)
+}
+
+func (s *shardedStore) Move(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	return s.move(userID, eventID, toUserID, false, by, fn)
+}
+
+func (s *shardedStore) MoveExclusive(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	return s.move(userID, eventID, toUserID, true, by, fn)
+}
+
+// move locks the shards of both users, the lower one first, when the event
+// changes shard
+func (s *shardedStore) move(userID, eventID, toUserID int, exclusive bool, by principal, fn func(*Event) error) (Event, error) {
+	from, to := s.shard(userID), s.shard(toUserID)
+	if from == to {
+		from.mu.Lock()
+		defer from.mu.Unlock()
+		return moveLocked(from, from, userID, eventID, toUserID, exclusive, by, fn)
+	}
+	first, second := from, to
+	if uint(toUserID)%uint(len(s.shards)) < uint(userID)%uint(len(s.shards)) {
+		first, second = to, from
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	return moveLocked(from, to, userID, eventID, toUserID, exclusive, by, fn)
+}
+
+func (s *shardedStore) Delete(userID, eventID int, by principal, check eventCheck) error {
+	return s.shard(userID).Delete(userID, eventID, by, check)
+}
+
+func (s *shardedStore) Restore(userID, eventID int, by principal) (Event, error) {
+	return s.shard(userID).Restore(userID, eventID, by)
+}
+
+func (s *shardedStore) Purge(cutoff time.Time, by principal) (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		n, err := shard.Purge(cutoff, by)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *shardedStore) Trash(userID int) []Event {
+	return s.shard(userID).Trash(userID)
+}
+
+// History merges the history of an event, which is split over two shards
+// when the event was moved between them
+func (s *shardedStore) History(eventID int) []auditEntry {
+	var entries []auditEntry
+	for _, shard := range s.shards {
+		entries = append(entries, shard.History(eventID)...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// Changes reads the audit index the shards share, without their locks
+func (s *shardedStore) Changes(userID int, seq int64) ([]auditEntry, int64) {
+	return s.shards[0].Changes(userID, seq)
+}
+
+func (s *shardedStore) Batch(userID int, ops []batchOp, atomic bool, by principal) ([]batchOutcome, error) {
+	return s.shard(userID).Batch(userID, ops, atomic, by)
+}
+
+func (s *shardedStore) Get(userID, eventID int) (Event, error) {
+	return s.shard(userID).Get(userID, eventID)
+}
+
+func (s *shardedStore) Range(userID int, startTime, endTime time.Time) []Event {
+	return s.shard(userID).Range(userID, startTime, endTime)
+}
+
+func (s *shardedStore) Series(userID int) []Event {
+	return s.shard(userID).Series(userID)
+}
+
+func (s *shardedStore) List(userID int) []Event {
+	return s.shard(userID).List(userID)
+}
+
+// UserIDs merges the users of every shard; an invited user shows up in the
+// shard of each organizer
+func (s *shardedStore) UserIDs() []int {
+	seen := make(map[int]bool)
+	var userIDs []int
+	for _, shard := range s.shards {
+		for _, userID := range shard.UserIDs() {
+			if !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	return userIDs
+}
+
+func (s *shardedStore) GetUser(userID int) User {
+	return s.shard(userID).GetUser(userID)
+}
+
+func (s *shardedStore) PutUser(user User) error {
+	return s.shard(user.UserID).PutUser(user)
+}
+
+func (s *shardedStore) UpdateUser(userID int, fn func(*User) error) (User, error) {
+	return s.shard(userID).UpdateUser(userID, fn)
+}
+
+func (s *shardedStore) Reminders() ([]Delivery, time.Time) {
+	return s.shards[0].Reminders()
+}
+
+func (s *shardedStore) UpdateReminders(update reminderUpdate) error {
+	return s.shards[0].UpdateReminders(update)
+}
+
+// Respond answers on the event in the shard of its organizer
+func (s *shardedStore) Respond(userID, eventID int, status string, by principal, check eventCheck) (Event, error) {
+	for _, shard := range s.shards {
+		if organizerID, invited := shard.organizerOf(userID, eventID); invited {
+			return s.shard(organizerID).Respond(userID, eventID, status, by, check)
+		}
+	}
+	return Event{}, notFoundf("user %d is not invited to event ID %d", userID, eventID)
+}
+
+func (s *shardedStore) Invitations(userID int) []Event {
+	var events []Event
+	for _, shard := range s.shards {
+		events = append(events, shard.Invitations(userID)...)
+	}
+	return events
+}
+
+func (s *shardedStore) Feed() *changeFeed {
+	return s.feed
+}
+
+func (s *shardedStore) CreateCalendar(cal Calendar) (Calendar, error) {
+	return s.shard(cal.UserID).CreateCalendar(cal)
+}
+
+func (s *shardedStore) UpdateCalendar(calendarID int, fn func(*Calendar) error) (Calendar, error) {
+	shard, err := s.calendarShard(calendarID)
+	if err != nil {
+		return Calendar{}, err
+	}
+	return shard.UpdateCalendar(calendarID, fn)
+}
+
+func (s *shardedStore) DeleteCalendar(calendarID int) error {
+	shard, err := s.calendarShard(calendarID)
+	if err != nil {
+		return err
+	}
+	return shard.DeleteCalendar(calendarID)
+}
+
+func (s *shardedStore) Calendar(calendarID int) (Calendar, error) {
+	shard, err := s.calendarShard(calendarID)
+	if err != nil {
+		return Calendar{}, err
+	}
+	return shard.Calendar(calendarID)
+}
+
+// Calendars merges the calendars the user owns, in the user's shard, with
+// those shared with the user, in the shards of their owners
+func (s *shardedStore) Calendars(userID int) []Calendar {
+	var calendars []Calendar
+	for _, shard := range s.shards {
+		calendars = append(calendars, shard.Calendars(userID)...)
+	}
+	return calendars
+}
+
+func (s *shardedStore) Stats() storeStats {
+	var stats storeStats
+	for _, shard := range s.shards {
+		shardStats := shard.Stats()
+		stats.Events += shardStats.Events
+		stats.Series += shardStats.Series
+		stats.Trashed += shardStats.Trashed
+		stats.AuditEntries += shardStats.AuditEntries
+		stats.PendingDeliveries += shardStats.PendingDeliveries
+		stats.Calendars += shardStats.Calendars
+	}
+	stats.Users = len(s.UserIDs())
+	stats.Subscribers = s.feed.subscriberCount()
+	return stats
+}
+
+func (s *shardedStore) Close() error {
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Close())
+	}
+	return errors.Join(errs...)
+}
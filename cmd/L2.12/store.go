@@ -0,0 +1,757 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventStore is the storage backend used by the business logic functions.
+// Writes name the principal that makes them, for the audit log.
+type EventStore interface {
+	// NextEventID reserves a new unique event ID
+	NextEventID() int
+	// Create stores a new event, failing if its ID is already taken
+	Create(event Event, by principal) error
+	// Update applies fn to a copy of the stored event and saves the result
+	Update(userID, eventID int, by principal, fn func(*Event) error) (Event, error)
+	// CreateExclusive is Create that fails with a *conflictError when the
+	// event overlaps existing events of the user
+	CreateExclusive(event Event, by principal) error
+	// UpdateExclusive is Update that fails with a *conflictError when the
+	// result overlaps events the event did not overlap before
+	UpdateExclusive(userID, eventID int, by principal, fn func(*Event) error) (Event, error)
+	// Move applies fn to a copy of the stored event and hands the result,
+	// together with its edited occurrences, to another user
+	Move(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error)
+	// MoveExclusive is Move that fails with a *conflictError when the moved
+	// events overlap events of the new owner
+	MoveExclusive(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error)
+	// Delete moves an event to the trash; check, if not nil, can veto the
+	// deletion of the current event
+	Delete(userID, eventID int, by principal, check eventCheck) error
+	// Restore moves an event from the trash back into the calendar
+	Restore(userID, eventID int, by principal) (Event, error)
+	// Purge permanently removes the events deleted before cutoff and
+	// returns their number
+	Purge(cutoff time.Time, by principal) (int, error)
+	// Trash returns the deleted events of the user
+	Trash(userID int) []Event
+	// History returns the audit entries of an event, oldest first
+	History(eventID int) []auditEntry
+	// Changes returns the audit entries that concern the calendar of userID
+	// recorded after seq, oldest first, and the sequence number of the
+	// latest entry
+	Changes(userID int, seq int64) ([]auditEntry, int64)
+	// Batch applies several writes to the calendar of a user under one
+	// lock and journals them as one record. If atomic is set and any
+	// write fails, none is applied.
+	Batch(userID int, ops []batchOp, atomic bool, by principal) ([]batchOutcome, error)
+	// Get returns a single stored event
+	Get(userID, eventID int) (Event, error)
+	// Range returns the user's non-recurring events that overlap
+	// [startTime, endTime)
+	Range(userID int, startTime, endTime time.Time) []Event
+	// Series returns all recurring events of the user
+	Series(userID int) []Event
+	// List returns every stored event of the user, recurring or not
+	List(userID int) []Event
+	// UserIDs returns the IDs of the users that have events or invitations
+	UserIDs() []int
+	// GetUser returns the settings of a user; unknown users get defaults
+	GetUser(userID int) User
+	// PutUser stores the settings of a user
+	PutUser(user User) error
+	// UpdateUser changes the settings of a user with fn under the store
+	// lock and returns them
+	UpdateUser(userID int, fn func(*User) error) (User, error)
+	// Reminders returns the reminder deliveries and the time up to which
+	// reminders have been scheduled
+	Reminders() ([]Delivery, time.Time)
+	// UpdateReminders atomically applies a change of the reminder state
+	UpdateReminders(update reminderUpdate) error
+	// Respond records the RSVP of an invitee on the organizer's event;
+	// check, if not nil, can veto the answer
+	Respond(userID, eventID int, status string, by principal, check eventCheck) (Event, error)
+	// Invitations returns the events of other users that list userID as
+	// an attendee
+	Invitations(userID int) []Event
+	// Feed returns the feed that publishes every committed event change
+	Feed() *changeFeed
+	// CreateCalendar stores a new calendar and assigns its ID
+	CreateCalendar(cal Calendar) (Calendar, error)
+	// UpdateCalendar applies fn to a copy of the stored calendar and saves
+	// the result
+	UpdateCalendar(calendarID int, fn func(*Calendar) error) (Calendar, error)
+	// DeleteCalendar removes a calendar that has no events
+	DeleteCalendar(calendarID int) error
+	// Calendar returns a single calendar
+	Calendar(calendarID int) (Calendar, error)
+	// Calendars returns the calendars the user owns or that are shared with
+	// the user
+	Calendars(userID int) []Calendar
+	// Stats counts what the store holds
+	Stats() storeStats
+	// Close flushes pending state and releases resources
+	Close() error
+}
+
+// Store operations recorded by a journal
+const (
+	opPut       = "put"
+	opDelete    = "delete"
+	opUser      = "user"
+	opReminders = "reminders"
+	opMove      = "move"
+	opRestore   = "restore"
+	opPurge     = "purge"
+	opBatch     = "batch"
+
+	opCalendar       = "calendar"
+	opDeleteCalendar = "delete_calendar"
+)
+
+// storeRecord describes a single state change of the store
+type storeRecord struct {
+	Op      string `json:"op"`
+	Event   *Event `json:"event,omitempty"`
+	UserID  int    `json:"user_id,omitempty"`
+	EventID int    `json:"event_id,omitempty"`
+	User    *User  `json:"user,omitempty"`
+	// Events are the moved events of a move record, UserID being their
+	// previous owner, or the purged events of a purge record
+	Events []Event `json:"events,omitempty"`
+	// Actor and Time say who made the change and when, for the audit log
+	Actor *auditActor `json:"actor,omitempty"`
+	Time  time.Time   `json:"time,omitempty"`
+	// Seq numbers the committed records
+	Seq int64 `json:"seq,omitempty"`
+	// Records are the changes of a batch record, which share its actor,
+	// time and sequence number
+	Records []storeRecord `json:"records,omitempty"`
+
+	Reminders *reminderUpdate `json:"reminders,omitempty"`
+	Calendar  *Calendar       `json:"calendar,omitempty"`
+}
+
+// memoryStore keeps all events in memory, grouped by user. Single events are
+// indexed by time span and recurring ones are tracked separately, so range
+// queries do not scan the whole calendar.
+type memoryStore struct {
+	mu     sync.RWMutex
+	events map[int]map[int]Event
+	index  map[int]*intervalTree
+	series map[int]map[int]bool
+	users  map[int]User
+	// eventIDs allocates event IDs without taking the lock
+	eventIDs *sequence
+	// invites maps an attendee to the invitations, event ID to organizer
+	invites map[int]map[int]int
+	// trash keeps the deleted events by user until they are purged
+	trash map[int]map[int]Event
+	// audit is the history of every event, by event ID
+	audit map[int][]auditEntry
+	// auditIndex numbers the audit entries and keeps them by user
+	auditIndex *auditIndex
+	// recordSeq is the sequence number of the latest record
+	recordSeq int64
+
+	deliveries map[string]Delivery
+	watermark  time.Time
+
+	calendars   map[int]Calendar
+	calendarIDs *sequence
+
+	// journal, if set, is called under the write lock before a change is
+	// applied; an error aborts the change
+	journal func(rec storeRecord) error
+	// feed publishes committed changes; replayed records are not published
+	feed *changeFeed
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		events:   make(map[int]map[int]Event),
+		index:    make(map[int]*intervalTree),
+		series:   make(map[int]map[int]bool),
+		users:    make(map[int]User),
+		eventIDs: &sequence{},
+
+		invites:    make(map[int]map[int]int),
+		trash:      make(map[int]map[int]Event),
+		audit:      make(map[int][]auditEntry),
+		auditIndex: newAuditIndex(),
+
+		deliveries: make(map[string]Delivery),
+		feed:       newChangeFeed(),
+
+		calendars:   make(map[int]Calendar),
+		calendarIDs: &sequence{},
+	}
+}
+
+// sequence hands out increasing numbers, starting at 1, without a lock
+type sequence struct {
+	last atomic.Int64
+}
+
+// next returns a number greater than any handed out or observed before
+func (q *sequence) next() int64 {
+	return q.last.Add(1)
+}
+
+// observe makes sure n is never handed out, for numbers read back from a
+// snapshot or the journal
+func (q *sequence) observe(n int64) {
+	for {
+		last := q.last.Load()
+		if n <= last || q.last.CompareAndSwap(last, n) {
+			return
+		}
+	}
+}
+
+// current returns the number handed out or observed last
+func (q *sequence) current() int64 {
+	return q.last.Load()
+}
+
+func (s *memoryStore) NextEventID() int {
+	return int(s.eventIDs.next())
+}
+
+func (s *memoryStore) Create(event Event, by principal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.events[event.UserID][event.EventID]; exists {
+		return conflictf("event ID %d already exists for user %d", event.EventID, event.UserID)
+	}
+	if err := s.checkQuotaLocked(event.UserID, 1); err != nil {
+		return err
+	}
+	if err := s.checkCalendarLocked(event); err != nil {
+		return err
+	}
+	if err := s.checkUIDLocked(event, nil); err != nil {
+		return err
+	}
+	event.Version = 1
+	if err := s.commit(storeRecord{Op: opPut, Event: &event, Actor: actorOf(by)}); err != nil {
+		return err
+	}
+	s.put(event)
+	return nil
+}
+
+func (s *memoryStore) Update(userID, eventID int, by principal, fn func(*Event) error) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events[userID] == nil {
+		return Event{}, notFoundf("user %d has no events", userID)
+	}
+	event, exists := s.events[userID][eventID]
+	if !exists {
+		return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+	}
+	version, uid := event.Version, event.UID
+	if err := fn(&event); err != nil {
+		return Event{}, err
+	}
+	if err := s.checkCalendarLocked(event); err != nil {
+		return Event{}, err
+	}
+	if event.UID != uid {
+		if err := s.checkUIDLocked(event, nil); err != nil {
+			return Event{}, err
+		}
+	}
+	event.Version = version + 1
+	if err := s.commit(storeRecord{Op: opPut, Event: &event, Actor: actorOf(by)}); err != nil {
+		return Event{}, err
+	}
+	s.put(event)
+	return event, nil
+}
+
+// checkUIDLocked fails with a conflict if another event of the owner of
+// event already has its UID; edited occurrences share the UID of their
+// series and are not checked. staged, if not nil, holds the events a batch
+// has written so far, nil for deleted ones. The caller must hold the lock.
+func (s *memoryStore) checkUIDLocked(event Event, staged map[int]*Event) error {
+	if event.UID == "" || event.RecurrenceID != nil {
+		return nil
+	}
+	taken := func(other Event) bool {
+		return other.EventID != event.EventID && other.RecurrenceID == nil && eventUID(other) == event.UID
+	}
+	for eventID, other := range s.events[event.UserID] {
+		if _, written := staged[eventID]; !written && taken(other) {
+			return conflictf("event with uid %q already exists", event.UID)
+		}
+	}
+	for _, other := range staged {
+		if other != nil && taken(*other) {
+			return conflictf("event with uid %q already exists", event.UID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Move(userID, eventID, toUserID int, by principal, fn func(*Event) error) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return moveLocked(s, s, userID, eventID, toUserID, false, by, fn)
+}
+
+// moveLocked hands an event of userID held by from to toUserID, whose events
+// are held by to; from and to are the same store unless the store is
+// sharded. If exclusive is set, the moved events must not overlap events of
+// toUserID. The change is journaled and audited by from. The caller must
+// hold the write locks of both.
+func moveLocked(from, to *memoryStore, userID, eventID, toUserID int, exclusive bool, by principal, fn func(*Event) error) (Event, error) {
+	event, exists := from.events[userID][eventID]
+	if !exists {
+		return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+	}
+	if event.SeriesID != 0 {
+		return Event{}, invalidf("event ID %d is an edited occurrence; move its recurring event %d instead", eventID, event.SeriesID)
+	}
+	version := event.Version
+	if err := fn(&event); err != nil {
+		return Event{}, err
+	}
+	event.Version = version + 1
+	event.UserID = toUserID
+	event.removeAttendee(toUserID)
+	// The calendars of the old owner are not the new owner's
+	if to.checkCalendarLocked(event) != nil {
+		event.CalendarID = primaryCalendarID
+	}
+	if err := to.checkUIDLocked(event, nil); err != nil {
+		return Event{}, err
+	}
+
+	moved := []Event{event}
+	for _, other := range from.events[userID] {
+		if other.SeriesID == eventID {
+			other.UserID = toUserID
+			other.CalendarID = event.CalendarID
+			other.removeAttendee(toUserID)
+			other.Version++
+			moved = append(moved, other)
+		}
+	}
+	if err := to.checkQuotaLocked(toUserID, len(moved)); err != nil {
+		return Event{}, err
+	}
+	if exclusive {
+		seen := make(map[occurrenceKey]bool)
+		var conflicts []Event
+		for _, event := range moved {
+			for _, other := range to.conflictsLocked(event) {
+				if !seen[keyOf(other)] {
+					seen[keyOf(other)] = true
+					conflicts = append(conflicts, other)
+				}
+			}
+		}
+		if len(conflicts) > 0 {
+			return Event{}, &conflictError{Conflicts: conflicts}
+		}
+	}
+	if err := from.commit(storeRecord{Op: opMove, UserID: userID, Events: moved, Actor: actorOf(by)}); err != nil {
+		return Event{}, err
+	}
+	for _, event := range moved {
+		from.remove(userID, event.EventID)
+		to.put(event)
+	}
+	return event, nil
+}
+
+func (s *memoryStore) Delete(userID, eventID int, by principal, check eventCheck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events[userID] == nil {
+		return notFoundf("user %d has no events", userID)
+	}
+	event, exists := s.events[userID][eventID]
+	if !exists {
+		return notFoundf("event ID %d not found for user %d", eventID, userID)
+	}
+	if err := check.verify(event); err != nil {
+		return err
+	}
+	// The edited occurrences of a recurring event go with it
+	recs := []storeRecord{{Op: opDelete, UserID: userID, EventID: eventID}}
+	for _, other := range s.events[userID] {
+		if other.SeriesID == eventID {
+			recs = append(recs, storeRecord{Op: opDelete, UserID: userID, EventID: other.EventID})
+		}
+	}
+	if len(recs) > 1 {
+		return s.commitBatch(recs, by)
+	}
+	now := time.Now().UTC()
+	if err := s.commit(storeRecord{Op: opDelete, UserID: userID, EventID: eventID, Actor: actorOf(by), Time: now}); err != nil {
+		return err
+	}
+	s.discard(userID, eventID, now)
+	return nil
+}
+
+func (s *memoryStore) Get(userID, eventID int) (Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	event, exists := s.events[userID][eventID]
+	if !exists {
+		return Event{}, notFoundf("event ID %d not found for user %d", eventID, userID)
+	}
+	return event, nil
+}
+
+func (s *memoryStore) Range(userID int, startTime, endTime time.Time) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// Collecting the IDs first sizes the result in one allocation
+	var eventIDs []int
+	s.index[userID].query(startTime, endTime, func(eventID int) {
+		eventIDs = append(eventIDs, eventID)
+	})
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	userEvents := s.events[userID]
+	events := make([]Event, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		event := userEvents[eventID]
+		if start, end := event.span(); overlaps(start, end, startTime, endTime) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (s *memoryStore) Series(userID int) []Event {
+	var events []Event
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for eventID := range s.series[userID] {
+		events = append(events, s.events[userID][eventID])
+	}
+	return events
+}
+
+func (s *memoryStore) List(userID int) []Event {
+	var events []Event
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, event := range s.events[userID] {
+		events = append(events, event)
+	}
+	return events
+}
+
+func (s *memoryStore) UserIDs() []int {
+	var userIDs []int
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for userID := range s.events {
+		userIDs = append(userIDs, userID)
+	}
+	for userID := range s.invites {
+		if s.events[userID] == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+func (s *memoryStore) GetUser(userID int) User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if user, exists := s.users[userID]; exists {
+		return user
+	}
+	return User{UserID: userID}
+}
+
+func (s *memoryStore) PutUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commit(storeRecord{Op: opUser, User: &user}); err != nil {
+		return err
+	}
+	s.users[user.UserID] = user
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(userID int, fn func(*User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userID]
+	if !exists {
+		user = User{UserID: userID}
+	}
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	user.UserID = userID
+	if err := s.commit(storeRecord{Op: opUser, User: &user}); err != nil {
+		return User{}, err
+	}
+	s.users[userID] = user
+	return user, nil
+}
+
+// storeStats counts what a store holds, for the metrics
+type storeStats struct {
+	Events            int
+	Series            int
+	Users             int
+	Trashed           int
+	AuditEntries      int
+	PendingDeliveries int
+	// WALRecords are the records logged since the last snapshot
+	WALRecords  int
+	Subscribers int
+	Calendars   int
+}
+
+func (s *memoryStore) Stats() storeStats {
+	stats := storeStats{Subscribers: s.feed.subscriberCount()}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats.Calendars = len(s.calendars)
+	for _, events := range s.events {
+		stats.Events += len(events)
+	}
+	for _, series := range s.series {
+		stats.Series += len(series)
+	}
+	stats.Users = len(s.events)
+	for userID := range s.invites {
+		if s.events[userID] == nil {
+			stats.Users++
+		}
+	}
+	for _, events := range s.trash {
+		stats.Trashed += len(events)
+	}
+	for _, entries := range s.audit {
+		stats.AuditEntries += len(entries)
+	}
+	for _, delivery := range s.deliveries {
+		if delivery.Status == deliveryPending {
+			stats.PendingDeliveries++
+		}
+	}
+	return stats
+}
+
+func (s *memoryStore) Feed() *changeFeed {
+	return s.feed
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// commit stamps a change with the current time unless it has one, passes it
+// to the journal and, once it is durable, to the change feed and the audit
+// log; the caller must hold the write lock
+func (s *memoryStore) commit(rec storeRecord) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	s.recordSeq++
+	rec.Seq = s.recordSeq
+	if s.journal != nil {
+		if err := s.journal(rec); err != nil {
+			return err
+		}
+	}
+	s.feed.publish(s.changesLocked(rec))
+	s.auditLocked(rec)
+	return nil
+}
+
+// commitBatch journals several changes as a single record, so that they are
+// recovered all together or not at all, and applies them one after the
+// other; the caller must hold the write lock
+func (s *memoryStore) commitBatch(recs []storeRecord, by principal) error {
+	batch := storeRecord{Op: opBatch, Records: recs, Actor: actorOf(by), Time: time.Now().UTC()}
+	s.recordSeq++
+	batch.Seq = s.recordSeq
+	if s.journal != nil {
+		if err := s.journal(batch); err != nil {
+			return err
+		}
+	}
+	for _, rec := range recs {
+		rec.Actor, rec.Time = batch.Actor, batch.Time
+		s.feed.publish(s.changesLocked(rec))
+		if err := s.mutate(rec, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply replays a journaled change; the caller must hold the write lock
+func (s *memoryStore) apply(rec storeRecord) error {
+	// A record the snapshot already covers has its audit entries in there
+	audit := rec.Seq == 0 || rec.Seq > s.recordSeq
+	if rec.Seq > s.recordSeq {
+		s.recordSeq = rec.Seq
+	}
+	if rec.Op != opBatch {
+		return s.mutate(rec, audit)
+	}
+	for _, sub := range rec.Records {
+		sub.Actor, sub.Time = rec.Actor, rec.Time
+		if err := s.mutate(sub, audit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutate applies a single change, recording it in the audit log first if
+// audit is set; the caller must hold the write lock
+func (s *memoryStore) mutate(rec storeRecord, audit bool) error {
+	if (rec.Op == opPut || rec.Op == opRestore) && rec.Event == nil {
+		return fmt.Errorf("%s record without event", rec.Op)
+	}
+	if (rec.Op == opCalendar || rec.Op == opDeleteCalendar) && rec.Calendar == nil {
+		return fmt.Errorf("%s record without calendar", rec.Op)
+	}
+	if audit {
+		s.auditLocked(rec)
+	}
+	switch rec.Op {
+	case opPut:
+		s.put(*rec.Event)
+		s.eventIDs.observe(int64(rec.Event.EventID))
+	case opDelete:
+		s.discard(rec.UserID, rec.EventID, rec.Time)
+	case opUser:
+		if rec.User == nil {
+			return fmt.Errorf("user record without user")
+		}
+		s.users[rec.User.UserID] = *rec.User
+	case opMove:
+		s.move(rec.UserID, rec.Events)
+	case opRestore:
+		s.forget(rec.Event.UserID, rec.Event.EventID)
+		s.put(*rec.Event)
+	case opPurge:
+		for _, event := range rec.Events {
+			s.forget(event.UserID, event.EventID)
+		}
+	case opReminders:
+		if rec.Reminders == nil {
+			return fmt.Errorf("reminders record without update")
+		}
+		s.applyReminders(*rec.Reminders)
+	case opCalendar:
+		s.calendars[rec.Calendar.CalendarID] = *rec.Calendar
+		s.calendarIDs.observe(int64(rec.Calendar.CalendarID))
+	case opDeleteCalendar:
+		delete(s.calendars, rec.Calendar.CalendarID)
+	default:
+		return fmt.Errorf("unknown record op %q", rec.Op)
+	}
+	return nil
+}
+
+func (s *memoryStore) put(event Event) {
+	if s.events[event.UserID] == nil {
+		s.events[event.UserID] = make(map[int]Event)
+	}
+	if old, exists := s.events[event.UserID][event.EventID]; exists {
+		s.unindex(old)
+	}
+	s.events[event.UserID][event.EventID] = event
+	s.reindex(event)
+}
+
+// move replaces events of userID with their moved copies
+func (s *memoryStore) move(userID int, moved []Event) {
+	for _, event := range moved {
+		s.remove(userID, event.EventID)
+		s.put(event)
+	}
+}
+
+func (s *memoryStore) remove(userID, eventID int) {
+	old, exists := s.events[userID][eventID]
+	if !exists {
+		return
+	}
+	s.unindex(old)
+	delete(s.events[userID], eventID)
+	if len(s.events[userID]) == 0 {
+		delete(s.events, userID)
+	}
+}
+
+// reindex adds an event to the interval index or the series set, and its
+// attendees to the invitation index
+func (s *memoryStore) reindex(event Event) {
+	s.indexAttendees(event)
+	if event.RRule != "" {
+		if s.series[event.UserID] == nil {
+			s.series[event.UserID] = make(map[int]bool)
+		}
+		s.series[event.UserID][event.EventID] = true
+		return
+	}
+	tree := s.index[event.UserID]
+	if tree == nil {
+		tree = &intervalTree{}
+		s.index[event.UserID] = tree
+	}
+	tree.insert(event)
+}
+
+// unindex removes an event from the interval index or the series set, and
+// its attendees from the invitation index
+func (s *memoryStore) unindex(event Event) {
+	s.unindexAttendees(event)
+	if event.RRule != "" {
+		delete(s.series[event.UserID], event.EventID)
+		if len(s.series[event.UserID]) == 0 {
+			delete(s.series, event.UserID)
+		}
+		return
+	}
+	if tree := s.index[event.UserID]; tree != nil {
+		tree.remove(event)
+		if tree.size == 0 {
+			delete(s.index, event.UserID)
+		}
+	}
+}
+
+// allUsers returns the settings of every user; the caller must hold at
+// least the read lock
+func (s *memoryStore) allUsers() []User {
+	var users []User
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// all returns every stored event; the caller must hold at least the read lock
+func (s *memoryStore) all() []Event {
+	var events []Event
+	for _, userEvents := range s.events {
+		for _, event := range userEvents {
+			events = append(events, event)
+		}
+	}
+	return events
+}
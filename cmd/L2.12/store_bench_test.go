@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchSizes = []int{1000, 10000, 50000}
+
+// newBenchStore fills a store with n events of user 1 spread over five years,
+// mostly short meetings plus some multi-day events
+func newBenchStore(b *testing.B, n int) *memoryStore {
+	// The benchmark calendars are larger than the default quota allows
+	limit := maxEventsPerUser
+	maxEventsPerUser = 0
+	b.Cleanup(func() { maxEventsPerUser = limit })
+	s := newMemoryStore()
+	rng := rand.New(rand.NewPCG(1, 2))
+	base := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		start := base.Add(time.Duration(rng.Int64N(int64(5 * 365 * 24 * time.Hour))))
+		duration := time.Duration(30+rng.IntN(150)) * time.Minute
+		if i%100 == 0 {
+			duration = time.Duration(1+rng.IntN(5)) * 24 * time.Hour
+		}
+		event := Event{
+			UserID:    1,
+			EventID:   s.NextEventID(),
+			Title:     fmt.Sprintf("event %d", i),
+			StartTime: start,
+			EndTime:   start.Add(duration),
+		}
+		if err := s.Create(event, systemActor); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkRangeMonth(b *testing.B) {
+	from := time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("events=%d", n), func(b *testing.B) {
+			s := newBenchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Range(1, from, to)
+			}
+		})
+	}
+}
+
+// BenchmarkRangeMonthLinearScan is the previous full scan of the user's
+// events, kept as a baseline for BenchmarkRangeMonth
+func BenchmarkRangeMonthLinearScan(b *testing.B) {
+	from := time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("events=%d", n), func(b *testing.B) {
+			s := newBenchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var events []Event
+				s.mu.RLock()
+				for _, event := range s.events[1] {
+					if start, end := event.span(); overlaps(start, end, from, to) {
+						events = append(events, event)
+					}
+				}
+				s.mu.RUnlock()
+			}
+		})
+	}
+}
+
+func BenchmarkEventsForMonth(b *testing.B) {
+	from := time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("events=%d", n), func(b *testing.B) {
+			saved := store
+			store = newBenchStore(b, n)
+			b.Cleanup(func() { store = saved })
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				getEventsForRange(1, from, to)
+			}
+		})
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	s := newBenchStore(b, 10000)
+	base := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := base.Add(time.Duration(i) * time.Minute)
+		s.Create(Event{UserID: 1, EventID: s.NextEventID(), StartTime: start, EndTime: start.Add(time.Hour)}, systemActor)
+	}
+}
+
+// mixedUsers and mixedEventsPerUser size the store of BenchmarkMixedParallel
+const (
+	mixedUsers         = 1000
+	mixedEventsPerUser = 50
+)
+
+// fillMixedStore gives every user a year of events and returns their IDs
+func fillMixedStore(s EventStore) [][]int {
+	rng := rand.New(rand.NewPCG(3, 4))
+	base := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	eventIDs := make([][]int, mixedUsers+1)
+	for userID := 1; userID <= mixedUsers; userID++ {
+		for i := 0; i < mixedEventsPerUser; i++ {
+			start := base.Add(time.Duration(rng.Int64N(int64(365 * 24 * time.Hour))))
+			event := Event{
+				UserID:    userID,
+				EventID:   s.NextEventID(),
+				Title:     fmt.Sprintf("event %d", i),
+				StartTime: start,
+				EndTime:   start.Add(time.Hour),
+			}
+			if err := s.Create(event, systemActor); err != nil {
+				panic(err)
+			}
+			eventIDs[userID] = append(eventIDs[userID], event.EventID)
+		}
+	}
+	return eventIDs
+}
+
+// BenchmarkMixedParallel runs mixed traffic of many users from GOMAXPROCS
+// goroutines: 60% month ranges, 20% single reads, 10% creates and 10%
+// updates. Compare the stores across processor counts with
+//
+//	go test -run '^$' -bench MixedParallel -cpu 1,2,4,8
+func BenchmarkMixedParallel(b *testing.B) {
+	from := time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	for _, backend := range []struct {
+		name string
+		open func() EventStore
+	}{
+		{"store=memory", func() EventStore { return newMemoryStore() }},
+		{"store=sharded", func() EventStore { return newShardedStore(64) }},
+	} {
+		b.Run(backend.name, func(b *testing.B) {
+			s := backend.open()
+			eventIDs := fillMixedStore(s)
+			var seed atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(seed.Add(1), 5))
+				for pb.Next() {
+					userID := 1 + rng.IntN(mixedUsers)
+					eventID := eventIDs[userID][rng.IntN(mixedEventsPerUser)]
+					switch n := rng.IntN(10); {
+					case n < 6:
+						s.Range(userID, from, to)
+					case n < 8:
+						s.Get(userID, eventID)
+					case n < 9:
+						// New events go a year later, so that the ranges keep
+						// their cost as the store grows
+						start := from.AddDate(1, 0, 0).Add(time.Duration(rng.IntN(365*24)) * time.Hour)
+						s.Create(Event{UserID: userID, EventID: s.NextEventID(), StartTime: start, EndTime: start.Add(time.Hour)}, systemActor)
+					default:
+						s.Update(userID, eventID, systemActor, func(event *Event) error {
+							event.Title = "updated"
+							return nil
+						})
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+		})
+	}
+}
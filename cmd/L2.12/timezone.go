@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Layouts accepted for event times without an explicit UTC offset; they are
+// interpreted in the time zone of the event
+var localTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// allDayWindowSlack widens store queries so that all-day events, which are
+// stored at midnight UTC, are found for windows in any time zone
+const allDayWindowSlack = 14 * time.Hour
+
+// User holds the per-user settings
+type User struct {
+	UserID   int    `json:"user_id"`
+	TimeZone string `json:"time_zone,omitempty"`
+	// StrictConflicts rejects writes that overlap existing events
+	StrictConflicts bool `json:"strict_conflicts,omitempty"`
+	// WebhookURL receives the user's event reminders
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// location returns the user's time zone, UTC if none is set
+func (u User) location() *time.Location {
+	loc, err := loadLocation(u.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// location returns the time zone of the event, UTC if none is set
+func (e *Event) location() *time.Location {
+	loc, err := loadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// loadLocation loads an IANA time zone; an empty name means UTC
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, invalidf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// parseEventTime parses an RFC 3339 timestamp, a local date-time interpreted
+// in loc, or a bare date; dateOnly reports the last case
+func parseEventTime(value string, loc *time.Location) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, false, nil
+		}
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("want RFC 3339 timestamp or YYYY-MM-DD date, got %q", value)
+}
+
+// setEventTimes fills the start, end, kind and time zone of a new event; an
+// event without a time zone gets the user's zone
+func setEventTimes(event *Event, startValue, endValue, timeZone string, allDay bool) error {
+	if timeZone == "" && !allDay {
+		timeZone = store.GetUser(event.UserID).TimeZone
+	}
+	return assignEventTimes(event, startValue, endValue, timeZone, allDay)
+}
+
+// assignEventTimes parses and validates the times of an event. An event is
+// all-day when allDay is set or both values are bare dates; all-day events
+// are stored as dates at midnight UTC and have no time zone. It does not
+// touch the store, so it is safe inside store update functions.
+func assignEventTimes(event *Event, startValue, endValue, timeZone string, allDay bool) error {
+	loc, err := loadLocation(timeZone)
+	if err != nil {
+		return err
+	}
+
+	startTime, startDate, err := parseEventTime(startValue, loc)
+	if err != nil {
+		return invalidf("invalid start_time: %s", err)
+	}
+	endTime, endDate, err := parseEventTime(endValue, loc)
+	if err != nil {
+		return invalidf("invalid end_time: %s", err)
+	}
+	if startDate != endDate && !allDay {
+		return invalidf("start_time and end_time must both be dates or both be timestamps")
+	}
+	if endTime.Before(startTime) {
+		return invalidf("end_time must not be before start_time")
+	}
+
+	if allDay || startDate {
+		event.AllDay = true
+		event.TimeZone = ""
+		event.StartTime = dateOf(startTime)
+		event.EndTime = dateOf(endTime)
+		return nil
+	}
+	event.AllDay = false
+	event.TimeZone = timeZone
+	event.StartTime = startTime
+	event.EndTime = endTime
+	return nil
+}
+
+// dateOf returns the calendar date of t as midnight UTC
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// floatingDate returns the all-day date d as local midnight in loc
+func floatingDate(d time.Time, loc *time.Location) time.Time {
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+}
+
+// inWindow reports whether the event overlaps [startTime, endTime); the dates
+// of an all-day event are taken in the time zone of startTime
+func (e *Event) inWindow(startTime, endTime time.Time) bool {
+	if e.AllDay {
+		loc := startTime.Location()
+		start := floatingDate(e.StartTime, loc)
+		end := floatingDate(e.EndTime, loc).AddDate(0, 0, 1)
+		return overlaps(start, end, startTime, endTime)
+	}
+	start, end := e.span()
+	return overlaps(start, end, startTime, endTime)
+}
+
+// requestLocation returns the time zone of a query: the tz parameter, then
+// the user's stored zone, then UTC
+func requestLocation(params url.Values, userID int) (*time.Location, error) {
+	if tz := params.Get("tz"); tz != "" {
+		return loadLocation(tz)
+	}
+	return store.GetUser(userID).location(), nil
+}
+
+// parseInstant parses a timestamp parameter; a bare date or local date-time
+// is taken in loc
+func parseInstant(params url.Values, key string, loc *time.Location) (time.Time, error) {
+	value := params.Get(key)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing %s parameter", key)
+	}
+	t, dateOnly, err := parseEventTime(value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s parameter: %s", key, err)
+	}
+	if dateOnly {
+		return floatingDate(t, loc), nil
+	}
+	return t.In(loc), nil
+}
+
+// parseDay parses a date parameter as local midnight in loc; a timestamp is
+// reduced to its local date
+func parseDay(params url.Values, key string, loc *time.Location) (time.Time, error) {
+	t, err := parseInstant(params, key, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc), nil
+}
+
+// Handler for GET /v1/users/{user_id}/settings
+func getUserSettingsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": store.GetUser(userID)})
+}
+
+// userSettingsRequest is the JSON body of PATCH /v1/users/{user_id}/settings
+type userSettingsRequest struct {
+	TimeZone        *string `json:"time_zone"`
+	StrictConflicts *bool   `json:"strict_conflicts"`
+	WebhookURL      *string `json:"webhook_url"`
+}
+
+// Handler for PATCH /v1/users/{user_id}/settings
+func patchUserSettingsV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	var req userSettingsRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	// The values are checked first; the store then applies them to the
+	// current settings, so concurrent changes of other settings are kept
+	if req.TimeZone != nil {
+		*req.TimeZone = strings.TrimSpace(*req.TimeZone)
+		if _, err := loadLocation(*req.TimeZone); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	}
+	if req.WebhookURL != nil {
+		*req.WebhookURL = strings.TrimSpace(*req.WebhookURL)
+		if err := validateWebhookURL(*req.WebhookURL); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	}
+	user, err := store.UpdateUser(userID, func(user *User) error {
+		if req.TimeZone != nil {
+			user.TimeZone = *req.TimeZone
+		}
+		if req.StrictConflicts != nil {
+			user.StrictConflicts = *req.StrictConflicts
+		}
+		if req.WebhookURL != nil {
+			user.WebhookURL = *req.WebhookURL
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": user})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestPatchUserSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   User
+	}{
+		{"time zone", `{"time_zone":" Europe/Berlin "}`, http.StatusOK, User{UserID: 1, TimeZone: "Europe/Berlin", StrictConflicts: true}},
+		{"strict mode", `{"strict_conflicts":false}`, http.StatusOK, User{UserID: 1, TimeZone: "UTC"}},
+		{"unknown time zone", `{"time_zone":"Mars/Olympus"}`, http.StatusBadRequest, User{UserID: 1, TimeZone: "UTC", StrictConflicts: true}},
+		{"private webhook", `{"strict_conflicts":false,"webhook_url":"http://127.0.0.1/"}`, http.StatusBadRequest, User{UserID: 1, TimeZone: "UTC", StrictConflicts: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := newAPITest(t)
+			store.PutUser(User{UserID: 1, TimeZone: "UTC", StrictConflicts: true})
+			if status, body := test.do(t, principal{UserID: 1}, "PATCH", "/v1/users/1/settings", tt.body); status != tt.status {
+				t.Fatalf("got status %d, want %d: %v", status, tt.status, body)
+			}
+			if got := store.GetUser(1); got != tt.want {
+				t.Errorf("got settings %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// interleavingStore makes another change of the settings just before the
+// first write of settings reaches the store, as a concurrent request would
+type interleavingStore struct {
+	*memoryStore
+	once  sync.Once
+	other func()
+}
+
+func (s *interleavingStore) PutUser(user User) error {
+	s.once.Do(s.other)
+	return s.memoryStore.PutUser(user)
+}
+
+func (s *interleavingStore) UpdateUser(userID int, fn func(*User) error) (User, error) {
+	s.once.Do(s.other)
+	return s.memoryStore.UpdateUser(userID, fn)
+}
+
+func TestPatchUserSettingsConcurrent(t *testing.T) {
+	test := newAPITest(t)
+	s := &interleavingStore{memoryStore: newMemoryStore()}
+	s.other = func() {
+		s.memoryStore.UpdateUser(1, func(user *User) error {
+			user.StrictConflicts = true
+			return nil
+		})
+	}
+	store = s
+
+	if status, body := test.do(t, principal{UserID: 1}, "PATCH", "/v1/users/1/settings", `{"time_zone":"Asia/Tokyo"}`); status != http.StatusOK {
+		t.Fatalf("got status %d: %v", status, body)
+	}
+	if user := store.GetUser(1); user.TimeZone != "Asia/Tokyo" || !user.StrictConflicts {
+		t.Errorf("got settings %+v, want both changes", user)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// discard moves a stored event to the trash of its owner; the caller must
+// hold the write lock
+func (s *memoryStore) discard(userID, eventID int, at time.Time) {
+	event, exists := s.events[userID][eventID]
+	if !exists {
+		return
+	}
+	s.remove(userID, eventID)
+	event.DeletedAt = &at
+	if s.trash[userID] == nil {
+		s.trash[userID] = make(map[int]Event)
+	}
+	s.trash[userID][eventID] = event
+}
+
+// forget removes an event from the trash for good; the caller must hold the
+// write lock
+func (s *memoryStore) forget(userID, eventID int) {
+	delete(s.trash[userID], eventID)
+	if len(s.trash[userID]) == 0 {
+		delete(s.trash, userID)
+	}
+}
+
+// Restore moves an event from the trash back into the calendar of its owner,
+// together with the edited occurrences that were deleted with it
+func (s *memoryStore) Restore(userID, eventID int, by principal) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event, exists := s.trash[userID][eventID]
+	if !exists {
+		return Event{}, notFoundf("event ID %d is not in the trash of user %d", eventID, userID)
+	}
+	if _, exists := s.events[userID][eventID]; exists {
+		return Event{}, conflictf("event ID %d already exists for user %d", eventID, userID)
+	}
+	restored := []Event{event}
+	for _, other := range s.trash[userID] {
+		if other.SeriesID == eventID && other.DeletedAt != nil && event.DeletedAt != nil &&
+			other.DeletedAt.Equal(*event.DeletedAt) {
+			if _, exists := s.events[userID][other.EventID]; !exists {
+				restored = append(restored, other)
+			}
+		}
+	}
+	if err := s.checkQuotaLocked(userID, len(restored)); err != nil {
+		return Event{}, err
+	}
+	recs := make([]storeRecord, len(restored))
+	for i := range restored {
+		restored[i].DeletedAt = nil
+		restored[i].Version++
+		// The calendar may have been deleted in the meantime
+		if s.checkCalendarLocked(restored[i]) != nil {
+			restored[i].CalendarID = primaryCalendarID
+		}
+		recs[i] = storeRecord{Op: opRestore, Event: &restored[i]}
+	}
+	if len(recs) > 1 {
+		if err := s.commitBatch(recs, by); err != nil {
+			return Event{}, err
+		}
+		return restored[0], nil
+	}
+	event = restored[0]
+	if err := s.commit(storeRecord{Op: opRestore, Event: &event, Actor: actorOf(by)}); err != nil {
+		return Event{}, err
+	}
+	s.forget(userID, eventID)
+	s.put(event)
+	return event, nil
+}
+
+// Purge permanently removes the events that were deleted before cutoff and
+// returns how many there were
+func (s *memoryStore) Purge(cutoff time.Time, by principal) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged []Event
+	for _, userTrash := range s.trash {
+		for _, event := range userTrash {
+			if event.DeletedAt == nil || event.DeletedAt.Before(cutoff) {
+				purged = append(purged, event)
+			}
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	if err := s.commit(storeRecord{Op: opPurge, Events: purged, Actor: actorOf(by)}); err != nil {
+		return 0, err
+	}
+	for _, event := range purged {
+		s.forget(event.UserID, event.EventID)
+	}
+	return len(purged), nil
+}
+
+func (s *memoryStore) Trash(userID int) []Event {
+	var events []Event
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, event := range s.trash[userID] {
+		events = append(events, event)
+	}
+	return events
+}
+
+// trashed returns every event in the trash; the caller must hold at least the
+// read lock
+func (s *memoryStore) trashed() []Event {
+	var events []Event
+	for _, userTrash := range s.trash {
+		for _, event := range userTrash {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (s *fileStore) Restore(userID, eventID int, by principal) (Event, error) {
+	defer s.compact()
+	return s.memoryStore.Restore(userID, eventID, by)
+}
+
+func (s *fileStore) Purge(cutoff time.Time, by principal) (int, error) {
+	defer s.compact()
+	return s.memoryStore.Purge(cutoff, by)
+}
+
+func restoreEvent(userID, eventID int, by principal) (Event, error) {
+	return store.Restore(userID, eventID, by)
+}
+
+// trashPurger empties the trash of events deleted longer than retention ago
+type trashPurger struct {
+	retention time.Duration
+	interval  time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTrashPurger(retention, interval time.Duration) *trashPurger {
+	return &trashPurger{
+		retention: retention,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs the purger in the background until Stop is called
+func (p *trashPurger) Start() {
+	go p.run()
+}
+
+// Stop ends the purger and waits for a running purge to finish
+func (p *trashPurger) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *trashPurger) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.purge(time.Now())
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *trashPurger) purge(now time.Time) {
+	n, err := store.Purge(now.Add(-p.retention), systemActor)
+	if err != nil {
+		slog.Error("trash: purge failed", "err", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("trash: purged deleted events", "count", n, "retention", p.retention.String())
+	}
+}
+
+// Handler for POST /restore_event
+func restoreEventHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := r.Form
+
+	userID, err := requestUserID(r, params)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	eventID, err := parseInt(params, "event_id")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := restoreEvent(userID, eventID, callerOf(r)); err != nil {
+		respondWithLegacyError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "Event restored"})
+}
+
+// Handler for GET /v1/users/{user_id}/trash?tag=...; lists the deleted events, the
+// most recently deleted first
+func listTrashV1(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	events := filter.filterEvents(store.Trash(userID))
+	if events == nil {
+		events = []Event{}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].DeletedAt.Equal(*events[j].DeletedAt) {
+			return events[i].DeletedAt.After(*events[j].DeletedAt)
+		}
+		return events[i].EventID < events[j].EventID
+	})
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": events})
+}
+
+// Handler for POST /v1/users/{user_id}/trash/{event_id}/restore
+func restoreEventV1(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := eventPath(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := restoreEvent(userID, eventID, callerOf(r))
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Location", eventLocation(userID, eventID))
+	respondWithEvent(w, http.StatusOK, event)
+}